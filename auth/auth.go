@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"log"
+	"miniblog/utils"
+	"net/http"
+	"strings"
+)
+
+// LEGACY_USER_ID_HEADER is trusted only if Config.LegacyHeader is set.
+const LEGACY_USER_ID_HEADER = "System-Design-User-Id"
+const API_KEY_HEADER = "X-API-Key"
+
+var InvalidCredentials = errors.New("invalid credentials")
+
+type contextKey struct{}
+
+// WithUserId returns a copy of ctx carrying the authenticated user id.
+func WithUserId(ctx context.Context, userId string) context.Context {
+	return context.WithValue(ctx, contextKey{}, userId)
+}
+
+// UserId returns the authenticated user id, empty if the request is anonymous.
+func UserId(ctx context.Context) string {
+	userId, _ := ctx.Value(contextKey{}).(string)
+	return userId
+}
+
+type Config struct {
+	// HS256Secret verifies HS256 signed tokens, disabled if empty
+	HS256Secret []byte
+	// RS256PublicKey verifies RS256 signed tokens, disabled if nil
+	RS256PublicKey *rsa.PublicKey
+	// Issuer is required in the iss claim of tokens, not checked if empty
+	Issuer string
+	// Audience is required in the aud claim of tokens, not checked if empty
+	Audience string
+	// APIKeys maps static keys of service accounts to their user ids
+	APIKeys map[string]string
+	// LegacyHeader makes System-Design-User-Id header trusted
+	LegacyHeader bool
+}
+
+// ConfigFromEnv reads the authentication config:
+// AUTH_JWT_HS256_SECRET, AUTH_JWT_RS256_PUBLIC_KEY_FILE, AUTH_JWT_ISSUER, AUTH_JWT_AUDIENCE,
+// AUTH_API_KEYS as comma separated "key:userId" pairs, and AUTH_LEGACY_HEADER.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		HS256Secret:  []byte(utils.GetEnvVarWithDefault("AUTH_JWT_HS256_SECRET", "")),
+		Issuer:       utils.GetEnvVarWithDefault("AUTH_JWT_ISSUER", ""),
+		Audience:     utils.GetEnvVarWithDefault("AUTH_JWT_AUDIENCE", ""),
+		APIKeys:      make(map[string]string),
+		LegacyHeader: utils.GetEnvVarWithDefault("AUTH_LEGACY_HEADER", "false") == "true",
+	}
+	if keyFile := utils.GetEnvVarWithDefault("AUTH_JWT_RS256_PUBLIC_KEY_FILE", ""); keyFile != "" {
+		pem, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read RS256 public key: %w", err)
+		}
+		config.RS256PublicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse RS256 public key: %w", err)
+		}
+	}
+	if apiKeys := utils.GetEnvVarWithDefault("AUTH_API_KEYS", ""); apiKeys != "" {
+		for _, pair := range strings.Split(apiKeys, ",") {
+			key, userId := splitPair(pair)
+			if key == "" || userId == "" {
+				return config, fmt.Errorf("invalid API key entry %q, expected key:userId", pair)
+			}
+			config.APIKeys[key] = userId
+		}
+	}
+	return config, nil
+}
+
+func splitPair(pair string) (string, string) {
+	i := strings.LastIndex(pair, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+}
+
+type Authenticator struct {
+	config Config
+}
+
+func CreateAuthenticator(config Config) *Authenticator {
+	return &Authenticator{config: config}
+}
+
+func (a *Authenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method {
+	case jwt.SigningMethodHS256:
+		if len(a.config.HS256Secret) > 0 {
+			return a.config.HS256Secret, nil
+		}
+	case jwt.SigningMethodRS256:
+		if a.config.RS256PublicKey != nil {
+			return a.config.RS256PublicKey, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+}
+
+// verifyClaims checks the claims ParseWithClaims does not require: tokens must expire,
+// have a subject and be issued by the configured issuer to the configured audience.
+func (a *Authenticator) verifyClaims(claims *jwt.RegisteredClaims) error {
+	if claims.ExpiresAt == nil {
+		return fmt.Errorf("token has no expiration time: %w", InvalidCredentials)
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("token has no subject: %w", InvalidCredentials)
+	}
+	if a.config.Issuer != "" && !claims.VerifyIssuer(a.config.Issuer, true) {
+		return fmt.Errorf("token has unexpected issuer %q: %w", claims.Issuer, InvalidCredentials)
+	}
+	if a.config.Audience != "" && !claims.VerifyAudience(a.config.Audience, true) {
+		return fmt.Errorf("token has unexpected audience %v: %w", claims.Audience, InvalidCredentials)
+	}
+	return nil
+}
+
+// Authenticate returns the user id of the request, empty if the request has no credentials.
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		tokenString := strings.TrimPrefix(authorization, "Bearer ")
+		if tokenString == authorization {
+			return "", fmt.Errorf("unsupported authorization scheme: %w", InvalidCredentials)
+		}
+		var claims jwt.RegisteredClaims
+		_, err := jwt.ParseWithClaims(tokenString, &claims, a.keyFunc)
+		if err != nil {
+			return "", fmt.Errorf("invalid token: %s %w", err.Error(), InvalidCredentials)
+		}
+		if err = a.verifyClaims(&claims); err != nil {
+			return "", err
+		}
+		return claims.Subject, nil
+	}
+	if apiKey := r.Header.Get(API_KEY_HEADER); apiKey != "" {
+		userId, found := a.config.APIKeys[apiKey]
+		if !found {
+			return "", fmt.Errorf("unknown API key: %w", InvalidCredentials)
+		}
+		return userId, nil
+	}
+	if a.config.LegacyHeader {
+		return r.Header.Get(LEGACY_USER_ID_HEADER), nil
+	}
+	return "", nil
+}
+
+// Middleware puts the authenticated user id into the request context.
+// Requests with invalid credentials are rejected, requests without credentials
+// are passed anonymous, handlers requiring a user reject them.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := a.Authenticate(r)
+		if err != nil {
+			log.Printf("Authentication failed: %s", err.Error())
+			http.Error(w, "Invalid user token", http.StatusUnauthorized)
+			return
+		}
+		if userId != "" {
+			r = r.WithContext(WithUserId(r.Context(), userId))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package feedstream
+
+import (
+	"context"
+	"sync"
+)
+
+// Publisher delivers events to the readers of their topics connected at the moment.
+type Publisher interface {
+	Publish(ctx context.Context, events []Event) error
+}
+
+// Broadcaster is a Publisher that readers subscribe to.
+type Broadcaster interface {
+	Publisher
+	// Subscribe returns the events of the topic published until unsubscribe is called.
+	// The channel is closed by unsubscribe, or if the reader falls behind by more than SUBSCRIBER_BUFFER events:
+	// the reader is expected to read the missed state from the storage.
+	Subscribe(ctx context.Context, topic string) (events <-chan Event, unsubscribe func(), err error)
+}
+
+const SUBSCRIBER_BUFFER = 64
+
+type subscriber struct {
+	events chan Event
+}
+
+// InMemoryBroadcaster delivers events to the readers connected to this process only.
+type InMemoryBroadcaster struct {
+	mut sync.Mutex
+	// subscribers[topic] - readers of the topic
+	subscribers map[string]map[*subscriber]struct{}
+}
+
+func CreateInMemoryBroadcaster() *InMemoryBroadcaster {
+	return &InMemoryBroadcaster{subscribers: make(map[string]map[*subscriber]struct{})}
+}
+
+func (b *InMemoryBroadcaster) Publish(ctx context.Context, events []Event) error {
+	for _, event := range events {
+		b.deliver(event)
+	}
+	return nil
+}
+
+// deliver sends the event to the readers of its topic without waiting for them,
+// readers that fall behind are dropped.
+func (b *InMemoryBroadcaster) deliver(event Event) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	for sub := range b.subscribers[event.Topic] {
+		select {
+		case sub.events <- event:
+		default:
+			b.removeLocked(event.Topic, sub)
+		}
+	}
+}
+
+func (b *InMemoryBroadcaster) Subscribe(ctx context.Context, topic string) (<-chan Event, func(), error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	sub := &subscriber{events: make(chan Event, SUBSCRIBER_BUFFER)}
+	if b.subscribers[topic] == nil {
+		b.subscribers[topic] = make(map[*subscriber]struct{})
+	}
+	b.subscribers[topic][sub] = struct{}{}
+	unsubscribe := func() {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+		b.removeLocked(topic, sub)
+	}
+	return sub.events, unsubscribe, nil
+}
+
+// readers returns the number of readers of the topic.
+func (b *InMemoryBroadcaster) readers(topic string) int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return len(b.subscribers[topic])
+}
+
+func (b *InMemoryBroadcaster) removeLocked(topic string, sub *subscriber) {
+	if _, found := b.subscribers[topic][sub]; !found {
+		return
+	}
+	delete(b.subscribers[topic], sub)
+	if len(b.subscribers[topic]) == 0 {
+		delete(b.subscribers, topic)
+	}
+	close(sub.events)
+}
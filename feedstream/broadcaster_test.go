@@ -0,0 +1,93 @@
+package feedstream
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"miniblog/storage/models"
+	"testing"
+)
+
+type testPost struct {
+	models.Post `json:"-"`
+	Id          string   `json:"id"`
+	AuthorId    string   `json:"authorId"`
+	Text        string   `json:"text"`
+	Mentions    []string `json:"-"`
+}
+
+func (p *testPost) GetId() string {
+	return p.Id
+}
+
+func (p *testPost) GetAuthorId() string {
+	return p.AuthorId
+}
+
+func (p *testPost) GetText() string {
+	return p.Text
+}
+
+func (p *testPost) GetMentions() []string {
+	return p.Mentions
+}
+
+func TestInMemoryBroadcasterDeliversToReadersOfTopic(t *testing.T) {
+	ctx := context.Background()
+	b := CreateInMemoryBroadcaster()
+	events, unsubscribe, err := b.Subscribe(ctx, FeedTopic("reader"))
+	require.NoError(t, err)
+	other, unsubscribeOther, err := b.Subscribe(ctx, FeedTopic("other"))
+	require.NoError(t, err)
+	defer unsubscribeOther()
+
+	feedEvents, err := NewFeedEvents(&testPost{Id: "p1"}, []string{"reader"})
+	require.NoError(t, err)
+	require.NoError(t, b.Publish(ctx, feedEvents))
+	event := <-events
+	require.Equal(t, FeedPostEvent, event.Type)
+	require.Equal(t, "p1", event.Id)
+	require.JSONEq(t, `{"id": "p1", "authorId": "", "text": ""}`, string(event.Data))
+	require.Empty(t, other)
+
+	unsubscribe()
+	_, open := <-events
+	require.False(t, open)
+	require.NoError(t, b.Publish(ctx, feedEvents))
+	require.Zero(t, b.readers(FeedTopic("reader")))
+}
+
+func TestInMemoryBroadcasterDropsSlowReaders(t *testing.T) {
+	ctx := context.Background()
+	b := CreateInMemoryBroadcaster()
+	events, unsubscribe, err := b.Subscribe(ctx, PostTopic("p"))
+	require.NoError(t, err)
+
+	event, err := NewPostDeletedEvent("p")
+	require.NoError(t, err)
+	for i := 0; i <= SUBSCRIBER_BUFFER; i++ {
+		require.NoError(t, b.Publish(ctx, []Event{event}))
+	}
+	for i := 0; i < SUBSCRIBER_BUFFER; i++ {
+		<-events
+	}
+	_, open := <-events
+	require.False(t, open)
+	// unsubscribing a dropped reader is a no-op
+	unsubscribe()
+}
+
+func TestNewPostNotificationsNotifyEachUserOnce(t *testing.T) {
+	post := &testPost{Id: "p", AuthorId: "author", Text: "quote", Mentions: []string{"replied", "mentioned", "author"}}
+	events, err := NewPostNotifications(post, "replied", "quoted")
+	require.NoError(t, err)
+
+	var topics []string
+	for _, event := range events {
+		require.Equal(t, NotificationEvent, event.Type)
+		topics = append(topics, event.Topic)
+	}
+	require.Equal(t, []string{NotificationsTopic("replied"), NotificationsTopic("quoted"), NotificationsTopic("mentioned")}, topics)
+	require.JSONEq(t, `{"kind": "reply", "userId": "author", "postId": "p"}`, string(events[0].Data))
+	require.JSONEq(t, `{"kind": "quote", "userId": "author", "postId": "p"}`, string(events[1].Data))
+	require.JSONEq(t, `{"kind": "mention", "userId": "author", "postId": "p"}`, string(events[2].Data))
+}
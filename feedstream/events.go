@@ -0,0 +1,145 @@
+package feedstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"miniblog/storage/models"
+)
+
+// Event is delivered to the readers of Topic, Id is the id of the post the event is about.
+type Event struct {
+	Topic string          `json:"topic"`
+	Type  string          `json:"type"`
+	Id    string          `json:"id"`
+	Data  json.RawMessage `json:"data"`
+	// ReplyToAuthorId is set on events of author topics about replies, which are only in the feeds
+	// of the readers following the replied author too
+	ReplyToAuthorId string `json:"replyToAuthorId,omitempty"`
+}
+
+// types of events
+const (
+	// FeedPostEvent is a post added to the feed, Data is the post as it is returned in the feed
+	FeedPostEvent = "feedPost"
+	// NotificationEvent is a Notification of the user
+	NotificationEvent = "notification"
+	// PostUpdatedEvent is a post changed by its author or by counters, Data is the post
+	PostUpdatedEvent = "postUpdated"
+	// PostDeletedEvent is a deleted post, Data has its id only
+	PostDeletedEvent = "postDeleted"
+)
+
+func FeedTopic(userId string) string {
+	return "feed:" + userId
+}
+
+func NotificationsTopic(userId string) string {
+	return "notifications:" + userId
+}
+
+// AuthorTopic has the new posts of the author that are not added to feeds by fan-out but merged into them on read,
+// the feed readers following the author subscribe to it.
+func AuthorTopic(authorId string) string {
+	return "author:" + authorId
+}
+
+func PostTopic(postId string) string {
+	return "post:" + postId
+}
+
+// kinds of notifications
+const (
+	MentionNotification      = "mention"
+	ReplyNotification        = "reply"
+	RepostNotification       = "repost"
+	QuoteNotification        = "quote"
+	SubscriptionNotification = "subscription"
+)
+
+// Notification tells the user about an action of another user concerning them.
+type Notification struct {
+	Kind string `json:"kind"`
+	// UserId is the user whose action caused the notification
+	UserId string `json:"userId"`
+	// PostId is the post of the action, empty for subscriptions
+	PostId string `json:"postId,omitempty"`
+}
+
+func newEvent(topic string, eventType string, id string, data interface{}) (Event, error) {
+	rawData, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to dump %s event to json: %w", eventType, err)
+	}
+	return Event{Topic: topic, Type: eventType, Id: id, Data: rawData}, nil
+}
+
+// NewFeedEvents returns events of the post added to feeds of users.
+func NewFeedEvents(post models.Post, userIds []string) ([]Event, error) {
+	events := make([]Event, 0, len(userIds))
+	for _, userId := range userIds {
+		event, err := newEvent(FeedTopic(userId), FeedPostEvent, post.GetId(), post)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// NewAuthorPostEvent returns the event of the author's post merged into the feeds of followers on read.
+func NewAuthorPostEvent(post models.Post, replyToAuthorId string) (Event, error) {
+	event, err := newEvent(AuthorTopic(post.GetAuthorId()), FeedPostEvent, post.GetId(), post)
+	event.ReplyToAuthorId = replyToAuthorId
+	return event, err
+}
+
+func NewPostUpdatedEvent(post models.Post) (Event, error) {
+	return newEvent(PostTopic(post.GetId()), PostUpdatedEvent, post.GetId(), post)
+}
+
+func NewPostDeletedEvent(postId string) (Event, error) {
+	return newEvent(PostTopic(postId), PostDeletedEvent, postId, map[string]string{"id": postId})
+}
+
+func newNotificationEvent(userId string, notification Notification) (Event, error) {
+	return newEvent(NotificationsTopic(userId), NotificationEvent, notification.PostId, notification)
+}
+
+// NewPostNotifications returns notifications about the new post to the authors of the replied
+// and reposted posts and to the mentioned users, one per user. Empty author ids are skipped.
+func NewPostNotifications(post models.Post, replyToAuthorId string, repostOfAuthorId string) ([]Event, error) {
+	repostKind := QuoteNotification
+	if post.GetText() == "" {
+		repostKind = RepostNotification
+	}
+	kinds := []struct {
+		kind    string
+		userIds []string
+	}{
+		{ReplyNotification, []string{replyToAuthorId}},
+		{repostKind, []string{repostOfAuthorId}},
+		{MentionNotification, post.GetMentions()},
+	}
+	notified := map[string]bool{"": true, post.GetAuthorId(): true}
+	var events []Event
+	for _, kind := range kinds {
+		for _, userId := range kind.userIds {
+			if notified[userId] {
+				continue
+			}
+			notified[userId] = true
+			notification := Notification{Kind: kind.kind, UserId: post.GetAuthorId(), PostId: post.GetId()}
+			event, err := newNotificationEvent(userId, notification)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// NewSubscriptionNotification returns the notification of the user about the new subscriber.
+func NewSubscriptionNotification(userId string, subscriber string) (Event, error) {
+	return newNotificationEvent(userId, Notification{Kind: SubscriptionNotification, UserId: subscriber})
+}
@@ -0,0 +1,101 @@
+package feedstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"sync"
+)
+
+// RedisPublisher publishes events to the Redis channels named by their topics,
+// so that they are delivered by the replica the reader is connected to.
+type RedisPublisher struct {
+	client *redis.Client
+}
+
+func CreateRedisPublisher(redisUrl string) *RedisPublisher {
+	return &RedisPublisher{
+		client: redis.NewClient(&redis.Options{
+			Addr: redisUrl,
+		}),
+	}
+}
+
+func (p *RedisPublisher) Publish(ctx context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	_, err := p.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, event := range events {
+			rawEvent, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			pipe.Publish(ctx, event.Topic, rawEvent)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish %d events: %w", len(events), err)
+	}
+	return nil
+}
+
+// RedisBroadcaster subscribes one Redis connection per replica to the channels of topics
+// that have readers connected to the replica, and delivers the received events to them.
+type RedisBroadcaster struct {
+	*RedisPublisher
+	pubsub *redis.PubSub
+	local  *InMemoryBroadcaster
+	// mut orders subscriptions of the channels with their unsubscriptions
+	mut sync.Mutex
+}
+
+func CreateRedisBroadcaster(redisUrl string) *RedisBroadcaster {
+	publisher := CreateRedisPublisher(redisUrl)
+	b := &RedisBroadcaster{
+		RedisPublisher: publisher,
+		pubsub:         publisher.client.Subscribe(context.Background()),
+		local:          CreateInMemoryBroadcaster(),
+	}
+	go b.receive()
+	return b
+}
+
+func (b *RedisBroadcaster) receive() {
+	for message := range b.pubsub.Channel() {
+		var event Event
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			log.Printf("Failed to decode event from %s: %s", message.Channel, err.Error())
+			continue
+		}
+		event.Topic = message.Channel
+		b.local.deliver(event)
+	}
+}
+
+func (b *RedisBroadcaster) Subscribe(ctx context.Context, topic string) (<-chan Event, func(), error) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if b.local.readers(topic) == 0 {
+		if err := b.pubsub.Subscribe(ctx, topic); err != nil {
+			return nil, nil, fmt.Errorf("failed to subscribe to %s: %w", topic, err)
+		}
+	}
+	events, unsubscribeLocal, _ := b.local.Subscribe(ctx, topic)
+	unsubscribe := func() {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+
+		unsubscribeLocal()
+		if b.local.readers(topic) == 0 {
+			if err := b.pubsub.Unsubscribe(context.Background(), topic); err != nil {
+				log.Printf("Failed to unsubscribe from %s: %s", topic, err.Error())
+			}
+		}
+	}
+	return events, unsubscribe, nil
+}
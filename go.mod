@@ -6,10 +6,12 @@ require (
 	github.com/RichardKnop/machinery v1.10.6
 	github.com/getkin/kin-openapi v0.75.0
 	github.com/go-redis/redis/v8 v8.11.4
+	github.com/golang-jwt/jwt/v4 v4.3.0
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
 	github.com/motemen/go-loghttp v0.0.0-20170804080138-974ac5ceac27
 	github.com/motemen/go-nuts v0.0.0-20210915132349-615a782f2c69 // indirect
 	github.com/stretchr/testify v1.7.0
 	go.mongodb.org/mongo-driver v1.7.2
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 )
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"miniblog/auth"
+	"miniblog/storage"
+	"net/http"
+	"path"
+)
+
+// reactionPath parses /posts/{postId}/likes and /posts/{postId}/reactions/{reaction}.
+// The reaction is empty if it is not one of storage.Reactions, likes have their own path.
+func reactionPath(urlPath string) (postId string, reaction string) {
+	if path.Base(urlPath) == "likes" {
+		return path.Base(path.Dir(urlPath)), storage.Like
+	}
+	postId = path.Base(path.Dir(path.Dir(urlPath)))
+	for _, r := range storage.Reactions {
+		if r == path.Base(urlPath) && r != storage.Like {
+			return postId, r
+		}
+	}
+	return postId, ""
+}
+
+func writeReactionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.NotFoundError) {
+		http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, storage.ClientError) {
+		log.Printf("Client error while processing reactions: %s", err.Error())
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Failed to process reactions: %s", err.Error())
+	http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+}
+
+func (h *HTTPHandler) HandleAddReaction(w http.ResponseWriter, r *http.Request) {
+	postId, reaction := reactionPath(r.URL.Path)
+	if reaction == "" {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.Storage.AddReaction(r.Context(), postId, userId, reaction)
+	if err != nil {
+		writeReactionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"context"
+	"net"
+)
+
+type connContextKey struct{}
+
+// ConnContext keeps the connection of requests in their context, so that streaming handlers
+// manage its deadlines. Must be set as ConnContext of the server.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+func connFromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connContextKey{}).(net.Conn)
+	return conn
+}
@@ -2,12 +2,17 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"miniblog/auth"
+	"miniblog/storage"
 	"net/http"
 )
 
 type CreatePostRequestData struct {
-	Text string `json:"text"`
+	Text           string  `json:"text"`
+	ReplyToPostId  *string `json:"replyToPostId"`
+	RepostOfPostId *string `json:"repostOfPostId"`
 }
 
 func (h *HTTPHandler) HandleCreatePost(w http.ResponseWriter, r *http.Request) {
@@ -18,14 +23,30 @@ func (h *HTTPHandler) HandleCreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId := r.Header.Get("System-Design-User-Id")
+	userId := auth.UserId(r.Context())
 	if userId == "" {
 		http.Error(w, "Invalid user token", http.StatusUnauthorized)
 		return
 	}
 
-	post, err := h.Storage.AddPost(r.Context(), userId, data.Text)
+	options := storage.PostOptions{ReplyToPostId: data.ReplyToPostId, RepostOfPostId: data.RepostOfPostId}
+	post, err := h.Storage.AddPost(r.Context(), userId, data.Text, options)
 	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			log.Printf("Referenced post was not found: %s", err.Error())
+			http.Error(w, "Replied or reposted post was not found.", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.Conflict) {
+			log.Printf("Conflict while adding post: %s", err.Error())
+			http.Error(w, "Post is already reposted.", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while adding post: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
 		log.Printf("Failed to add post: %s", err.Error())
 		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
 		return
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"miniblog/auth"
+	"miniblog/storage"
+	"net/http"
+	"net/url"
+	"regexp"
+	"unicode/utf8"
+)
+
+var handleRegexp = regexp.MustCompile(`^[a-z0-9_]{3,30}$`)
+
+const (
+	MAX_DISPLAY_NAME_LENGTH = 50
+	MAX_BIO_LENGTH          = 160
+	MAX_AVATAR_URL_LENGTH   = 2048
+)
+
+type UserRequestData struct {
+	Handle      *string `json:"handle"`
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	AvatarUrl   *string `json:"avatarUrl"`
+}
+
+func (d *UserRequestData) validate() error {
+	if d.Handle != nil && !handleRegexp.MatchString(*d.Handle) {
+		return fmt.Errorf("handle must consist of 3 to 30 lowercase letters, digits or underscores")
+	}
+	if d.DisplayName != nil && utf8.RuneCountInString(*d.DisplayName) > MAX_DISPLAY_NAME_LENGTH {
+		return fmt.Errorf("display name must be at most %d characters long", MAX_DISPLAY_NAME_LENGTH)
+	}
+	if d.Bio != nil && utf8.RuneCountInString(*d.Bio) > MAX_BIO_LENGTH {
+		return fmt.Errorf("bio must be at most %d characters long", MAX_BIO_LENGTH)
+	}
+	if d.AvatarUrl != nil && *d.AvatarUrl != "" {
+		avatarUrl, err := url.Parse(*d.AvatarUrl)
+		if err != nil || len(*d.AvatarUrl) > MAX_AVATAR_URL_LENGTH ||
+			(avatarUrl.Scheme != "http" && avatarUrl.Scheme != "https") || avatarUrl.Host == "" {
+			return fmt.Errorf("avatar url must be an absolute http(s) url")
+		}
+	}
+	return nil
+}
+
+func (d *UserRequestData) profile() storage.UserProfile {
+	return storage.UserProfile{
+		Handle:      d.Handle,
+		DisplayName: d.DisplayName,
+		Bio:         d.Bio,
+		AvatarUrl:   d.AvatarUrl,
+	}
+}
+
+func writeUserError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.Conflict) {
+		log.Printf("Conflict while saving user: %s", err.Error())
+		http.Error(w, "User is already registered or handle is taken.", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, storage.NotFoundError) {
+		http.Error(w, "User was not found.", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, storage.ClientError) {
+		log.Printf("Client error while saving user: %s", err.Error())
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Internal error while saving user: %s", err.Error())
+	http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+}
+
+func writeUser(w http.ResponseWriter, user interface{}) {
+	rawResponse, err := json.Marshal(user)
+	if err != nil {
+		log.Printf("Failed to dump user to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rawResponse)
+}
+
+func (h *HTTPHandler) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	var data UserRequestData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if data.Handle == nil {
+		http.Error(w, "handle is required", http.StatusBadRequest)
+		return
+	}
+	if err = data.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.Storage.CreateUser(r.Context(), userId, data.profile())
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeUser(w, user)
+}
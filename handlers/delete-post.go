@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"miniblog/auth"
+	"miniblog/storage"
+	"net/http"
+	"path"
+)
+
+func (h *HTTPHandler) HandleDeletePost(w http.ResponseWriter, r *http.Request) {
+	postId := path.Base(r.URL.Path)
+
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.Storage.DeletePost(r.Context(), postId, userId)
+	if err != nil {
+		if errors.Is(err, storage.Forbidden) {
+			log.Printf("Forbidden error while deleting post: %s", err.Error())
+			http.Error(w, "Post is owned by another user.", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, storage.NotFoundError) {
+			log.Printf("Not Found error while deleting post: %s", err.Error())
+			http.Error(w, "Post not found.", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while deleting post: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Internal error while deleting post: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"miniblog/storage/models"
+	"net/http"
+)
+
+// postWithAuthor is a post serialized with the profile of its author in "author" field.
+type postWithAuthor struct {
+	models.Post
+	author models.User
+}
+
+func (p *postWithAuthor) MarshalJSON() ([]byte, error) {
+	rawPost, err := json.Marshal(p.Post)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(rawPost, &fields); err != nil {
+		return nil, err
+	}
+	if fields["author"], err = json.Marshal(p.author); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+func embedRequested(r *http.Request, field string) bool {
+	for _, embed := range r.URL.Query()["embed"] {
+		if embed == field {
+			return true
+		}
+	}
+	return false
+}
+
+// embedAuthors returns posts with authors' profiles embedded if requested by "embed=author" parameter.
+// Posts of users without a profile are returned as is.
+func (h *HTTPHandler) embedAuthors(r *http.Request, posts []models.Post) ([]models.Post, error) {
+	if !embedRequested(r, "author") || len(posts) == 0 {
+		return posts, nil
+	}
+	authorIds := make([]string, 0, len(posts))
+	seen := make(map[string]bool)
+	for _, post := range posts {
+		if !seen[post.GetAuthorId()] {
+			seen[post.GetAuthorId()] = true
+			authorIds = append(authorIds, post.GetAuthorId())
+		}
+	}
+	authors, err := h.Storage.GetUsers(r.Context(), authorIds)
+	if err != nil {
+		return nil, err
+	}
+	authorsById := make(map[string]models.User, len(authors))
+	for _, author := range authors {
+		authorsById[author.GetId()] = author
+	}
+
+	result := make([]models.Post, 0, len(posts))
+	for _, post := range posts {
+		if author, found := authorsById[post.GetAuthorId()]; found {
+			result = append(result, &postWithAuthor{Post: post, author: author})
+		} else {
+			result = append(result, post)
+		}
+	}
+	return result, nil
+}
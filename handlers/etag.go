@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"hash/fnv"
+	"miniblog/storage/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// postETag is derived from the post version, which is incremented on every patch, and from the post counters,
+// which change without a new version, e.g. "3-9f86d081884c7d65".
+func postETag(post models.Post) string {
+	counters := fnv.New64a()
+	write := func(name string, count int64) {
+		counters.Write([]byte(name + "=" + strconv.FormatInt(count, 10) + ";"))
+	}
+	write("likes", post.GetLikeCount())
+	write("replies", post.GetReplyCount())
+	write("reposts", post.GetRepostCount())
+	write("quotes", post.GetQuoteCount())
+	reactionCounts := post.GetReactionCounts()
+	reactions := make([]string, 0, len(reactionCounts))
+	for reaction := range reactionCounts {
+		reactions = append(reactions, reaction)
+	}
+	sort.Strings(reactions)
+	for _, reaction := range reactions {
+		write("reaction:"+reaction, reactionCounts[reaction])
+	}
+	return `"` + strconv.FormatInt(post.GetVersion(), 10) + "-" + strconv.FormatUint(counters.Sum64(), 16) + `"`
+}
+
+// parseETag returns the post version of a strong ETag. Counters are not compared,
+// so a post can be edited after its reactions changed.
+func parseETag(etag string) (int64, bool) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	value := etag[1 : len(etag)-1]
+	if dash := strings.IndexByte(value, '-'); dash >= 0 {
+		value = value[:dash]
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	return version, err == nil
+}
+
+// etagMatches tells if etag is in the list of If-None-Match header, using weak comparison.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
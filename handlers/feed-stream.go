@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"miniblog/auth"
+	"miniblog/feedstream"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FEED_STREAM_HEARTBEAT is the interval of comments keeping idle streams open through proxies
+var FEED_STREAM_HEARTBEAT = 5 * time.Second
+
+// FEED_STREAM_REPLAY_PAGES bounds the number of posts replayed to a reconnected stream, in pages of the feed
+var FEED_STREAM_REPLAY_PAGES = 10
+
+// FEED_STREAM_WRITE_TIMEOUT closes streams of clients not reading an event for this time
+var FEED_STREAM_WRITE_TIMEOUT = 10 * time.Second
+
+// FEED_STREAM_RETRY_MS is the reconnection delay suggested to clients
+var FEED_STREAM_RETRY_MS = 1000
+
+const feedStreamReplayPageSize = 100
+
+type feedStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// conn is the connection of the stream, nil if it is unknown
+	conn net.Conn
+	// sent - ids of posts sent to the stream, so that live events do not repeat replayed posts
+	sent map[string]bool
+}
+
+func (s *feedStream) write(format string, args ...interface{}) error {
+	// the write timeout of the server applies to the whole response, the stream bounds each write instead
+	if s.conn != nil {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(FEED_STREAM_WRITE_TIMEOUT)); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// send writes the post with its id as the event id, so that a reconnected client passes it in Last-Event-ID.
+func (s *feedStream) send(postId string, data []byte) error {
+	if s.sent[postId] {
+		return nil
+	}
+	s.sent[postId] = true
+	return s.write("id: %s\ndata: %s\n\n", postId, data)
+}
+
+// HandleFeedStream sends posts added to the feed of the user as server-sent events.
+// Clients reconnect with the id of the last received post in Last-Event-ID header.
+func (h *HTTPHandler) HandleFeedStream(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Response writer does not support streaming")
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before reading the feed, so that posts added meanwhile are not missed
+	events, unsubscribe, err := h.subscribeFeed(r.Context(), userId)
+	if err != nil {
+		log.Printf("Failed to subscribe to feed: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	defer unsubscribe()
+
+	var missed []models.Post
+	lastEventId := r.Header.Get("Last-Event-ID")
+	found := true
+	if lastEventId != "" {
+		missed, found, err = h.missedFeedPosts(r.Context(), userId, lastEventId)
+		if err != nil {
+			log.Printf("Failed to get missed feed posts: %s", err.Error())
+			http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	stream := &feedStream{w: w, flusher: flusher, conn: connFromContext(r.Context()), sent: make(map[string]bool)}
+	if err = stream.write("retry: %d\n\n", FEED_STREAM_RETRY_MS); err != nil {
+		return
+	}
+	if !found {
+		// the last event is unknown or too many posts were missed, the client has to read the feed again
+		if err = stream.write("event: reset\ndata: {}\n\n"); err != nil {
+			return
+		}
+	}
+	for _, post := range missed {
+		data, err := json.Marshal(post)
+		if err != nil {
+			log.Printf("Failed to dump post to json: %s", err.Error())
+			return
+		}
+		if err = stream.send(post.GetId(), data); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(FEED_STREAM_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				// the stream fell behind, the client reconnects and reads the missed posts from the feed
+				return
+			}
+			err = stream.send(event.Id, event.Data)
+		case <-heartbeat.C:
+			err = stream.write(": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// missedFeedPosts returns posts of the feed newer than the post with id lastEventId, oldest first,
+// and whether all of them fit into FEED_STREAM_REPLAY_PAGES pages. The id of the last event is the token
+// of the feed pages newer than it, see storage.Storage.FeedSince.
+func (h *HTTPHandler) missedFeedPosts(ctx context.Context, userId string, lastEventId string) ([]models.Post, bool, error) {
+	var missed []models.Post
+	since := lastEventId
+	for i := 0; i < FEED_STREAM_REPLAY_PAGES; i++ {
+		posts, nextSince, err := h.Storage.FeedSince(ctx, userId, since, feedStreamReplayPageSize)
+		if errors.Is(err, storage.ClientError) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		missed = append(missed, posts...)
+		if nextSince == nil {
+			return missed, true, nil
+		}
+		since = *nextSince
+	}
+	return nil, false, nil
+}
+
+// subscribeFeed returns the events of posts added to the feed of the user, including posts of followed authors
+// that are merged into the feed on read, see feedstream.AuthorTopic. The channel is closed like the one
+// of feedstream.Broadcaster.Subscribe.
+func (h *HTTPHandler) subscribeFeed(ctx context.Context, userId string) (<-chan feedstream.Event, func(), error) {
+	authors, err := h.Storage.GetFanoutOnReadAuthors(ctx, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(authors) == 0 {
+		return h.FeedEvents.Subscribe(ctx, feedstream.FeedTopic(userId))
+	}
+	subscriptions, err := h.Storage.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	// replies of the authors are in the feed if the user follows the replied author too
+	following := map[string]bool{userId: true}
+	for _, subscription := range subscriptions {
+		following[subscription] = true
+	}
+
+	topics := []string{feedstream.FeedTopic(userId)}
+	for _, author := range authors {
+		topics = append(topics, feedstream.AuthorTopic(author))
+	}
+	merged := make(chan feedstream.Event, feedstream.SUBSCRIBER_BUFFER)
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(done) }) }
+	var unsubscribes []func()
+	var forwarders sync.WaitGroup
+	unsubscribe := func() {
+		stop()
+		for _, unsubscribeTopic := range unsubscribes {
+			unsubscribeTopic()
+		}
+		forwarders.Wait()
+	}
+	for _, topic := range topics {
+		events, unsubscribeTopic, err := h.FeedEvents.Subscribe(ctx, topic)
+		if err != nil {
+			unsubscribe()
+			return nil, nil, err
+		}
+		unsubscribes = append(unsubscribes, unsubscribeTopic)
+		forwarders.Add(1)
+		go func() {
+			defer forwarders.Done()
+			// a closed channel of any topic closes the merged one, so that the reader reconnects
+			defer stop()
+			for {
+				var event feedstream.Event
+				var open bool
+				select {
+				case event, open = <-events:
+					if !open {
+						return
+					}
+				case <-done:
+					return
+				}
+				if event.ReplyToAuthorId != "" && !following[event.ReplyToAuthorId] {
+					continue
+				}
+				select {
+				case merged <- event:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		<-done
+		forwarders.Wait()
+		close(merged)
+	}()
+	return merged, unsubscribe, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"miniblog/auth"
 	"miniblog/storage"
 	"miniblog/storage/models"
 	"net/http"
@@ -16,7 +17,11 @@ type FeedResponse struct {
 }
 
 func (h *HTTPHandler) HandleFeed(w http.ResponseWriter, r *http.Request) {
-	userId := r.Header.Get("System-Design-User-Id")
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
 
 	cgiPage, found := r.URL.Query()["page"]
 	var page *string = nil
@@ -35,9 +40,22 @@ func (h *HTTPHandler) HandleFeed(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	posts, nextPage, err := h.Storage.Feed(r.Context(), &userId, page, size)
+	// since reads the feed forward from the post, for clients catching up on posts added while they were offline
+	cgiSince, found := r.URL.Query()["since"]
+	var posts []models.Post
+	var nextPage *string
+	var err error
+	if found {
+		if page != nil {
+			http.Error(w, "Only one of page and since may be specified", http.StatusBadRequest)
+			return
+		}
+		posts, nextPage, err = h.Storage.FeedSince(r.Context(), userId, cgiSince[0], size)
+	} else {
+		posts, nextPage, err = h.Storage.Feed(r.Context(), &userId, page, size)
+	}
 	if err != nil {
-		if errors.As(err, &storage.ClientError) {
+		if errors.Is(err, storage.ClientError) {
 			log.Printf("Client error while getting posts for author: %s", err.Error())
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -47,6 +65,13 @@ func (h *HTTPHandler) HandleFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	posts, err = h.embedAuthors(r, posts)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
 	postsResponse := PostByUserIdResponse{
 		posts,
 		nextPage,
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"miniblog/auth"
+	"net/http"
+)
+
+type FeedUnreadCountResponse struct {
+	Count int `json:"count"`
+}
+
+func (h *HTTPHandler) HandleGetFeedUnreadCount(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	count, err := h.Storage.GetFeedUnreadCount(r.Context(), userId)
+	if err != nil {
+		log.Printf("Failed to get feed unread count: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(FeedUnreadCountResponse{count})
+	if err != nil {
+		log.Printf("Failed to dump feed unread count to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
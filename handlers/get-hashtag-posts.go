@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/storage"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+func (h *HTTPHandler) HandleGetHashtagPosts(w http.ResponseWriter, r *http.Request) {
+	hashtag, ok := storage.NormalizeHashtag(path.Base(path.Dir(r.URL.Path)))
+	if !ok {
+		http.Error(w, "Invalid hashtag", http.StatusBadRequest)
+		return
+	}
+
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	posts, nextPage, err := h.Storage.GetPostsByHashtag(r.Context(), hashtag, page, size)
+	if err != nil {
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while getting posts by hashtag: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to get posts by hashtag: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = h.embedAuthors(r, posts)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(PostByUserIdResponse{posts, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump posts by hashtag to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
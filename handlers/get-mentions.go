@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/auth"
+	"miniblog/storage"
+	"net/http"
+	"strconv"
+)
+
+func (h *HTTPHandler) HandleGetMentions(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	posts, nextPage, err := h.Storage.GetPostsMentioning(r.Context(), userId, page, size)
+	if err != nil {
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while getting mentions: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to get mentions: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = h.embedAuthors(r, posts)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(PostByUserIdResponse{posts, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump mentions to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
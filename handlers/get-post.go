@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"miniblog/storage"
+	"miniblog/storage/models"
 	"net/http"
 	"path"
 )
@@ -13,11 +14,11 @@ func (h *HTTPHandler) HandleGetPost(w http.ResponseWriter, r *http.Request) {
 	postId := path.Base(r.URL.Path)
 	post, err := h.Storage.GetPost(r.Context(), postId)
 	if err != nil {
-		if errors.As(err, &storage.NotFoundError) {
+		if errors.Is(err, storage.NotFoundError) {
 			http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
 			return
 		}
-		if errors.As(err, &storage.ClientError) {
+		if errors.Is(err, storage.ClientError) {
 			log.Printf("Client error while getting posts for author: %s", err.Error())
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -26,8 +27,24 @@ func (h *HTTPHandler) HandleGetPost(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
 		return
 	}
+	// embedded author may change without changing the post, so its ETag would not identify the response
+	if !embedRequested(r, "author") {
+		etag := postETag(post)
+		w.Header().Set("ETag", etag)
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	embedded, err := h.embedAuthors(r, []models.Post{post})
+	if err != nil {
+		log.Printf("Failed to embed author: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	rawResponse, err := json.Marshal(post)
+	rawResponse, err := json.Marshal(embedded[0])
 	if err != nil {
 		log.Printf("Failed to dump post to json: %s", err.Error())
 		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
@@ -38,7 +38,7 @@ func (h *HTTPHandler) HandleGetPosts(w http.ResponseWriter, r *http.Request) {
 
 	posts, nextPage, err := h.Storage.GetPostsByUserId(r.Context(), &userId, page, size)
 	if err != nil {
-		if errors.As(err, &storage.ClientError) {
+		if errors.Is(err, storage.ClientError) {
 			log.Printf("Client error while getting posts for author: %s", err.Error())
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -48,6 +48,13 @@ func (h *HTTPHandler) HandleGetPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	posts, err = h.embedAuthors(r, posts)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
 	postsResponse := PostByUserIdResponse{
 		posts,
 		nextPage,
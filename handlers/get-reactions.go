@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type ReactionsResponse struct {
+	UserIds  []string `json:"userIds,omitempty"`
+	NextPage *string  `json:"nextPage,omitempty"`
+}
+
+func (h *HTTPHandler) HandleGetReactions(w http.ResponseWriter, r *http.Request) {
+	postId, reaction := reactionPath(r.URL.Path)
+	if reaction == "" {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	userIds, nextPage, err := h.Storage.GetReactions(r.Context(), postId, reaction, page, size)
+	if err != nil {
+		writeReactionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(ReactionsResponse{userIds, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump reactions to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
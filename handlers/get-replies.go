@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+type RepliesResponse struct {
+	Replies  []models.Post `json:"replies,omitempty"`
+	NextPage *string       `json:"nextPage,omitempty"`
+}
+
+// getReplies returns the page of replies to postId requested by "page" and "size" parameters,
+// with authors embedded if requested. On failure the error is written to w and ok is false.
+func (h *HTTPHandler) getReplies(w http.ResponseWriter, r *http.Request, postId string) (replies []models.Post, nextPage *string, ok bool) {
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return nil, nil, false
+		}
+	}
+
+	replies, nextPage, err := h.Storage.GetReplies(r.Context(), postId, page, size)
+	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
+			return nil, nil, false
+		}
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while getting replies: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		log.Printf("Failed to get replies: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	replies, err = h.embedAuthors(r, replies)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return replies, nextPage, true
+}
+
+func (h *HTTPHandler) HandleGetReplies(w http.ResponseWriter, r *http.Request) {
+	postId := path.Base(path.Dir(r.URL.Path))
+
+	replies, nextPage, ok := h.getReplies(w, r, postId)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(RepliesResponse{replies, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump replies to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
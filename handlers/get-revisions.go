@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+type RevisionsResponse struct {
+	Revisions []models.Revision `json:"revisions,omitempty"`
+	NextPage  *string           `json:"nextPage,omitempty"`
+}
+
+func (h *HTTPHandler) HandleGetRevisions(w http.ResponseWriter, r *http.Request) {
+	postId := path.Base(path.Dir(r.URL.Path))
+
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	revisions, nextPage, err := h.Storage.GetRevisions(r.Context(), postId, page, size)
+	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while getting revisions: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to get revisions: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(RevisionsResponse{revisions, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump revisions to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"miniblog/auth"
 	"miniblog/storage"
 	"net/http"
 )
@@ -13,14 +14,14 @@ type Subscribers struct {
 }
 
 func (h *HTTPHandler) HandleGetSubscribers(w http.ResponseWriter, r *http.Request) {
-	userId := r.Header.Get("System-Design-User-Id")
+	userId := auth.UserId(r.Context())
 	if userId == "" {
 		http.Error(w, "Invalid user token", http.StatusUnauthorized)
 		return
 	}
 	subscriptions, err := h.Storage.GetSubscribers(r.Context(), userId)
 	if err != nil {
-		if errors.As(err, &storage.ClientError) {
+		if errors.Is(err, storage.ClientError) {
 			log.Printf("Client error while getting subscriptions for user: %s", err.Error())
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"net/http"
+	"path"
+)
+
+// MAX_THREAD_ANCESTORS limits the ancestor chain of a thread, the most distant ancestors are dropped.
+var MAX_THREAD_ANCESTORS = 50
+
+type ThreadResponse struct {
+	// Ancestors are the posts replied by the post, the root post first
+	Ancestors []models.Post `json:"ancestors,omitempty"`
+	Post      models.Post   `json:"post"`
+	Replies   []models.Post `json:"replies,omitempty"`
+	NextPage  *string       `json:"nextPage,omitempty"`
+}
+
+// getAncestors returns up to MAX_THREAD_ANCESTORS posts replied by post, the most distant first.
+// The chain ends at a deleted post.
+func (h *HTTPHandler) getAncestors(r *http.Request, post models.Post) ([]models.Post, error) {
+	var ancestors []models.Post
+	for post.GetReplyToPostId() != "" && len(ancestors) < MAX_THREAD_ANCESTORS {
+		var err error
+		post, err = h.Storage.GetPost(r.Context(), post.GetReplyToPostId())
+		if errors.Is(err, storage.NotFoundError) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, post)
+	}
+	for i, j := 0, len(ancestors)-1; i < j; i, j = i+1, j-1 {
+		ancestors[i], ancestors[j] = ancestors[j], ancestors[i]
+	}
+	return ancestors, nil
+}
+
+func (h *HTTPHandler) HandleGetThread(w http.ResponseWriter, r *http.Request) {
+	postId := path.Base(path.Dir(r.URL.Path))
+
+	post, err := h.Storage.GetPost(r.Context(), postId)
+	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to get post: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	ancestors, err := h.getAncestors(r, post)
+	if err != nil {
+		log.Printf("Failed to get ancestors of post: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	posts, err := h.embedAuthors(r, append(ancestors, post))
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	replies, nextPage, ok := h.getReplies(w, r, postId)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(ThreadResponse{posts[:len(ancestors)], posts[len(ancestors)], replies, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump thread to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
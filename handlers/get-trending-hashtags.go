@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"miniblog/trending"
+	"net/http"
+	"strconv"
+)
+
+type TrendingHashtagsResponse struct {
+	Tags []trending.TagCount `json:"tags"`
+}
+
+func (h *HTTPHandler) HandleGetTrendingHashtags(w http.ResponseWriter, r *http.Request) {
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tags, err := h.Trending.Top(r.Context(), size)
+	if err != nil {
+		log.Printf("Failed to get trending hashtags: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(TrendingHashtagsResponse{tags})
+	if err != nil {
+		log.Printf("Failed to dump trending hashtags to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
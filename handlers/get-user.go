@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+)
+
+func (h *HTTPHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	userId := path.Base(r.URL.Path)
+	user, err := h.Storage.GetUser(r.Context(), userId)
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeUser(w, user)
+}
@@ -1,7 +1,13 @@
 package handlers
 
-import "miniblog/storage"
+import (
+	"miniblog/feedstream"
+	"miniblog/storage"
+	"miniblog/trending"
+)
 
 type HTTPHandler struct {
-	Storage storage.Storage
+	Storage    storage.Storage
+	Trending   trending.Tracker
+	FeedEvents feedstream.Broadcaster
 }
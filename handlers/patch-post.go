@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"miniblog/auth"
 	"miniblog/storage"
 	"net/http"
 	"path"
+	"strings"
 )
 
 type PatchPostRequestData struct {
@@ -23,14 +25,30 @@ func (h *HTTPHandler) HandlePatchPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userId := r.Header.Get("System-Design-User-Id")
+	userId := auth.UserId(r.Context())
 	if userId == "" {
 		http.Error(w, "Invalid user token", http.StatusUnauthorized)
 		return
 	}
 
-	post, err := h.Storage.PatchPost(r.Context(), postId, userId, data.Text)
+	// If-Match supports a single ETag, "*" matches any existing post
+	var ifVersion *int64
+	if ifMatch := strings.TrimSpace(r.Header.Get("If-Match")); ifMatch != "" && ifMatch != "*" {
+		version, ok := parseETag(ifMatch)
+		if !ok {
+			http.Error(w, "Post was modified.", http.StatusPreconditionFailed)
+			return
+		}
+		ifVersion = &version
+	}
+
+	post, err := h.Storage.PatchPost(r.Context(), postId, userId, data.Text, ifVersion)
 	if err != nil {
+		if errors.Is(err, storage.PreconditionFailed) {
+			log.Printf("Precondition failed while updating post: %s", err.Error())
+			http.Error(w, "Post was modified.", http.StatusPreconditionFailed)
+			return
+		}
 		if errors.Is(err, storage.Forbidden) {
 			log.Printf("Forbidden error while updating post: %s", err.Error())
 			http.Error(w, "Post is owned by another user.", http.StatusForbidden)
@@ -41,7 +59,7 @@ func (h *HTTPHandler) HandlePatchPost(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Post not found.", http.StatusNotFound)
 			return
 		}
-		if errors.As(err, &storage.ClientError) {
+		if errors.Is(err, storage.ClientError) {
 			log.Printf("Client error while updating post: %s", err.Error())
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
@@ -58,6 +76,7 @@ func (h *HTTPHandler) HandlePatchPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", postETag(post))
 	_, err = w.Write(rawResponse)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
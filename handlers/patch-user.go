@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"encoding/json"
+	"miniblog/auth"
+	"net/http"
+)
+
+func (h *HTTPHandler) HandlePatchMe(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	var data UserRequestData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = data.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.Storage.PatchUser(r.Context(), userId, data.profile())
+	if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	writeUser(w, user)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/auth"
+	"miniblog/storage"
+	"net/http"
+)
+
+type FeedReadMarkerRequestData struct {
+	PostId string `json:"postId"`
+}
+
+// HandlePutFeedReadMarker marks posts of the feed up to the post as read.
+// A marker older than the current one is ignored, so clients on several devices do not move it back.
+func (h *HTTPHandler) HandlePutFeedReadMarker(w http.ResponseWriter, r *http.Request) {
+	var data FeedReadMarkerRequestData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	err = h.Storage.SetFeedReadMarker(r.Context(), userId, data.PostId)
+	if err != nil {
+		if errors.Is(err, storage.NotFoundError) {
+			http.Error(w, "Post was not found. Please check post id.", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while setting feed read marker: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to set feed read marker: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
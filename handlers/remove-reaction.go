@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"miniblog/auth"
+	"net/http"
+)
+
+func (h *HTTPHandler) HandleRemoveReaction(w http.ResponseWriter, r *http.Request) {
+	postId, reaction := reactionPath(r.URL.Path)
+	if reaction == "" {
+		http.Error(w, "Unknown reaction", http.StatusBadRequest)
+		return
+	}
+
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.Storage.RemoveReaction(r.Context(), postId, userId, reaction)
+	if err != nil {
+		writeReactionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
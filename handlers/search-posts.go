@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"miniblog/storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseTimeParam converts an ISO 8601 query parameter to the format of post timestamps, "" if it is absent.
+func parseTimeParam(r *http.Request, name string) (string, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return "", true
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return "", false
+	}
+	return parsed.UTC().Format(time.RFC3339), true
+}
+
+func (h *HTTPHandler) HandleSearchPosts(w http.ResponseWriter, r *http.Request) {
+	terms := storage.Tokenize(r.URL.Query().Get("q"))
+	if len(terms) == 0 || len(terms) > storage.MAX_SEARCH_TERMS {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	query := storage.SearchQuery{Terms: terms, AuthorId: r.URL.Query().Get("author")}
+	var ok bool
+	if query.CreatedAfter, ok = parseTimeParam(r, "since"); !ok {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+	if query.CreatedBefore, ok = parseTimeParam(r, "until"); !ok {
+		http.Error(w, "Invalid until", http.StatusBadRequest)
+		return
+	}
+
+	cgiPage, found := r.URL.Query()["page"]
+	var page *string = nil
+	if found {
+		page = &cgiPage[0]
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	posts, nextPage, err := h.Storage.SearchPosts(r.Context(), query, page, size)
+	if err != nil {
+		if errors.Is(err, storage.ClientError) {
+			log.Printf("Client error while searching posts: %s", err.Error())
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to search posts: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = h.embedAuthors(r, posts)
+	if err != nil {
+		log.Printf("Failed to embed authors: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(PostByUserIdResponse{posts, nextPage})
+	if err != nil {
+		log.Printf("Failed to dump search results to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
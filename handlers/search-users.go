@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"net/http"
+	"strconv"
+)
+
+type UsersResponse struct {
+	Users []models.User `json:"users"`
+}
+
+func (h *HTTPHandler) HandleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	prefixes := storage.Tokenize(r.URL.Query().Get("q"))
+	if len(prefixes) == 0 || len(prefixes) > storage.MAX_SEARCH_TERMS {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+
+	cgiSize, found := r.URL.Query()["size"]
+	size := DEFAULT_PAGE_SIZE
+	if found {
+		var err error
+		size, err = strconv.Atoi(cgiSize[0])
+		if err != nil || size < 1 || size > 100 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	users, err := h.Storage.SearchUsers(r.Context(), prefixes, size)
+	if err != nil {
+		log.Printf("Failed to search users: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	rawResponse, err := json.Marshal(UsersResponse{users})
+	if err != nil {
+		log.Printf("Failed to dump users to json: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+	w.Write(rawResponse)
+}
@@ -2,12 +2,13 @@ package handlers
 
 import (
 	"log"
+	"miniblog/auth"
 	"net/http"
 	"path"
 )
 
 func (h *HTTPHandler) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
-	subscriberId := r.Header.Get("System-Design-User-Id")
+	subscriberId := auth.UserId(r.Context())
 	userId := path.Base(path.Dir(r.URL.Path))
 	if subscriberId == "" || userId == "" {
 		http.Error(w, "Invalid user token", http.StatusUnauthorized)
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"log"
+	"miniblog/auth"
+	"net/http"
+	"path"
+)
+
+func (h *HTTPHandler) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	subscriberId := auth.UserId(r.Context())
+	userId := path.Base(path.Dir(r.URL.Path))
+	if subscriberId == "" || userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.Storage.Unsubscribe(r.Context(), userId, subscriberId)
+	if err != nil {
+		log.Printf("Failed to unsubscribe: %s", err.Error())
+		http.Error(w, INTERNAL_ERROR_MESSAGE, http.StatusInternalServerError)
+		return
+	}
+}
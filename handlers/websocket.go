@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/websocket"
+	"log"
+	"miniblog/auth"
+	"miniblog/feedstream"
+	"miniblog/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WS_HEARTBEAT is the interval of pings, connections of clients not answering for two intervals are closed
+var WS_HEARTBEAT = 20 * time.Second
+
+// WS_WRITE_TIMEOUT closes connections of clients not reading a message for this time
+var WS_WRITE_TIMEOUT = 10 * time.Second
+
+var WS_MAX_SUBSCRIPTIONS = 100
+
+// topics of a connection, posts are subscribed to as "post:<postId>"
+const (
+	wsFeedTopic          = "feed"
+	wsNotificationsTopic = "notifications"
+	wsPostTopicPrefix    = "post:"
+)
+
+// WebSocketRequest is a message of the client.
+type WebSocketRequest struct {
+	// Type is one of "subscribe", "unsubscribe" and "pong"
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+}
+
+// WebSocketMessage is a message of the server: an event of a subscribed topic, an acknowledgement
+// of a request ("subscribed", "unsubscribed"), an "error" or a "ping" expecting a "pong".
+type WebSocketMessage struct {
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic,omitempty"`
+	Id      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+type wsSubscription struct {
+	unsubscribe func()
+	// cancelled is closed when the client unsubscribes, so that the closed events are not taken for a slow client
+	cancelled chan struct{}
+}
+
+type wsConnection struct {
+	h      *HTTPHandler
+	ws     *websocket.Conn
+	userId string
+	// out - messages waiting to be written, the connection is closed when it is full
+	out chan WebSocketMessage
+	// subscriptions[topic] - topics of the client, accessed by the reading goroutine only
+	subscriptions map[string]*wsSubscription
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// HandleWebSocket upgrades the connection of an authenticated user to a WebSocket, over which
+// the client subscribes to its feed, its notifications and updates of posts.
+func (h *HTTPHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	userId := auth.UserId(r.Context())
+	if userId == "" {
+		http.Error(w, "Invalid user token", http.StatusUnauthorized)
+		return
+	}
+	server := websocket.Server{
+		// clients authenticate with headers rather than cookies, so connections from any origin are accepted
+		Handshake: func(config *websocket.Config, r *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			c := &wsConnection{
+				h:             h,
+				ws:            ws,
+				userId:        userId,
+				out:           make(chan WebSocketMessage, feedstream.SUBSCRIBER_BUFFER),
+				subscriptions: make(map[string]*wsSubscription),
+				done:          make(chan struct{}),
+			}
+			c.serve()
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (c *wsConnection) serve() {
+	// the deadlines of the server apply to the request, the connection manages its own
+	if err := c.ws.SetDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to reset WebSocket deadlines: %s", err.Error())
+		return
+	}
+	go c.write()
+	c.read()
+	c.close()
+	for _, subscription := range c.subscriptions {
+		close(subscription.cancelled)
+		subscription.unsubscribe()
+	}
+}
+
+func (c *wsConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+// send queues the message without waiting for the client, a client that falls behind is disconnected
+// and expected to read the missed state from the API after reconnecting.
+func (c *wsConnection) send(message WebSocketMessage) {
+	select {
+	case c.out <- message:
+	case <-c.done:
+	default:
+		log.Printf("WebSocket client of %s is too slow, disconnecting", c.userId)
+		c.close()
+	}
+}
+
+func (c *wsConnection) sendError(topic string, message string) {
+	c.send(WebSocketMessage{Type: "error", Topic: topic, Message: message})
+}
+
+func (c *wsConnection) write() {
+	heartbeat := time.NewTicker(WS_HEARTBEAT)
+	defer heartbeat.Stop()
+	for {
+		var message WebSocketMessage
+		select {
+		case message = <-c.out:
+		case <-heartbeat.C:
+			message = WebSocketMessage{Type: "ping"}
+		case <-c.done:
+			return
+		}
+		if err := c.ws.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT)); err != nil {
+			c.close()
+			return
+		}
+		if err := websocket.JSON.Send(c.ws, message); err != nil {
+			c.close()
+			return
+		}
+	}
+}
+
+func (c *wsConnection) read() {
+	for {
+		if err := c.ws.SetReadDeadline(time.Now().Add(2 * WS_HEARTBEAT)); err != nil {
+			return
+		}
+		var request WebSocketRequest
+		if err := websocket.JSON.Receive(c.ws, &request); err != nil {
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+				c.sendError("", "Invalid message")
+				continue
+			}
+			return
+		}
+		switch request.Type {
+		case "subscribe":
+			c.subscribe(request.Topic)
+		case "unsubscribe":
+			c.unsubscribe(request.Topic)
+		case "pong":
+		default:
+			c.sendError(request.Topic, "Unknown message type")
+		}
+	}
+}
+
+func (c *wsConnection) subscribe(topic string) {
+	if _, found := c.subscriptions[topic]; found {
+		c.send(WebSocketMessage{Type: "subscribed", Topic: topic})
+		return
+	}
+	if len(c.subscriptions) >= WS_MAX_SUBSCRIPTIONS {
+		c.sendError(topic, "Too many subscriptions")
+		return
+	}
+	ctx := c.ws.Request().Context()
+	var eventsTopic string
+	subscribeEvents := c.h.FeedEvents.Subscribe
+	switch {
+	case topic == wsFeedTopic:
+		eventsTopic = feedstream.FeedTopic(c.userId)
+		// the feed includes posts of followed authors merged into it on read
+		subscribeEvents = func(ctx context.Context, _ string) (<-chan feedstream.Event, func(), error) {
+			return c.h.subscribeFeed(ctx, c.userId)
+		}
+	case topic == wsNotificationsTopic:
+		eventsTopic = feedstream.NotificationsTopic(c.userId)
+	case strings.HasPrefix(topic, wsPostTopicPrefix):
+		postId := strings.TrimPrefix(topic, wsPostTopicPrefix)
+		if _, err := c.h.Storage.GetPost(ctx, postId); err != nil {
+			if errors.Is(err, storage.NotFoundError) || errors.Is(err, storage.ClientError) {
+				c.sendError(topic, "Post not found")
+				return
+			}
+			log.Printf("Failed to get post to subscribe to: %s", err.Error())
+			c.sendError(topic, INTERNAL_ERROR_MESSAGE)
+			return
+		}
+		eventsTopic = feedstream.PostTopic(postId)
+	default:
+		c.sendError(topic, "Unknown topic")
+		return
+	}
+
+	events, unsubscribe, err := subscribeEvents(ctx, eventsTopic)
+	if err != nil {
+		log.Printf("Failed to subscribe to %s: %s", eventsTopic, err.Error())
+		c.sendError(topic, INTERNAL_ERROR_MESSAGE)
+		return
+	}
+	subscription := &wsSubscription{unsubscribe: unsubscribe, cancelled: make(chan struct{})}
+	c.subscriptions[topic] = subscription
+	// the acknowledgement precedes the events of the topic
+	c.send(WebSocketMessage{Type: "subscribed", Topic: topic})
+	go c.forward(topic, events, subscription.cancelled)
+}
+
+func (c *wsConnection) unsubscribe(topic string) {
+	if subscription, found := c.subscriptions[topic]; found {
+		delete(c.subscriptions, topic)
+		close(subscription.cancelled)
+		subscription.unsubscribe()
+	}
+	c.send(WebSocketMessage{Type: "unsubscribed", Topic: topic})
+}
+
+func (c *wsConnection) forward(topic string, events <-chan feedstream.Event, cancelled chan struct{}) {
+	for event := range events {
+		c.send(WebSocketMessage{Type: event.Type, Topic: topic, Id: event.Id, Data: event.Data})
+	}
+	select {
+	case <-cancelled:
+	default:
+		// the broadcaster dropped the subscription, since the client fell behind
+		log.Printf("WebSocket client of %s is too slow, disconnecting", c.userId)
+		c.close()
+	}
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ParseLimit parses limit in "rate:burst" format, empty string disables the limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "" {
+		return Limit{}, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected rate:burst", value)
+	}
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return Limit{}, fmt.Errorf("invalid rate in limit %q: %w", value, err)
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Limit{}, fmt.Errorf("invalid burst in limit %q: %w", value, err)
+	}
+	return Limit{Rate: rate, Burst: burst}, nil
+}
+
+type Result struct {
+	// Allowed tells if the bucket had a token, it is taken only if every bucket of the request had one
+	Allowed   bool
+	Remaining int
+	// RetryAfter is the time until a token is available, zero if the request is allowed
+	RetryAfter time.Duration
+	// ResetAfter is the time until the bucket is full
+	ResetAfter time.Duration
+}
+
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:    allowed,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return result
+}
+
+// Limiter takes a token from each of the buckets identified by keys, limits[i] is the limit of keys[i].
+// Tokens are taken only if every bucket has one, so a request rejected by one limit is not charged by the others.
+// Returns the results of the buckets in the order of keys.
+type Limiter interface {
+	Allow(ctx context.Context, keys []string, limits []Limit) ([]Result, error)
+}
+
+const IN_MEMORY_MAX_BUCKETS = 10000
+
+type bucket struct {
+	key       string
+	tokens    float64
+	updatedAt time.Time
+}
+
+// InMemoryLimiter keeps buckets in the process memory, so limits are not shared between replicas.
+// Least recently used buckets are dropped beyond maxBuckets, they are most likely refilled.
+type InMemoryLimiter struct {
+	mut        sync.Mutex
+	buckets    map[string]*list.Element
+	recent     *list.List
+	maxBuckets int
+	now        func() time.Time
+}
+
+func CreateInMemoryLimiter() *InMemoryLimiter {
+	return &InMemoryLimiter{
+		buckets:    make(map[string]*list.Element),
+		recent:     list.New(),
+		maxBuckets: IN_MEMORY_MAX_BUCKETS,
+		now:        time.Now,
+	}
+}
+
+func (l *InMemoryLimiter) Allow(ctx context.Context, keys []string, limits []Limit) ([]Result, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := l.now()
+	buckets := make([]*bucket, len(keys))
+	allowed := true
+	for i, key := range keys {
+		buckets[i] = l.refill(key, limits[i], now)
+		allowed = allowed && buckets[i].tokens >= 1
+	}
+	results := make([]Result, len(keys))
+	for i, b := range buckets {
+		if allowed {
+			b.tokens--
+		}
+		results[i] = newResult(limits[i], b.tokens, allowed || b.tokens >= 1)
+	}
+	return results, nil
+}
+
+// refill returns the bucket of key with the tokens added since its last use. Must be called with the lock held.
+func (l *InMemoryLimiter) refill(key string, limit Limit, now time.Time) *bucket {
+	element, found := l.buckets[key]
+	if found {
+		l.recent.MoveToFront(element)
+	} else {
+		element = l.recent.PushFront(&bucket{key: key, tokens: float64(limit.Burst), updatedAt: now})
+		l.buckets[key] = element
+		if l.recent.Len() > l.maxBuckets {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+	b := element.Value.(*bucket)
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updatedAt).Seconds()*limit.Rate)
+	b.updatedAt = now
+	return b
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"miniblog/auth"
+	"miniblog/utils"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RouteClass string
+
+const (
+	Reads      RouteClass = "reads"
+	Writes     RouteClass = "writes"
+	Subscribes RouteClass = "subscribes"
+)
+
+var routeClasses = []RouteClass{Reads, Writes, Subscribes}
+
+// default limits per user or IP, in "rate:burst" format
+var defaultLimits = map[RouteClass]string{
+	Reads:      "20:100",
+	Writes:     "2:20",
+	Subscribes: "1:10",
+}
+
+type Config struct {
+	// Limits per authenticated user, or per IP for anonymous requests
+	Limits map[RouteClass]Limit
+	// GlobalLimits are shared by all clients
+	GlobalLimits map[RouteClass]Limit
+}
+
+// ConfigFromEnv reads limits from RATE_LIMIT_<CLASS> and RATE_LIMIT_GLOBAL_<CLASS>
+// in "rate:burst" format, where rate is in requests per second. Empty value disables the limit.
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		Limits:       make(map[RouteClass]Limit),
+		GlobalLimits: make(map[RouteClass]Limit),
+	}
+	for _, class := range routeClasses {
+		suffix := strings.ToUpper(string(class))
+		limit, err := ParseLimit(utils.GetEnvVarWithDefault("RATE_LIMIT_"+suffix, defaultLimits[class]))
+		if err != nil {
+			return config, err
+		}
+		config.Limits[class] = limit
+		globalLimit, err := ParseLimit(utils.GetEnvVarWithDefault("RATE_LIMIT_GLOBAL_"+suffix, ""))
+		if err != nil {
+			return config, err
+		}
+		config.GlobalLimits[class] = globalLimit
+	}
+	return config, nil
+}
+
+func routeClass(r *http.Request) RouteClass {
+	if strings.HasSuffix(r.URL.Path, "/subscribe") {
+		return Subscribes
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return Reads
+	}
+	return Writes
+}
+
+func clientKey(r *http.Request) string {
+	if userId := auth.UserId(r.Context()); userId != "" {
+		return "user:" + userId
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+type RateLimiter struct {
+	limiter Limiter
+	config  Config
+}
+
+func CreateRateLimiter(limiter Limiter, config Config) *RateLimiter {
+	return &RateLimiter{limiter: limiter, config: config}
+}
+
+func setHeaders(w http.ResponseWriter, limit Limit, result Result) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds()))))
+}
+
+// allow checks the limits of the buckets, failing open if the limiter is unavailable.
+func (l *RateLimiter) allow(r *http.Request, keys []string, limits []Limit) ([]Result, bool) {
+	results, err := l.limiter.Allow(r.Context(), keys, limits)
+	if err != nil {
+		log.Printf("Rate limiter failed, request is allowed: %s", err.Error())
+		return nil, false
+	}
+	return results, true
+}
+
+func reject(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	http.Error(w, "Too many requests, please retry later.", http.StatusTooManyRequests)
+}
+
+// Middleware rejects requests exceeding the limits of their route class with 429.
+// Must be applied after the authentication middleware to limit users rather than IPs.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/maintenance/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		class := routeClass(r)
+
+		// both buckets are checked at once, so a request rejected by one limit does not use up the other
+		var keys []string
+		var limits []Limit
+		clientLimit := l.config.Limits[class]
+		if clientLimit.Enabled() {
+			keys = append(keys, fmt.Sprintf("ratelimit:%s:%s", class, clientKey(r)))
+			limits = append(limits, clientLimit)
+		}
+		if limit := l.config.GlobalLimits[class]; limit.Enabled() {
+			keys = append(keys, fmt.Sprintf("ratelimit:%s:global", class))
+			limits = append(limits, limit)
+		}
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		results, ok := l.allow(r, keys, limits)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if clientLimit.Enabled() {
+			setHeaders(w, clientLimit, results[0])
+		}
+		// the client's own limit is reported first
+		for _, result := range results {
+			if !result.Allowed {
+				reject(w, result.RetryAfter)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
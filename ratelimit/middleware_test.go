@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"miniblog/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMiddlewareLimitsUsers(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := CreateInMemoryLimiter()
+	limiter.now = func() time.Time { return now }
+	config := Config{
+		Limits:       map[RouteClass]Limit{Writes: {Rate: 1, Burst: 2}},
+		GlobalLimits: map[RouteClass]Limit{},
+	}
+	handler := CreateRateLimiter(limiter, config).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method, userId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/posts", nil)
+		req = req.WithContext(auth.WithUserId(req.Context(), userId))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := do("POST", "a1")
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "2", resp.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, "1", resp.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(t, http.StatusOK, do("POST", "a1").Code)
+
+	resp = do("POST", "a1")
+	require.Equal(t, http.StatusTooManyRequests, resp.Code)
+	require.Equal(t, "1", resp.Header().Get("Retry-After"))
+	require.Equal(t, "0", resp.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(t, "2", resp.Header().Get("X-RateLimit-Reset"))
+
+	// other users and route classes have their own buckets
+	require.Equal(t, http.StatusOK, do("POST", "b2").Code)
+	require.Equal(t, http.StatusOK, do("GET", "a1").Code)
+
+	now = now.Add(time.Second)
+	require.Equal(t, http.StatusOK, do("POST", "a1").Code)
+	require.Equal(t, http.StatusTooManyRequests, do("POST", "a1").Code)
+}
+
+func TestMiddlewareDoesNotChargeGlobalLimitForRejectedRequests(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := CreateInMemoryLimiter()
+	limiter.now = func() time.Time { return now }
+	config := Config{
+		Limits:       map[RouteClass]Limit{Writes: {Rate: 1, Burst: 1}},
+		GlobalLimits: map[RouteClass]Limit{Writes: {Rate: 1, Burst: 2}},
+	}
+	handler := CreateRateLimiter(limiter, config).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(userId string) int {
+		req := httptest.NewRequest("POST", "/api/v1/posts", nil)
+		req = req.WithContext(auth.WithUserId(req.Context(), userId))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	require.Equal(t, http.StatusOK, do("a1"))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusTooManyRequests, do("a1"))
+	}
+	require.Equal(t, http.StatusOK, do("b2"))
+	require.Equal(t, http.StatusTooManyRequests, do("c3"))
+}
+
+func TestMiddlewareDoesNotChargeClientLimitForGloballyRejectedRequests(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := CreateInMemoryLimiter()
+	limiter.now = func() time.Time { return now }
+	config := Config{
+		Limits:       map[RouteClass]Limit{Writes: {Rate: 1, Burst: 2}},
+		GlobalLimits: map[RouteClass]Limit{Writes: {Rate: 1, Burst: 1}},
+	}
+	handler := CreateRateLimiter(limiter, config).Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(userId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/posts", nil)
+		req = req.WithContext(auth.WithUserId(req.Context(), userId))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, do("b2").Code)
+	for i := 0; i < 3; i++ {
+		resp := do("a1")
+		require.Equal(t, http.StatusTooManyRequests, resp.Code)
+		require.Equal(t, "2", resp.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	now = now.Add(time.Second)
+	require.Equal(t, http.StatusOK, do("a1").Code)
+	now = now.Add(time.Second)
+	require.Equal(t, http.StatusOK, do("a1").Code)
+}
+
+func TestInMemoryLimiterDropsLeastRecentlyUsedBuckets(t *testing.T) {
+	ctx := context.Background()
+	limiter := CreateInMemoryLimiter()
+	limiter.maxBuckets = 2
+	limit := Limit{Rate: 0.001, Burst: 2}
+	take := func(key string) int {
+		results, err := limiter.Allow(ctx, []string{key}, []Limit{limit})
+		require.NoError(t, err)
+		return results[0].Remaining
+	}
+
+	require.Equal(t, 1, take("a"))
+	require.Equal(t, 1, take("b"))
+	require.Equal(t, 0, take("a"))
+	// "b" is the least recently used one
+	require.Equal(t, 1, take("c"))
+	require.Len(t, limiter.buckets, 2)
+	require.Equal(t, 1, take("b"))
+	require.Equal(t, 0, take("c"))
+}
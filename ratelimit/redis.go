@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"math"
+	"strconv"
+	"time"
+)
+
+// KEYS - bucket keys
+// ARGV[1] - current time in milliseconds
+// ARGV[2i], ARGV[2i+1] - rate, tokens per second, and burst of KEYS[i]
+// Returns allowed flag and tokens of every bucket, tokens are taken only if every bucket has one.
+var TAKE_TOKEN_SCRIPT_STR = `
+	local now = tonumber(ARGV[1])
+	local tokens = {}
+	local allowed = 1
+	for i, key in ipairs(KEYS) do
+	  local rate = tonumber(ARGV[2 * i])
+	  local burst = tonumber(ARGV[2 * i + 1])
+	  local bucket = redis.call("hmget", key, "tokens", "updatedAt")
+	  local updatedAt = tonumber(bucket[2]) or now
+	  tokens[i] = math.min(burst, (tonumber(bucket[1]) or burst) + math.max(0, now - updatedAt) * rate / 1000)
+	  if (tokens[i] < 1) then
+	    allowed = 0
+	  end
+	end
+	local reply = {}
+	for i, key in ipairs(KEYS) do
+	  local rate = tonumber(ARGV[2 * i])
+	  local burst = tonumber(ARGV[2 * i + 1])
+	  local bucketAllowed = 0
+	  if (tokens[i] >= 1) then
+	    bucketAllowed = 1
+	  end
+	  if (allowed == 1) then
+	    tokens[i] = tokens[i] - 1
+	  end
+	  redis.call("hmset", key, "tokens", tostring(tokens[i]), "updatedAt", now)
+	  redis.call("pexpire", key, math.ceil(burst / rate * 1000))
+	  table.insert(reply, bucketAllowed)
+	  table.insert(reply, tostring(tokens[i]))
+	end
+	return reply
+`
+var TAKE_TOKEN_SCRIPT = redis.NewScript(TAKE_TOKEN_SCRIPT_STR)
+
+// RedisLimiter keeps buckets in Redis, so limits hold across replicas.
+// Buckets of a request are checked by one script, so they must be kept by a single Redis instance.
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+func CreateRedisLimiter(redisUrl string) *RedisLimiter {
+	return &RedisLimiter{
+		client: redis.NewClient(&redis.Options{
+			Addr: redisUrl,
+		}),
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, keys []string, limits []Limit) ([]Result, error) {
+	args := []interface{}{time.Now().UnixNano() / int64(time.Millisecond)}
+	for _, limit := range limits {
+		args = append(args, limit.Rate, limit.Burst)
+	}
+	reply, err := TAKE_TOKEN_SCRIPT.Run(ctx, l.client, keys, args...).Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take token: %w", err)
+	}
+	if len(reply) != 2*len(keys) {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	results := make([]Result, len(keys))
+	for i, limit := range limits {
+		allowed, _ := reply[2*i].(int64)
+		rawTokens, _ := reply[2*i+1].(string)
+		tokens, err := strconv.ParseFloat(rawTokens, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected tokens %v: %w", reply[2*i+1], err)
+		}
+		results[i] = newResult(limit, math.Max(0, tokens), allowed == 1)
+	}
+	return results, nil
+}
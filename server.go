@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/gorilla/mux"
 	_ "github.com/motemen/go-loghttp/global"
 	"log"
+	"miniblog/auth"
+	"miniblog/feedstream"
 	"miniblog/handlers"
+	"miniblog/ratelimit"
 	"miniblog/storage"
 	"miniblog/storage/in_memory"
 	"miniblog/storage/persistent"
 	"miniblog/storage/persistent_cached"
+	"miniblog/trending"
 	"miniblog/utils"
 	"net/http"
 	"os"
@@ -23,54 +28,179 @@ const (
 	MongoWithCache             = "cached"
 )
 
+type TaskQueueMode string
+
+const (
+	RedisTaskQueue     TaskQueueMode = "redis"
+	InProcessTaskQueue               = "inprocess"
+)
+
 type AppMode string
 
 const (
-	ServerMode AppMode = "SERVER"
-	WorkerMode         = "WORKER"
+	ServerMode      AppMode = "SERVER"
+	WorkerMode              = "WORKER"
+	RebuildFeedMode         = "REBUILD_FEED"
 )
 
+func getFeedConfig() persistent.FeedConfig {
+	feedConfig, err := persistent.FeedConfigFromEnv()
+	if err != nil {
+		panic("Invalid feed config: " + err.Error())
+	}
+	return feedConfig
+}
+
+func getTaskQueueMode() TaskQueueMode {
+	taskQueueMode := TaskQueueMode(utils.GetEnvVarWithDefault("TASK_QUEUE", string(RedisTaskQueue)))
+	if taskQueueMode != RedisTaskQueue && taskQueueMode != InProcessTaskQueue {
+		panic("Invalid 'TASK_QUEUE'")
+	}
+	return taskQueueMode
+}
+
+// createLimiter keeps rate limits in Redis to share them between replicas,
+// or in memory if the storage is in memory or Redis is not configured.
+func createLimiter(storageMode StorageMode) ratelimit.Limiter {
+	if storageMode != InMemory {
+		redisUrl := utils.GetEnvVarWithDefault("RATE_LIMIT_REDIS_URL", utils.GetEnvVarWithDefault("REDIS_URL", ""))
+		if redisUrl != "" {
+			return ratelimit.CreateRedisLimiter(redisUrl)
+		}
+		log.Printf("Redis for rate limits is not configured, limits are kept in memory")
+	}
+	return ratelimit.CreateInMemoryLimiter()
+}
+
+// createTracker counts trending hashtags in Redis to share them between replicas,
+// or in memory if the storage is in memory or Redis is not configured.
+func createTracker(storageMode StorageMode) trending.Tracker {
+	config, err := trending.ConfigFromEnv()
+	if err != nil {
+		panic("Invalid trending config: " + err.Error())
+	}
+	if storageMode != InMemory {
+		redisUrl := utils.GetEnvVarWithDefault("TRENDING_REDIS_URL", utils.GetEnvVarWithDefault("REDIS_URL", ""))
+		if redisUrl != "" {
+			return trending.CreateRedisTracker(redisUrl, config)
+		}
+		log.Printf("Redis for trending hashtags is not configured, counts are kept in memory")
+	}
+	return trending.CreateInMemoryTracker(config)
+}
+
+// feedEventsRedisUrl returns the address of Redis to publish real-time events through, empty if it is not configured.
+func feedEventsRedisUrl() string {
+	return utils.GetEnvVarWithDefault("FEED_EVENTS_REDIS_URL", utils.GetEnvVarWithDefault("REDIS_URL", ""))
+}
+
+// createBroadcaster delivers events through Redis, so that the replica a reader is connected to
+// receives events of any worker, or in memory if the storage is in memory or Redis is not configured.
+func createBroadcaster(storageMode StorageMode) feedstream.Broadcaster {
+	if storageMode != InMemory {
+		if redisUrl := feedEventsRedisUrl(); redisUrl != "" {
+			return feedstream.CreateRedisBroadcaster(redisUrl)
+		}
+		log.Printf("Redis for feed events is not configured, only events of the in-process worker are streamed")
+	}
+	return feedstream.CreateInMemoryBroadcaster()
+}
+
 func CreateServer() *http.Server {
 	r := mux.NewRouter()
 
 	port := utils.GetEnvVarWithDefault("SERVER_PORT", "8080")
 	storageMode := utils.GetEnvVarWithDefault("STORAGE_MODE", "mongo")
 
+	feedEvents := createBroadcaster(StorageMode(storageMode))
+	tracker := createTracker(StorageMode(storageMode))
 	var storage storage.Storage
 	if StorageMode(storageMode) == InMemory {
-		storage = in_memory.CreateInMemoryStorage()
+		storage = in_memory.CreateInMemoryStorage(feedEvents, tracker)
 	} else {
 		mongoUrl := utils.GetEnvVar("MONGO_URL")
 		mongoDbName := utils.GetEnvVar("MONGO_DBNAME")
-		brokerUrl := "redis://" + utils.GetEnvVar("REDIS_URL")
+		feedConfig := getFeedConfig()
 		if StorageMode(storageMode) == Mongo {
-			storage = persistent.CreateMongoStorageWithBroker(mongoUrl, mongoDbName, brokerUrl)
+			persistentStorage := persistent.CreateMongoStorageWithBroker(mongoUrl, mongoDbName, feedConfig)
+			persistentStorage.SetTrending(tracker)
+			storage = persistentStorage
 		} else if StorageMode(storageMode) == MongoWithCache {
 			cacheUrl := utils.GetEnvVar("REDIS_CACHE_URL")
-			persistentStorage := persistent.CreateMongoStorageWithBroker(mongoUrl, mongoDbName, brokerUrl)
+			persistentStorage := persistent.CreateMongoStorageWithBroker(mongoUrl, mongoDbName, feedConfig)
+			persistentStorage.SetTrending(tracker)
 			storage = persistent_cached.CreatePersistentStorageCachedWithRedis(persistentStorage, cacheUrl)
 		} else {
 			panic("Invalid 'STORAGE_MODE'")
 		}
+		if getTaskQueueMode() == InProcessTaskQueue {
+			persistent.GetMongoStorageWithoutBroker().SetFeedEvents(feedEvents)
+			go func() {
+				if err := persistent.CreateInProcessWorker(context.Background()); err != nil {
+					log.Printf("In-process worker stopped: %s", err.Error())
+				}
+			}()
+		}
+	}
+
+	handler := &handlers.HTTPHandler{
+		Storage:    storage,
+		Trending:   tracker,
+		FeedEvents: feedEvents,
 	}
 
-	handler := &handlers.HTTPHandler{Storage: storage}
+	authConfig, err := auth.ConfigFromEnv()
+	if err != nil {
+		panic("Invalid auth config: " + err.Error())
+	}
+	r.Use(auth.CreateAuthenticator(authConfig).Middleware)
+
+	rateLimitConfig, err := ratelimit.ConfigFromEnv()
+	if err != nil {
+		panic("Invalid rate limit config: " + err.Error())
+	}
+	r.Use(ratelimit.CreateRateLimiter(createLimiter(StorageMode(storageMode)), rateLimitConfig).Middleware)
 
 	r.HandleFunc("/maintenance/ping", handler.HealthCheck).Methods("GET")
 	r.HandleFunc("/api/v1/posts", handler.HandleCreatePost).Methods("POST")
 	r.HandleFunc("/api/v1/posts/{postId}", handler.HandleGetPost).Methods("GET")
 	r.HandleFunc("/api/v1/users/{userId}/posts", handler.HandleGetPosts).Methods("GET")
 	r.HandleFunc("/api/v1/posts/{postId}", handler.HandlePatchPost).Methods("PATCH")
+	r.HandleFunc("/api/v1/posts/{postId}", handler.HandleDeletePost).Methods("DELETE")
+	r.HandleFunc("/api/v1/posts/{postId}/revisions", handler.HandleGetRevisions).Methods("GET")
+	r.HandleFunc("/api/v1/posts/{postId}/replies", handler.HandleGetReplies).Methods("GET")
+	r.HandleFunc("/api/v1/posts/{postId}/thread", handler.HandleGetThread).Methods("GET")
+	r.HandleFunc("/api/v1/posts/{postId}/likes", handler.HandleAddReaction).Methods("PUT")
+	r.HandleFunc("/api/v1/posts/{postId}/likes", handler.HandleRemoveReaction).Methods("DELETE")
+	r.HandleFunc("/api/v1/posts/{postId}/likes", handler.HandleGetReactions).Methods("GET")
+	r.HandleFunc("/api/v1/posts/{postId}/reactions/{reaction}", handler.HandleAddReaction).Methods("PUT")
+	r.HandleFunc("/api/v1/posts/{postId}/reactions/{reaction}", handler.HandleRemoveReaction).Methods("DELETE")
+	r.HandleFunc("/api/v1/posts/{postId}/reactions/{reaction}", handler.HandleGetReactions).Methods("GET")
+	r.HandleFunc("/api/v1/search/posts", handler.HandleSearchPosts).Methods("GET")
+	r.HandleFunc("/api/v1/search/users", handler.HandleSearchUsers).Methods("GET")
+	r.HandleFunc("/api/v1/tags/trending", handler.HandleGetTrendingHashtags).Methods("GET")
+	r.HandleFunc("/api/v1/tags/{tag}/posts", handler.HandleGetHashtagPosts).Methods("GET")
 	r.HandleFunc("/api/v1/users/{userId}/subscribe", handler.HandleSubscribe).Methods("POST")
+	r.HandleFunc("/api/v1/users/{userId}/subscribe", handler.HandleUnsubscribe).Methods("DELETE")
 	r.HandleFunc("/api/v1/subscriptions", handler.HandleGetSubscriptions).Methods("GET")
 	r.HandleFunc("/api/v1/subscribers", handler.HandleGetSubscribers).Methods("GET")
 	r.HandleFunc("/api/v1/feed", handler.HandleFeed).Methods("GET")
+	r.HandleFunc("/api/v1/feed/stream", handler.HandleFeedStream).Methods("GET")
+	r.HandleFunc("/api/v1/feed/unread-count", handler.HandleGetFeedUnreadCount).Methods("GET")
+	r.HandleFunc("/api/v1/feed/read-marker", handler.HandlePutFeedReadMarker).Methods("PUT")
+	r.HandleFunc("/api/v1/ws", handler.HandleWebSocket).Methods("GET")
+	r.HandleFunc("/api/v1/mentions", handler.HandleGetMentions).Methods("GET")
+	r.HandleFunc("/api/v1/users", handler.HandleCreateUser).Methods("POST")
+	r.HandleFunc("/api/v1/users/me", handler.HandlePatchMe).Methods("PATCH")
+	r.HandleFunc("/api/v1/users/{userId}", handler.HandleGetUser).Methods("GET")
 
 	return &http.Server{
 		Handler:      r,
 		Addr:         "0.0.0.0:" + port,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		// streams replace the write timeout with their own, see HandleFeedStream
+		ConnContext: handlers.ConnContext,
 	}
 }
 
@@ -85,10 +215,30 @@ func main() {
 		log.Printf("Start serving on %s", srv.Addr)
 		log.Fatal(srv.ListenAndServe())
 	case WorkerMode:
+		if redisUrl := feedEventsRedisUrl(); redisUrl != "" {
+			persistent.GetMongoStorageWithoutBroker().SetFeedEvents(feedstream.CreateRedisPublisher(redisUrl))
+		} else {
+			log.Printf("Redis for feed events is not configured, events are not streamed")
+		}
+		if getTaskQueueMode() == InProcessTaskQueue || getFeedConfig().Source == persistent.ChangeStreamFeedSource {
+			if err := persistent.CreateInProcessWorker(context.Background()); err != nil {
+				panic("Failed to start worker: " + err.Error())
+			}
+			return
+		}
 		brokerUrl := "redis://" + utils.GetEnvVar("REDIS_URL")
 		if err := persistent.CreateWorker(brokerUrl); err != nil {
 			panic("Failed to start worker: " + err.Error())
 		}
+	case RebuildFeedMode:
+		var userId *string
+		if id, found := os.LookupEnv("REBUILD_FEED_USER_ID"); found {
+			userId = &id
+		}
+		dryRun := utils.GetEnvVarWithDefault("REBUILD_FEED_DRY_RUN", "false") == "true"
+		if err := persistent.RebuildFeeds(context.Background(), userId, dryRun); err != nil {
+			panic("Failed to rebuild feeds: " + err.Error())
+		}
 	default:
 		panic("Invalid 'APP_MODE'")
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	_ "embed"
@@ -10,11 +11,17 @@ import (
 	"github.com/getkin/kin-openapi/openapi3filter"
 	openapi3_routers "github.com/getkin/kin-openapi/routers"
 	openapi3_legacy "github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/websocket"
 	"io"
 	"io/ioutil"
 	"log"
+	"miniblog/auth"
+	"miniblog/utils"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -37,11 +44,28 @@ type APISuite struct {
 	apiSpecRouter openapi3_routers.Router
 }
 
+const testJWTSecret = "test-secret"
+const testJWTIssuer = "test-issuer"
+const testJWTAudience = "test-audience"
+const testAPIKey = "test-api-key"
+
 func (s *APISuite) SetupSuite() {
+	// tests authenticate with the legacy header unless they check authentication
+	s.Require().NoError(os.Setenv("AUTH_LEGACY_HEADER", "true"))
+	s.Require().NoError(os.Setenv("AUTH_JWT_HS256_SECRET", testJWTSecret))
+	s.Require().NoError(os.Setenv("AUTH_JWT_ISSUER", testJWTIssuer))
+	s.Require().NoError(os.Setenv("AUTH_JWT_AUDIENCE", testJWTAudience))
+	s.Require().NoError(os.Setenv("AUTH_API_KEYS", testAPIKey+":c3c3"))
+	for _, class := range []string{"READS", "WRITES", "SUBSCRIBES"} {
+		s.Require().NoError(os.Setenv("RATE_LIMIT_"+class, ""))
+	}
 	srv := CreateServer()
+	// listen before serving, so requests of the first test are not refused
+	listener, err := net.Listen("tcp", srv.Addr)
+	s.Require().NoError(err)
 	go func() {
 		log.Printf("Start serving on %s", srv.Addr)
-		log.Fatal(srv.ListenAndServe())
+		log.Fatal(srv.Serve(listener))
 	}()
 
 	spec, err := openapi3.NewLoader().LoadFromData(apiSpec)
@@ -183,3 +207,1096 @@ func (s *APISuite) TestSimple() {
 	json.NewDecoder(respGet.Body).Decode(&p)
 	s.Require().Equal("new text", p.Text)
 }
+
+type postsPage struct {
+	Posts    []post  `json:"posts"`
+	NextPage *string `json:"nextPage"`
+}
+
+type users struct {
+	Users []string `json:"users"`
+}
+
+func (s *APISuite) requireInMemoryStorage() {
+	if StorageMode(utils.GetEnvVarWithDefault("STORAGE_MODE", "mongo")) != InMemory {
+		s.T().Skip("feed is updated asynchronously in persistent storage modes")
+	}
+}
+
+func (s *APISuite) doRequest(method, url, userId string, body io.Reader) *http.Response {
+	req, _ := http.NewRequest(method, url, body)
+	req.Header.Set("Content-Type", "application/json")
+	if userId != "" {
+		req.Header.Set("System-Design-User-Id", userId)
+	}
+	resp, err := s.client.Do(req)
+	s.Require().NoError(err)
+	return resp
+}
+
+func (s *APISuite) createPost(userId, text string) post {
+	body, _ := json.Marshal(map[string]string{"text": text})
+	resp := s.doRequest("POST", "http://localhost:8080/api/v1/posts", userId, bytes.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var p post
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	return p
+}
+
+func (s *APISuite) subscribe(userId, subscriber string) {
+	url := "http://localhost:8080/api/v1/users/" + userId + "/subscribe"
+	resp := s.doRequest("POST", url, subscriber, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+}
+
+func (s *APISuite) getUsers(path, userId string) []string {
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/"+path, userId, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var u users
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&u))
+	return u.Users
+}
+
+func (s *APISuite) getFeed(userId string, page *string, size int) postsPage {
+	url := fmt.Sprintf("http://localhost:8080/api/v1/feed?size=%d", size)
+	if page != nil {
+		url += "&page=" + *page
+	}
+	resp := s.doRequest("GET", url, userId, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var p postsPage
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	return p
+}
+
+func (s *APISuite) TestSubscriptionsAndFeed() {
+	s.requireInMemoryStorage()
+
+	author1, author2, reader := "a1a1", "a2a2", "b1b1"
+	old := s.createPost(author1, "posted before subscription")
+
+	s.subscribe(author1, reader)
+	s.subscribe(author1, reader)
+	s.subscribe(author2, reader)
+	s.Require().Equal([]string{author1, author2}, s.getUsers("subscriptions", reader))
+	s.Require().Equal([]string{reader}, s.getUsers("subscribers", author1))
+
+	p1 := s.createPost(author2, "first")
+	p2 := s.createPost(author1, "second")
+	p3 := s.createPost(author2, "third")
+	s.createPost(reader, "own posts are not in the feed")
+
+	// Patched posts are visible in the feed
+	body := strings.NewReader("{\"text\": \"second patched\"}")
+	resp := s.doRequest("PATCH", "http://localhost:8080/api/v1/posts/"+p2.Id, author1, body)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	feed := s.getFeed(reader, nil, 3)
+	s.Require().Len(feed.Posts, 3)
+	s.Require().Equal(p3.Id, feed.Posts[0].Id)
+	s.Require().Equal(p2.Id, feed.Posts[1].Id)
+	s.Require().Equal("second patched", feed.Posts[1].Text)
+	s.Require().Equal(p1.Id, feed.Posts[2].Id)
+	s.Require().NotNil(feed.NextPage)
+	s.Require().Equal(old.Id, *feed.NextPage)
+
+	feed = s.getFeed(reader, feed.NextPage, 3)
+	s.Require().Len(feed.Posts, 1)
+	s.Require().Equal(old.Id, feed.Posts[0].Id)
+	s.Require().Nil(feed.NextPage)
+
+	s.Require().Empty(s.getFeed(author1, nil, 10).Posts)
+}
+
+func (s *APISuite) TestDeletePost() {
+	s.requireInMemoryStorage()
+
+	author, reader := "a3a3", "b3b3"
+	s.subscribe(author, reader)
+	kept := s.createPost(author, "kept")
+	deleted := s.createPost(author, "deleted")
+
+	url := "http://localhost:8080/api/v1/posts/" + deleted.Id
+	resp := s.doRequest("DELETE", url, reader, nil)
+	s.Require().Equal(http.StatusForbidden, resp.StatusCode)
+
+	resp = s.doRequest("DELETE", url, author, nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+
+	resp = s.doRequest("GET", url, author, nil)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+	resp = s.doRequest("DELETE", url, author, nil)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+
+	feed := s.getFeed(reader, nil, 10)
+	s.Require().Len(feed.Posts, 1)
+	s.Require().Equal(kept.Id, feed.Posts[0].Id)
+
+	// a page token pointing at a deleted post keeps its position
+	feed = s.getFeed(reader, &deleted.Id, 10)
+	s.Require().Len(feed.Posts, 1)
+	s.Require().Equal(kept.Id, feed.Posts[0].Id)
+}
+
+func (s *APISuite) TestUnsubscribe() {
+	s.requireInMemoryStorage()
+
+	author1, author2, reader := "a4a4", "a5a5", "b4b4"
+	s.subscribe(author1, reader)
+	s.subscribe(author2, reader)
+	s.createPost(author1, "removed from feed")
+	kept := s.createPost(author2, "kept in feed")
+
+	url := "http://localhost:8080/api/v1/users/" + author1 + "/subscribe"
+	resp := s.doRequest("DELETE", url, reader, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	resp = s.doRequest("DELETE", url, reader, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	s.Require().Equal([]string{author2}, s.getUsers("subscriptions", reader))
+	s.Require().Empty(s.getUsers("subscribers", author1))
+
+	feed := s.getFeed(reader, nil, 10)
+	s.Require().Len(feed.Posts, 1)
+	s.Require().Equal(kept.Id, feed.Posts[0].Id)
+
+	s.createPost(author1, "not delivered after unsubscription")
+	s.Require().Len(s.getFeed(reader, nil, 10).Posts, 1)
+}
+
+func (s *APISuite) createPostWithHeader(header, value string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"text": "authenticated"})
+	req, _ := http.NewRequest("POST", "http://localhost:8080/api/v1/posts", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, value)
+	resp, err := s.client.Do(req)
+	s.Require().NoError(err)
+	return resp
+}
+
+func (s *APISuite) TestAuthentication() {
+	signed := func(secret string, claims jwt.RegisteredClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		s.Require().NoError(err)
+		return "Bearer " + token
+	}
+
+	valid := jwt.RegisteredClaims{
+		Subject:   "d4d4",
+		Issuer:    testJWTIssuer,
+		Audience:  jwt.ClaimStrings{testJWTAudience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	resp := s.createPostWithHeader("Authorization", signed(testJWTSecret, valid))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var p post
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	s.Require().Equal("d4d4", p.AuthorId)
+
+	resp = s.createPostWithHeader(auth.API_KEY_HEADER, testAPIKey)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	s.Require().Equal("c3c3", p.AuthorId)
+
+	resp = s.createPostWithHeader("Authorization", signed("wrong-secret", valid))
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	resp = s.createPostWithHeader("Authorization", signed(testJWTSecret, expired))
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	neverExpiring := valid
+	neverExpiring.ExpiresAt = nil
+	resp = s.createPostWithHeader("Authorization", signed(testJWTSecret, neverExpiring))
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	otherIssuer := valid
+	otherIssuer.Issuer = "other-issuer"
+	resp = s.createPostWithHeader("Authorization", signed(testJWTSecret, otherIssuer))
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	otherAudience := valid
+	otherAudience.Audience = jwt.ClaimStrings{"other-audience"}
+	resp = s.createPostWithHeader("Authorization", signed(testJWTSecret, otherAudience))
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	resp = s.createPostWithHeader(auth.API_KEY_HEADER, "unknown-key")
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+type user struct {
+	Id          string `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+func (s *APISuite) TestUsers() {
+	userId := fmt.Sprintf("%x", time.Now().UnixNano())
+	handle := "user_" + userId[len(userId)-8:]
+	body := `{"handle": "` + handle + `", "displayName": "User", "avatarUrl": "https://example.com/a.png"}`
+
+	resp := s.doRequest("POST", "http://localhost:8080/api/v1/users", userId, strings.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	resp = s.doRequest("POST", "http://localhost:8080/api/v1/users", userId, strings.NewReader(body))
+	s.Require().Equal(http.StatusConflict, resp.StatusCode)
+	resp = s.doRequest("POST", "http://localhost:8080/api/v1/users", "e5e5"+userId, strings.NewReader(body))
+	s.Require().Equal(http.StatusConflict, resp.StatusCode)
+
+	resp = s.doRequest("PATCH", "http://localhost:8080/api/v1/users/me", userId, strings.NewReader(`{"bio": "about me"}`))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/users/"+userId, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var u user
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&u))
+	s.Require().Equal(user{userId, handle, "User", "about me", "https://example.com/a.png"}, u)
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/users/f6f6"+userId, "", nil)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+
+	p := s.createPost(userId, "with author")
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/posts/"+p.Id+"?embed=author", "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var embedded struct {
+		post
+		Author user `json:"author"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&embedded))
+	s.Require().Equal(p.Id, embedded.Id)
+	s.Require().Equal(u, embedded.Author)
+}
+
+func (s *APISuite) TestConditionalRequests() {
+	p := s.createPost("a7a7", "original")
+	url := "http://localhost:8080/api/v1/posts/" + p.Id
+	doConditional := func(method, header, etag, body string) *http.Response {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("System-Design-User-Id", "a7a7")
+		req.Header.Set(header, etag)
+		resp, err := s.client.Do(req)
+		s.Require().NoError(err)
+		return resp
+	}
+
+	resp := s.doRequest("GET", url, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	s.Require().NotEmpty(etag)
+	resp = doConditional("GET", "If-None-Match", etag, "")
+	s.Require().Equal(http.StatusNotModified, resp.StatusCode)
+
+	resp = doConditional("PATCH", "If-Match", etag, `{"text": "first edit"}`)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	newEtag := resp.Header.Get("ETag")
+	s.Require().NotEqual(etag, newEtag)
+
+	// a concurrent edit based on the original version is rejected
+	resp = doConditional("PATCH", "If-Match", etag, `{"text": "second edit"}`)
+	s.Require().Equal(http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = doConditional("GET", "If-None-Match", etag, "")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var patched post
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&patched))
+	s.Require().Equal("first edit", patched.Text)
+	s.Require().Equal(newEtag, resp.Header.Get("ETag"))
+
+	// counters change the ETag without a new version, so a conditional edit still succeeds
+	resp = s.doRequest("PUT", url+"/likes", "b7b7", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	resp = doConditional("GET", "If-None-Match", newEtag, "")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	likedEtag := resp.Header.Get("ETag")
+	s.Require().NotEqual(newEtag, likedEtag)
+	resp = doConditional("PATCH", "If-Match", newEtag, `{"text": "third edit"}`)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+}
+
+type revisionsPage struct {
+	Revisions []struct {
+		Version int64  `json:"version"`
+		Text    string `json:"text"`
+	} `json:"revisions"`
+	NextPage *string `json:"nextPage"`
+}
+
+func (s *APISuite) TestRevisions() {
+	p := s.createPost("a8a8", "v0")
+	url := "http://localhost:8080/api/v1/posts/" + p.Id
+	for _, text := range []string{"v1", "v2", "v3"} {
+		resp := s.doRequest("PATCH", url, "a8a8", strings.NewReader(`{"text": "`+text+`"}`))
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	var texts []string
+	pageUrl := url + "/revisions?size=2"
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page revisionsPage
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		for _, revision := range page.Revisions {
+			texts = append(texts, revision.Text)
+		}
+		if page.NextPage == nil {
+			break
+		}
+		pageUrl = url + "/revisions?size=2&page=" + *page.NextPage
+	}
+	s.Require().Equal([]string{"v2", "v1", "v0"}, texts)
+
+	resp := s.doRequest("DELETE", url, "a8a8", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	resp = s.doRequest("GET", url+"/revisions", "", nil)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+type reactionsPage struct {
+	UserIds  []string `json:"userIds"`
+	NextPage *string  `json:"nextPage"`
+}
+
+func (s *APISuite) TestReactions() {
+	p := s.createPost("a9a9", "react to me")
+	url := "http://localhost:8080/api/v1/posts/" + p.Id
+	for _, userId := range []string{"b1b1", "b2b2", "b1b1"} {
+		resp := s.doRequest("PUT", url+"/likes", userId, nil)
+		s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	}
+	resp := s.doRequest("PUT", url+"/reactions/love", "b1b1", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+
+	var counted struct {
+		LikeCount      int64            `json:"likeCount"`
+		ReactionCounts map[string]int64 `json:"reactionCounts"`
+	}
+	resp = s.doRequest("GET", url, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&counted))
+	s.Require().EqualValues(2, counted.LikeCount)
+	s.Require().Equal(map[string]int64{"love": 1}, counted.ReactionCounts)
+
+	var userIds []string
+	pageUrl := url + "/likes?size=1"
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page reactionsPage
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		userIds = append(userIds, page.UserIds...)
+		if page.NextPage == nil {
+			break
+		}
+		pageUrl = url + "/likes?size=1&page=" + *page.NextPage
+	}
+	s.Require().Equal([]string{"b2b2", "b1b1"}, userIds)
+
+	for i := 0; i < 2; i++ {
+		resp = s.doRequest("DELETE", url+"/likes", "b1b1", nil)
+		s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+		resp = s.doRequest("DELETE", url+"/reactions/love", "b1b1", nil)
+		s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	}
+	resp = s.doRequest("GET", url, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	counted.ReactionCounts = nil
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&counted))
+	s.Require().EqualValues(1, counted.LikeCount)
+	s.Require().Empty(counted.ReactionCounts)
+
+	resp = s.doRequest("PUT", "http://localhost:8080/api/v1/posts/f6f6"+p.Id+"/likes", "b1b1", nil)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (s *APISuite) reply(userId, replyToPostId, text string) post {
+	body, _ := json.Marshal(map[string]string{"text": text, "replyToPostId": replyToPostId})
+	resp := s.doRequest("POST", "http://localhost:8080/api/v1/posts", userId, bytes.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var p post
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	return p
+}
+
+type thread struct {
+	Ancestors []post `json:"ancestors"`
+	Post      struct {
+		post
+		RootPostId string `json:"rootPostId"`
+		ReplyCount int64  `json:"replyCount"`
+	} `json:"post"`
+	Replies  []post  `json:"replies"`
+	NextPage *string `json:"nextPage"`
+}
+
+func (s *APISuite) TestReplies() {
+	// d1d1 follows both the replying author and the replied one, d2d2 follows the replying author only
+	s.subscribe("c1c1", "d1d1")
+	s.subscribe("c2c2", "d1d1")
+	s.subscribe("c2c2", "d2d2")
+
+	root := s.createPost("c1c1", "root")
+	first := s.reply("c2c2", root.Id, "first reply")
+	second := s.reply("c1c1", root.Id, "second reply")
+	nested := s.reply("c1c1", first.Id, "nested reply")
+
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/posts/"+first.Id+"/thread?size=1", "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var t thread
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&t))
+	s.Require().Len(t.Ancestors, 1)
+	s.Require().Equal(root.Id, t.Ancestors[0].Id)
+	s.Require().Equal(first.Id, t.Post.Id)
+	s.Require().Equal(root.Id, t.Post.RootPostId)
+	s.Require().EqualValues(1, t.Post.ReplyCount)
+	s.Require().Len(t.Replies, 1)
+	s.Require().Equal(nested.Id, t.Replies[0].Id)
+	s.Require().Nil(t.NextPage)
+
+	var replyIds []string
+	pageUrl := "http://localhost:8080/api/v1/posts/" + root.Id + "/replies?size=1"
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page struct {
+			Replies  []post `json:"replies"`
+			NextPage *string
+		}
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		for _, reply := range page.Replies {
+			replyIds = append(replyIds, reply.Id)
+		}
+		if page.NextPage == nil {
+			break
+		}
+		pageUrl = "http://localhost:8080/api/v1/posts/" + root.Id + "/replies?size=1&page=" + *page.NextPage
+	}
+	s.Require().Equal([]string{first.Id, second.Id}, replyIds)
+
+	feedIds := func(userId string) []string {
+		var ids []string
+		for _, p := range s.getFeed(userId, nil, 10).Posts {
+			ids = append(ids, p.Id)
+		}
+		return ids
+	}
+	s.Require().Equal([]string{nested.Id, second.Id, first.Id, root.Id}, feedIds("d1d1"))
+	s.Require().Empty(feedIds("d2d2"))
+
+	body, _ := json.Marshal(map[string]string{"text": "orphan", "replyToPostId": "f6f6" + root.Id})
+	resp = s.doRequest("POST", "http://localhost:8080/api/v1/posts", "c2c2", bytes.NewReader(body))
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *APISuite) repost(userId, repostOfPostId, text string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"text": text, "repostOfPostId": repostOfPostId})
+	return s.doRequest("POST", "http://localhost:8080/api/v1/posts", userId, bytes.NewReader(body))
+}
+
+type repostedPost struct {
+	post
+	RepostOfPostId string `json:"repostOfPostId"`
+	RepostCount    int64  `json:"repostCount"`
+	QuoteCount     int64  `json:"quoteCount"`
+	RepostedBy     string `json:"repostedBy"`
+}
+
+func (s *APISuite) TestReposts() {
+	// f1f1 follows both reposters but not the original author
+	s.subscribe("e2e2", "f1f1")
+	s.subscribe("e3e3", "f1f1")
+
+	original := s.createPost("e1e1", "original")
+	resp := s.repost("e2e2", original.Id, "")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var first repostedPost
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&first))
+	s.Require().Equal(original.Id, first.RepostOfPostId)
+	s.Require().Empty(first.Text)
+
+	// reposting a repost reposts the original post
+	resp = s.repost("e3e3", first.Id, "")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var second repostedPost
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&second))
+	s.Require().Equal(original.Id, second.RepostOfPostId)
+
+	resp = s.repost("e2e2", original.Id, "")
+	s.Require().Equal(http.StatusConflict, resp.StatusCode)
+	resp = s.repost("e2e2", "f6f6"+original.Id, "")
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	resp = s.repost("e3e3", original.Id, "quote")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var quote repostedPost
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&quote))
+	s.Require().Equal(original.Id, quote.RepostOfPostId)
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/posts/"+original.Id, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var counted repostedPost
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&counted))
+	s.Require().EqualValues(2, counted.RepostCount)
+	s.Require().EqualValues(1, counted.QuoteCount)
+
+	feed := func() []repostedPost {
+		resp := s.doRequest("GET", "http://localhost:8080/api/v1/feed?size=10", "f1f1", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page struct {
+			Posts []repostedPost `json:"posts"`
+		}
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		return page.Posts
+	}
+	posts := feed()
+	s.Require().Len(posts, 2)
+	s.Require().Equal(quote.Id, posts[0].Id)
+	s.Require().Empty(posts[0].RepostedBy)
+	s.Require().Equal(original.Id, posts[1].Id)
+	s.Require().Contains([]string{"e2e2", "e3e3"}, posts[1].RepostedBy)
+
+	// the post stays in the feed while a followed author reposts it
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+first.Id, "e2e2", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	posts = feed()
+	s.Require().Len(posts, 2)
+	s.Require().Equal("e3e3", posts[1].RepostedBy)
+
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+second.Id, "e3e3", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	posts = feed()
+	s.Require().Len(posts, 1)
+	s.Require().Equal(quote.Id, posts[0].Id)
+}
+
+func (s *APISuite) TestUnsubscribeKeepsRepostsOfFollowedAuthors() {
+	s.subscribe("e6e6", "f2f2")
+	s.subscribe("e7e7", "f2f2")
+	original := s.createPost("e6e6", "original")
+	resp := s.repost("e7e7", original.Id, "")
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/users/e6e6/subscribe", "f2f2", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/feed?size=10", "f2f2", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var page struct {
+		Posts []repostedPost `json:"posts"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+	s.Require().Len(page.Posts, 1)
+	s.Require().Equal(original.Id, page.Posts[0].Id)
+	s.Require().Equal("e7e7", page.Posts[0].RepostedBy)
+}
+
+type hashtagPost struct {
+	post
+	Hashtags []string `json:"hashtags"`
+}
+
+func (s *APISuite) TestHashtags() {
+	first := s.createPost("g1g1", "#Go and #golang, #go again")
+	second := s.createPost("g2g2", "learning #go")
+	s.createPost("g2g2", "no hashtags, a#b is not one")
+
+	var created hashtagPost
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/posts/"+first.Id, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&created))
+	s.Require().Equal([]string{"go", "golang"}, created.Hashtags)
+
+	var postIds []string
+	pageUrl := "http://localhost:8080/api/v1/tags/GO/posts?size=1"
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page postsPage
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		for _, p := range page.Posts {
+			postIds = append(postIds, p.Id)
+		}
+		if page.NextPage == nil {
+			break
+		}
+		pageUrl = "http://localhost:8080/api/v1/tags/go/posts?size=1&page=" + *page.NextPage
+	}
+	s.Require().Equal([]string{second.Id, first.Id}, postIds)
+
+	// the patched post leaves the timeline of the removed hashtag
+	body, _ := json.Marshal(map[string]string{"text": "#golang only"})
+	resp = s.doRequest("PATCH", "http://localhost:8080/api/v1/posts/"+first.Id, "g1g1", bytes.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/tags/go/posts", "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var page postsPage
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+	s.Require().Len(page.Posts, 1)
+	s.Require().Equal(second.Id, page.Posts[0].Id)
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/tags/trending?size=2", "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var trending struct {
+		Tags []struct {
+			Tag   string `json:"tag"`
+			Count int64  `json:"count"`
+		} `json:"tags"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&trending))
+	// the hashtag removed by the patch is not counted
+	s.Require().Len(trending.Tags, 2)
+	s.Require().Equal("go", trending.Tags[0].Tag)
+	s.Require().EqualValues(1, trending.Tags[0].Count)
+	s.Require().Equal("golang", trending.Tags[1].Tag)
+	s.Require().EqualValues(1, trending.Tags[1].Count)
+
+	// uses added by a patch and uses of deleted posts are taken back
+	body, _ = json.Marshal(map[string]string{"text": "no hashtags"})
+	resp = s.doRequest("PATCH", "http://localhost:8080/api/v1/posts/"+first.Id, "g1g1", bytes.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+second.Id, "g2g2", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/tags/trending?size=100", "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	trending.Tags = nil
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&trending))
+	for _, tag := range trending.Tags {
+		s.Require().NotContains([]string{"go", "golang"}, tag.Tag)
+	}
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/tags/not-a-tag/posts", "", nil)
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *APISuite) mentions(userId string) []string {
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/mentions", userId, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var page postsPage
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+	var ids []string
+	for _, p := range page.Posts {
+		ids = append(ids, p.Id)
+	}
+	return ids
+}
+
+func (s *APISuite) TestMentions() {
+	userId := fmt.Sprintf("%x", time.Now().UnixNano())
+	handle := "mentioned_" + userId[len(userId)-8:]
+	body := `{"handle": "` + handle + `"}`
+	resp := s.doRequest("POST", "http://localhost:8080/api/v1/users", userId, strings.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	// a9a9 is known by its posts only, and no user has the hex-looking id of @cafe
+	s.createPost("a9a9", "hello")
+	// the mentioned users do not follow the authors
+	byHandle := s.createPost("h1h1", "hello @"+strings.ToUpper(handle))
+	byId := s.createPost("h2h2", "hello @a9a9 and @"+userId)
+	s.createPost("h1h1", "mail a9a9@example.com, @not-a-user, @cafe")
+	s.Require().Equal([]string{byId.Id, byHandle.Id}, s.mentions(userId))
+	s.Require().Equal([]string{byId.Id}, s.mentions("a9a9"))
+
+	var created struct {
+		Mentions []string `json:"mentions"`
+	}
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/posts/"+byId.Id, "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&created))
+	s.Require().Equal([]string{"a9a9", userId}, created.Mentions)
+
+	// the author of the first post is known by it
+	newcomer := fmt.Sprintf("%x", time.Now().UnixNano())
+	self := s.createPost(newcomer, "hello from @"+newcomer)
+	s.Require().Equal([]string{self.Id}, s.mentions(newcomer))
+
+	patch := func(p post, text string) {
+		body, _ := json.Marshal(map[string]string{"text": text})
+		resp := s.doRequest("PATCH", "http://localhost:8080/api/v1/posts/"+p.Id, p.AuthorId, bytes.NewReader(body))
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+	}
+	patch(byId, "hello @a9a9")
+	s.Require().Equal([]string{byHandle.Id}, s.mentions(userId))
+	patch(byId, "hello @"+handle)
+	s.Require().Equal([]string{byId.Id, byHandle.Id}, s.mentions(userId))
+	s.Require().Empty(s.mentions("a9a9"))
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/mentions", "", nil)
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *APISuite) search(query string) []string {
+	var ids []string
+	pageUrl := "http://localhost:8080/api/v1/search/posts?size=1&" + query
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page postsPage
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		for _, p := range page.Posts {
+			ids = append(ids, p.Id)
+		}
+		if page.NextPage == nil {
+			return ids
+		}
+		pageUrl = "http://localhost:8080/api/v1/search/posts?size=1&" + query + "&page=" + *page.NextPage
+	}
+}
+
+func (s *APISuite) TestSearchPosts() {
+	frequent := s.createPost("a7a7", "Quokka, quokka at sunset")
+	rare := s.createPost("b7b7", "a quokka at noon")
+	other := s.createPost("a7a7", "sunset only")
+
+	s.Require().Equal([]string{frequent.Id, rare.Id}, s.search("q=quokka"))
+	s.Require().Equal([]string{frequent.Id, other.Id}, s.search("q=QUOKKA+sunset&author=a7a7"))
+	s.Require().Empty(s.search("q=quokka&since=2100-01-01T00:00:00Z"))
+	s.Require().Equal([]string{rare.Id}, s.search("q=quokka&author=b7b7&until=2100-01-01T00:00:00.000Z"))
+
+	body, _ := json.Marshal(map[string]string{"text": "a wombat at noon"})
+	resp := s.doRequest("PATCH", "http://localhost:8080/api/v1/posts/"+rare.Id, "b7b7", bytes.NewReader(body))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().Equal([]string{frequent.Id}, s.search("q=quokka"))
+	s.Require().Equal([]string{rare.Id}, s.search("q=wombat"))
+
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+frequent.Id, "a7a7", nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	s.Require().Empty(s.search("q=quokka"))
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/search/posts?q=%21%21", "", nil)
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (s *APISuite) TestSearchPagesDoNotShiftOnWrites() {
+	found := []post{
+		s.createPost("c7c7", "numbat numbat numbat"),
+		s.createPost("c7c7", "bilby bilby"),
+		s.createPost("c7c7", "numbat bilby"),
+	}
+
+	var ids []string
+	pageUrl := "http://localhost:8080/api/v1/search/posts?size=1&q=numbat+bilby"
+	for {
+		resp := s.doRequest("GET", pageUrl, "", nil)
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+		var page postsPage
+		s.Require().NoError(json.NewDecoder(resp.Body).Decode(&page))
+		for _, p := range page.Posts {
+			ids = append(ids, p.Id)
+		}
+		if page.NextPage == nil {
+			break
+		}
+		// new posts change the weights of the terms, a deleted post keeps the position of the page
+		s.createPost("d7d7", "numbat")
+		s.createPost("d7d7", "numbat")
+		if len(ids) == 1 {
+			resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+found[2].Id, "c7c7", nil)
+			s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+		}
+		pageUrl = "http://localhost:8080/api/v1/search/posts?size=1&q=numbat+bilby&page=" + *page.NextPage
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		s.Require().False(seen[id], "post %s is found twice", id)
+		seen[id] = true
+	}
+	s.Require().True(seen[found[0].Id] || seen[found[1].Id])
+}
+
+func (s *APISuite) searchUsers(query string) []string {
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/search/users?q="+url.QueryEscape(query), "", nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	var result struct {
+		Users []struct {
+			Id string `json:"id"`
+		} `json:"users"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&result))
+	var ids []string
+	for _, user := range result.Users {
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
+func (s *APISuite) TestSearchUsers() {
+	suffix := fmt.Sprintf("%x", time.Now().UnixNano())
+	prefix := "zq" + suffix[len(suffix)-6:]
+	popular, unpopular := "a8a8"+suffix, "b8b8"+suffix
+	for userId, body := range map[string]string{
+		popular:   `{"handle": "` + prefix + `_alpha", "displayName": "Alpha Bravo"}`,
+		unpopular: `{"handle": "` + prefix + `_beta", "displayName": "Beta Alpha"}`,
+	} {
+		resp := s.doRequest("POST", "http://localhost:8080/api/v1/users", userId, strings.NewReader(body))
+		s.Require().Equal(http.StatusOK, resp.StatusCode)
+	}
+	s.subscribe(popular, "c8c8")
+	s.subscribe(popular, "d8d8")
+	s.subscribe(unpopular, "c8c8")
+
+	s.Require().Equal([]string{popular, unpopular}, s.searchUsers(strings.ToUpper(prefix)))
+	s.Require().Equal([]string{unpopular}, s.searchUsers("@"+prefix+" bet"))
+
+	resp := s.doRequest("PATCH", "http://localhost:8080/api/v1/users/me", unpopular, strings.NewReader(`{"displayName": "Gamma"}`))
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().Empty(s.searchUsers(prefix + " bet"))
+	s.Require().Equal([]string{unpopular}, s.searchUsers(prefix+" gam"))
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/search/users?q=%40", "", nil)
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+type streamEvent struct {
+	Id    string
+	Event string
+	Data  string
+}
+
+// openFeedStream connects to the feed stream, the spec validating client is not used,
+// since it reads the whole body.
+func (s *APISuite) openFeedStream(userId, lastEventId string) (*bufio.Reader, func()) {
+	req, _ := http.NewRequest("GET", "http://localhost:8080/api/v1/feed/stream", nil)
+	req.Header.Set("System-Design-User-Id", userId)
+	if lastEventId != "" {
+		req.Header.Set("Last-Event-ID", lastEventId)
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	s.Require().NoError(err)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+	s.Require().Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+// nextStreamEvent returns the next event of the stream, skipping comments and retry hints.
+func (s *APISuite) nextStreamEvent(stream *bufio.Reader) streamEvent {
+	var event streamEvent
+	for {
+		line, err := stream.ReadString('\n')
+		s.Require().NoError(err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if event.Data != "" {
+				return event
+			}
+			continue
+		}
+		field := strings.SplitN(line, ": ", 2)
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case "id":
+			event.Id = field[1]
+		case "event":
+			event.Event = field[1]
+		case "data":
+			event.Data = field[1]
+		}
+	}
+}
+
+func (s *APISuite) TestFeedStream() {
+	s.requireInMemoryStorage()
+
+	author, reader := "a0a0", "b0b0"
+	s.subscribe(author, reader)
+	s.createPost(author, "before the stream")
+
+	stream, closeStream := s.openFeedStream(reader, "")
+	s.createPost(reader, "own posts are not streamed")
+	live := s.createPost(author, "live")
+	event := s.nextStreamEvent(stream)
+	s.Require().Equal(live.Id, event.Id)
+	var p post
+	s.Require().NoError(json.Unmarshal([]byte(event.Data), &p))
+	s.Require().Equal("live", p.Text)
+	closeStream()
+
+	// posts added while disconnected are replayed oldest first
+	missed1 := s.createPost(author, "missed 1")
+	missed2 := s.createPost(author, "missed 2")
+	stream, closeStream = s.openFeedStream(reader, live.Id)
+	s.Require().Equal(missed1.Id, s.nextStreamEvent(stream).Id)
+	s.Require().Equal(missed2.Id, s.nextStreamEvent(stream).Id)
+	next := s.createPost(author, "next")
+	s.Require().Equal(next.Id, s.nextStreamEvent(stream).Id)
+	closeStream()
+
+	stream, closeStream = s.openFeedStream(reader, "unknown")
+	s.Require().Equal("reset", s.nextStreamEvent(stream).Event)
+	closeStream()
+
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/feed/stream", "", nil)
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *APISuite) getFeedSince(userId string, since string, size int) postsPage {
+	url := fmt.Sprintf("http://localhost:8080/api/v1/feed?size=%d&since=%s", size, since)
+	resp := s.doRequest("GET", url, userId, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var p postsPage
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&p))
+	return p
+}
+
+func (s *APISuite) unreadCount(userId string) int {
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/feed/unread-count", userId, nil)
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	var unread struct {
+		Count int `json:"count"`
+	}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&unread))
+	return unread.Count
+}
+
+func (s *APISuite) setReadMarker(userId, postId string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"postId": postId})
+	return s.doRequest("PUT", "http://localhost:8080/api/v1/feed/read-marker", userId, bytes.NewReader(body))
+}
+
+func (s *APISuite) TestFeedSinceAndReadMarker() {
+	s.requireInMemoryStorage()
+
+	author, reader := "a6a6", "b6b6"
+	s.subscribe(author, reader)
+	seen := s.createPost(author, "seen")
+	p1 := s.createPost(author, "first")
+	p2 := s.createPost(author, "second")
+	p3 := s.createPost(author, "third")
+
+	// newer posts are returned oldest first
+	feed := s.getFeedSince(reader, seen.Id, 2)
+	s.Require().Len(feed.Posts, 2)
+	s.Require().Equal(p1.Id, feed.Posts[0].Id)
+	s.Require().Equal(p2.Id, feed.Posts[1].Id)
+	s.Require().NotNil(feed.NextPage)
+	s.Require().Equal(p2.Id, *feed.NextPage)
+
+	feed = s.getFeedSince(reader, *feed.NextPage, 2)
+	s.Require().Len(feed.Posts, 1)
+	s.Require().Equal(p3.Id, feed.Posts[0].Id)
+	s.Require().Nil(feed.NextPage)
+	s.Require().Empty(s.getFeedSince(reader, p3.Id, 2).Posts)
+
+	resp := s.doRequest("GET", "http://localhost:8080/api/v1/feed?page="+p3.Id+"&since="+seen.Id, reader, nil)
+	s.Require().Equal(http.StatusBadRequest, resp.StatusCode)
+
+	s.Require().Equal(4, s.unreadCount(reader))
+	resp = s.setReadMarker(reader, p1.Id)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	s.Require().Equal(2, s.unreadCount(reader))
+
+	// the marker is not moved back
+	resp = s.setReadMarker(reader, seen.Id)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	s.Require().Equal(2, s.unreadCount(reader))
+
+	p4 := s.createPost(author, "fourth")
+	s.Require().Equal(3, s.unreadCount(reader))
+
+	// a deleted since post keeps its position in the feed
+	resp = s.doRequest("DELETE", "http://localhost:8080/api/v1/posts/"+p2.Id, author, nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	feed = s.getFeedSince(reader, p2.Id, 2)
+	s.Require().Len(feed.Posts, 2)
+	s.Require().Equal(p3.Id, feed.Posts[0].Id)
+	s.Require().Equal(p4.Id, feed.Posts[1].Id)
+
+	resp = s.setReadMarker(reader, "f6f6"+p1.Id)
+	s.Require().Equal(http.StatusNotFound, resp.StatusCode)
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/feed/unread-count", "", nil)
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+}
+
+func (s *APISuite) dialWebSocket(userId string) *websocket.Conn {
+	config, err := websocket.NewConfig("ws://localhost:8080/api/v1/ws", "http://localhost:8080")
+	s.Require().NoError(err)
+	config.Header.Set("System-Design-User-Id", userId)
+	ws, err := websocket.DialConfig(config)
+	s.Require().NoError(err)
+	s.Require().NoError(ws.SetDeadline(time.Now().Add(5 * time.Second)))
+	return ws
+}
+
+type webSocketMessage struct {
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic"`
+	Id      string          `json:"id"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message"`
+}
+
+func (s *APISuite) sendWebSocket(ws *websocket.Conn, messageType, topic string) {
+	s.Require().NoError(websocket.JSON.Send(ws, map[string]string{"type": messageType, "topic": topic}))
+}
+
+// receiveWebSocket returns the next count messages by topic, messages of different topics may be reordered.
+func (s *APISuite) receiveWebSocket(ws *websocket.Conn, count int) map[string]webSocketMessage {
+	messages := make(map[string]webSocketMessage)
+	for len(messages) < count {
+		var message webSocketMessage
+		s.Require().NoError(websocket.JSON.Receive(ws, &message))
+		if message.Type != "ping" {
+			messages[message.Topic] = message
+		}
+	}
+	return messages
+}
+
+func (s *APISuite) TestWebSocket() {
+	s.requireInMemoryStorage()
+
+	author, reader := "d0d0", "c0c0"
+	s.subscribe(author, reader)
+	own := s.createPost(reader, "own post")
+
+	ws := s.dialWebSocket(reader)
+	defer ws.Close()
+	for _, topic := range []string{"feed", "notifications", "post:" + own.Id, "unknown", "post:missing"} {
+		s.sendWebSocket(ws, "subscribe", topic)
+	}
+	acks := s.receiveWebSocket(ws, 5)
+	s.Require().Equal("subscribed", acks["feed"].Type)
+	s.Require().Equal("subscribed", acks["notifications"].Type)
+	s.Require().Equal("subscribed", acks["post:"+own.Id].Type)
+	s.Require().Equal("error", acks["unknown"].Type)
+	s.Require().Equal("error", acks["post:missing"].Type)
+
+	mention := s.createPost(author, "hi @"+reader)
+	events := s.receiveWebSocket(ws, 2)
+	s.Require().Equal("feedPost", events["feed"].Type)
+	s.Require().Equal(mention.Id, events["feed"].Id)
+	s.Require().Equal("notification", events["notifications"].Type)
+	s.Require().JSONEq(`{"kind": "mention", "userId": "`+author+`", "postId": "`+mention.Id+`"}`, string(events["notifications"].Data))
+
+	resp := s.doRequest("PUT", "http://localhost:8080/api/v1/posts/"+own.Id+"/likes", author, nil)
+	s.Require().Equal(http.StatusNoContent, resp.StatusCode)
+	update := s.receiveWebSocket(ws, 1)["post:"+own.Id]
+	s.Require().Equal("postUpdated", update.Type)
+	var liked struct {
+		LikeCount int64 `json:"likeCount"`
+	}
+	s.Require().NoError(json.Unmarshal(update.Data, &liked))
+	s.Require().EqualValues(1, liked.LikeCount)
+
+	s.sendWebSocket(ws, "unsubscribe", "feed")
+	s.Require().Equal("unsubscribed", s.receiveWebSocket(ws, 1)["feed"].Type)
+	s.createPost(author, "not streamed")
+	s.subscribe(reader, "e0e0")
+	messages := s.receiveWebSocket(ws, 1)
+	s.Require().Len(messages, 1)
+	s.Require().JSONEq(`{"kind": "subscription", "userId": "e0e0"}`, string(messages["notifications"].Data))
+
+	resp = s.doRequest("GET", "http://localhost:8080/api/v1/ws", "", nil)
+	s.Require().Equal(http.StatusUnauthorized, resp.StatusCode)
+}
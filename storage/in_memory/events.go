@@ -0,0 +1,57 @@
+package in_memory
+
+import (
+	"context"
+	"log"
+	"miniblog/feedstream"
+	"miniblog/storage"
+)
+
+// publish sends events to the connected readers of their topics unless err is set by building them.
+// Publishing is best effort, since readers fall back to reading the storage.
+func (s *InMemoryStorage) publish(ctx context.Context, events []feedstream.Event, err error) {
+	if err == nil {
+		err = s.feedEvents.Publish(ctx, events)
+	}
+	if err != nil {
+		log.Printf("Failed to publish events: %s", err.Error())
+	}
+}
+
+// publishNewPost sends the new post to the connected readers of feeds it was added to and notifies
+// the users it concerns. The post reposted by a plain repost is sent to feeds instead of the repost.
+// Must be called with the lock held.
+func (s *InMemoryStorage) publishNewPost(ctx context.Context, post Post, readers []string) {
+	events, err := feedstream.NewPostNotifications(&post, post.replyToAuthorId, s.posts[post.RepostOfPostId].AuthorId)
+	if err == nil && len(readers) > 0 {
+		feedPost := post
+		if storage.IsPlainRepost(&post) {
+			feedPost = s.posts[post.RepostOfPostId]
+			feedPost.RepostedBy = post.AuthorId
+		}
+		var feedEvents []feedstream.Event
+		feedEvents, err = feedstream.NewFeedEvents(&feedPost, readers)
+		events = append(events, feedEvents...)
+	}
+	s.publish(ctx, events, err)
+}
+
+// publishPostUpdate sends the current state of the post to its readers. Must be called with the lock held.
+func (s *InMemoryStorage) publishPostUpdate(ctx context.Context, postId string) {
+	post, found := s.posts[postId]
+	if !found {
+		return
+	}
+	event, err := feedstream.NewPostUpdatedEvent(&post)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
+
+func (s *InMemoryStorage) publishPostDeleted(ctx context.Context, postId string) {
+	event, err := feedstream.NewPostDeletedEvent(postId)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
+
+func (s *InMemoryStorage) publishSubscription(ctx context.Context, userId string, subscriber string) {
+	event, err := feedstream.NewSubscriptionNotification(userId, subscriber)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
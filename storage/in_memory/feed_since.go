@@ -0,0 +1,61 @@
+package in_memory
+
+import (
+	"context"
+	"fmt"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+func (s *InMemoryStorage) FeedSince(ctx context.Context, userId string, since string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	// a deleted post keeps its position, so that clients reading the feed since it do not start over
+	sinceSeq, found := s.seqOf(since)
+	if !found {
+		return nil, nil, fmt.Errorf("since post %s not found: %w", since, storage.ClientError)
+	}
+	feed := s.feeds[userId]
+	first := s.indexAfter(feed, sinceSeq)
+	last := len(feed)
+	if first+size < last {
+		last = first + size
+	}
+	posts := make([]models.Post, 0, last-first)
+	for _, postId := range feed[first:last] {
+		post := s.posts[postId]
+		post.RepostedBy = s.repostedBy[userId][postId]
+		posts = append(posts, &post)
+	}
+	if last == len(feed) {
+		return posts, nil, nil
+	}
+	return posts, &feed[last-1], nil
+}
+
+func (s *InMemoryStorage) SetFeedReadMarker(ctx context.Context, userId string, postId string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	post, found := s.posts[postId]
+	if !found {
+		return fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	if post.seq > s.feedReadMarkers[userId] {
+		s.feedReadMarkers[userId] = post.seq
+	}
+	return nil
+}
+
+func (s *InMemoryStorage) GetFeedUnreadCount(ctx context.Context, userId string) (int, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	feed := s.feeds[userId]
+	unread := len(feed) - s.indexAfter(feed, s.feedReadMarkers[userId])
+	if unread > storage.MAX_FEED_UNREAD_COUNT {
+		unread = storage.MAX_FEED_UNREAD_COUNT
+	}
+	return unread, nil
+}
@@ -0,0 +1,14 @@
+package in_memory
+
+import (
+	"context"
+	"miniblog/storage/models"
+)
+
+func (s *InMemoryStorage) GetPostsByHashtag(
+	ctx context.Context, hashtag string, page *string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return s.paginate(s.postIdsByHashtag[hashtag], page, size)
+}
@@ -0,0 +1,31 @@
+package in_memory
+
+import (
+	"context"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+// resolveMentions returns ids of users mentioned in the text of the post of authorId.
+// The author exists even before the first post is stored. Must be called with the lock held.
+func (s *InMemoryStorage) resolveMentions(text string, authorId string) []string {
+	return storage.ResolveMentions(storage.ExtractMentions(text), s.userIdsByHandle, func(userId string) bool {
+		return userId == authorId || s.userExists(userId)
+	})
+}
+
+// userExists tells if the user has a profile, posts or subscriptions. Must be called with the lock held.
+func (s *InMemoryStorage) userExists(userId string) bool {
+	if _, found := s.users[userId]; found {
+		return true
+	}
+	return len(s.postIdsByUser[userId]) > 0 || len(s.subscriptions[userId]) > 0 || len(s.subscribers[userId]) > 0
+}
+
+func (s *InMemoryStorage) GetPostsMentioning(
+	ctx context.Context, userId string, page *string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return s.paginate(s.postIdsByMention[userId], page, size)
+}
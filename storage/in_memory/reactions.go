@@ -0,0 +1,99 @@
+package in_memory
+
+import (
+	"context"
+	"fmt"
+	"miniblog/storage"
+)
+
+func indexOf(userIds []string, userId string) int {
+	for i, id := range userIds {
+		if id == userId {
+			return i
+		}
+	}
+	return -1
+}
+
+// addReactionCount must be called with the write lock held.
+func (s *InMemoryStorage) addReactionCount(postId string, reaction string, delta int64) {
+	post := s.posts[postId]
+	if reaction == storage.Like {
+		post.LikeCount += delta
+	} else {
+		counts := make(map[string]int64, len(post.ReactionCounts)+1)
+		for r, count := range post.ReactionCounts {
+			counts[r] = count
+		}
+		counts[reaction] += delta
+		if counts[reaction] == 0 {
+			delete(counts, reaction)
+		}
+		post.ReactionCounts = counts
+	}
+	s.posts[postId] = post
+}
+
+func (s *InMemoryStorage) AddReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, found := s.posts[postId]; !found {
+		return fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	if s.reactions[postId] == nil {
+		s.reactions[postId] = make(map[string][]string)
+	}
+	if indexOf(s.reactions[postId][reaction], userId) >= 0 {
+		return nil
+	}
+	s.reactions[postId][reaction] = append(s.reactions[postId][reaction], userId)
+	s.addReactionCount(postId, reaction, 1)
+	s.publishPostUpdate(ctx, postId)
+	return nil
+}
+
+func (s *InMemoryStorage) RemoveReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, found := s.posts[postId]; !found {
+		return fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	userIds := s.reactions[postId][reaction]
+	i := indexOf(userIds, userId)
+	if i < 0 {
+		return nil
+	}
+	s.reactions[postId][reaction] = append(userIds[:i:i], userIds[i+1:]...)
+	s.addReactionCount(postId, reaction, -1)
+	s.publishPostUpdate(ctx, postId)
+	return nil
+}
+
+func (s *InMemoryStorage) GetReactions(
+	ctx context.Context, postId string, reaction string, page *string, size int) ([]string, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if _, found := s.posts[postId]; !found {
+		return nil, nil, fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	userIds := s.reactions[postId][reaction]
+	last := len(userIds) - 1
+	if page != nil {
+		last = indexOf(userIds, *page)
+		if last < 0 {
+			return nil, nil, fmt.Errorf("invalid reactions page %s: %w", *page, storage.ClientError)
+		}
+	}
+	result := make([]string, 0, size)
+	for i := last; i >= 0; i-- {
+		if len(result) == size {
+			nextPage := userIds[i]
+			return result, &nextPage, nil
+		}
+		result = append(result, userIds[i])
+	}
+	return result, nil, nil
+}
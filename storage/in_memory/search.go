@@ -0,0 +1,162 @@
+package in_memory
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexText moves the post between the search index terms when its text changes.
+// Must be called with the write lock held.
+func (s *InMemoryStorage) indexText(postId string, previous string, current string) {
+	for _, term := range storage.Tokenize(previous) {
+		delete(s.searchIndex[term], postId)
+		if len(s.searchIndex[term]) == 0 {
+			delete(s.searchIndex, term)
+		}
+	}
+	for _, term := range storage.Tokenize(current) {
+		if s.searchIndex[term] == nil {
+			s.searchIndex[term] = make(map[string]int)
+		}
+		s.searchIndex[term][postId]++
+	}
+}
+
+type searchResult struct {
+	post  Post
+	score float64
+}
+
+// before tells if the result goes before the other one in the search results.
+func (r *searchResult) before(score float64, seq int64) bool {
+	return r.score > score || (r.score == score && r.post.seq > seq)
+}
+
+// searchPage is the position of the first result of a page. It keeps the weights of the query terms
+// of the first page, which change with every written post, so that results keep their scores.
+type searchPage struct {
+	score   float64
+	seq     int64
+	weights []float64
+}
+
+func (p *searchPage) encode() string {
+	weights := make([]string, len(p.weights))
+	for i, weight := range p.weights {
+		weights[i] = strconv.FormatFloat(weight, 'g', -1, 64)
+	}
+	raw := fmt.Sprintf("%s %d %s", strconv.FormatFloat(p.score, 'g', -1, 64), p.seq, strings.Join(weights, ","))
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSearchPage(page string, terms int) (searchPage, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(page)
+	if err != nil {
+		return searchPage{}, fmt.Errorf("invalid search page %s: %w", page, storage.ClientError)
+	}
+	parts := strings.Split(string(raw), " ")
+	if len(parts) != 3 {
+		return searchPage{}, fmt.Errorf("invalid search page %s: %w", page, storage.ClientError)
+	}
+	var decoded searchPage
+	if decoded.score, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return searchPage{}, fmt.Errorf("invalid search page score %s: %w", page, storage.ClientError)
+	}
+	if decoded.seq, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return searchPage{}, fmt.Errorf("invalid search page seq %s: %w", page, storage.ClientError)
+	}
+	weights := strings.Split(parts[2], ",")
+	if len(weights) != terms {
+		return searchPage{}, fmt.Errorf("search page %s does not match the query: %w", page, storage.ClientError)
+	}
+	decoded.weights = make([]float64, terms)
+	for i, weight := range weights {
+		if decoded.weights[i], err = strconv.ParseFloat(weight, 64); err != nil {
+			return searchPage{}, fmt.Errorf("invalid search page weight %s: %w", page, storage.ClientError)
+		}
+	}
+	return decoded, nil
+}
+
+func distinctTerms(terms []string) []string {
+	var distinct []string
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			distinct = append(distinct, term)
+		}
+	}
+	return distinct
+}
+
+func (s *InMemoryStorage) SearchPosts(
+	ctx context.Context, query storage.SearchQuery, page *string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	terms := distinctTerms(query.Terms)
+	var position *searchPage
+	var weights []float64
+	if page != nil {
+		decoded, err := decodeSearchPage(*page, len(terms))
+		if err != nil {
+			return nil, nil, err
+		}
+		position, weights = &decoded, decoded.weights
+	} else {
+		// terms are weighted by inverse document frequency, so rare terms matter more
+		weights = make([]float64, len(terms))
+		for i, term := range terms {
+			weights[i] = math.Log(1 + float64(len(s.posts))/float64(len(s.searchIndex[term])))
+		}
+	}
+
+	scores := make(map[string]float64)
+	for i, term := range terms {
+		for postId, count := range s.searchIndex[term] {
+			scores[postId] += float64(count) * weights[i]
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	previous := 0
+	for postId, score := range scores {
+		post := s.posts[postId]
+		if (query.AuthorId != "" && post.AuthorId != query.AuthorId) ||
+			(query.CreatedAfter != "" && post.CreatedAt < query.CreatedAfter) ||
+			(query.CreatedBefore != "" && post.CreatedAt > query.CreatedBefore) {
+			continue
+		}
+		result := searchResult{post: post, score: score}
+		// the page starts at its position, results before it were returned on the previous pages
+		if position != nil && result.before(position.score, position.seq) {
+			previous++
+			continue
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].before(results[j].score, results[j].post.seq)
+	})
+
+	posts := make([]models.Post, 0, size)
+	for i := range results {
+		if previous+i == storage.MAX_SEARCH_RESULTS {
+			break
+		}
+		if len(posts) == size {
+			nextPage := (&searchPage{score: results[i].score, seq: results[i].post.seq, weights: weights}).encode()
+			return posts, &nextPage, nil
+		}
+		posts = append(posts, &results[i].post)
+	}
+	return posts, nil, nil
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"miniblog/feedstream"
 	"miniblog/storage"
 	"miniblog/storage/models"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +20,45 @@ type Post struct {
 	Text           string `json:"text"`
 	CreatedAt      string `json:"createdAt"`
 	LastModifiedAt string `json:"lastModifiedAt"`
+	LikeCount      int64  `json:"likeCount"`
+	// ReactionCounts is replaced rather than modified, since posts are copied by value
+	ReactionCounts map[string]int64 `json:"reactionCounts,omitempty"`
+	ReplyToPostId  string           `json:"replyToPostId,omitempty"`
+	RootPostId     string           `json:"rootPostId,omitempty"`
+	ReplyCount     int64            `json:"replyCount"`
+	RepostOfPostId string           `json:"repostOfPostId,omitempty"`
+	RepostCount    int64            `json:"repostCount"`
+	QuoteCount     int64            `json:"quoteCount"`
+	Hashtags       []string         `json:"hashtags,omitempty"`
+	Mentions       []string         `json:"mentions,omitempty"`
+	// RepostedBy is set on feed posts that are in the feed because a followed user reposted them
+	RepostedBy string `json:"repostedBy,omitempty"`
+	// replyToAuthorId is the author of the replied post
+	replyToAuthorId string
+	// seq orders posts of all users by creation time
+	seq int64
+	// version is incremented on every patch
+	version int64
+	// hashtagUses are the hashtags counted in trending hashtags and when they were recorded
+	hashtagUses []storage.HashtagUse
+}
+
+type Revision struct {
+	Version   int64  `json:"version"`
+	Text      string `json:"text"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (r *Revision) GetVersion() int64 {
+	return r.Version
+}
+
+func (r *Revision) GetText() string {
+	return r.Text
+}
+
+func (r *Revision) GetCreatedAt() string {
+	return r.CreatedAt
 }
 
 func (p *Post) GetId() string {
@@ -23,7 +66,47 @@ func (p *Post) GetId() string {
 }
 
 func (p *Post) GetVersion() int64 {
-	return 0
+	return p.version
+}
+
+func (p *Post) GetLikeCount() int64 {
+	return p.LikeCount
+}
+
+func (p *Post) GetReactionCounts() map[string]int64 {
+	return p.ReactionCounts
+}
+
+func (p *Post) GetReplyToPostId() string {
+	return p.ReplyToPostId
+}
+
+func (p *Post) GetRootPostId() string {
+	return p.RootPostId
+}
+
+func (p *Post) GetReplyCount() int64 {
+	return p.ReplyCount
+}
+
+func (p *Post) GetRepostOfPostId() string {
+	return p.RepostOfPostId
+}
+
+func (p *Post) GetRepostCount() int64 {
+	return p.RepostCount
+}
+
+func (p *Post) GetQuoteCount() int64 {
+	return p.QuoteCount
+}
+
+func (p *Post) GetHashtags() []string {
+	return p.Hashtags
+}
+
+func (p *Post) GetMentions() []string {
+	return p.Mentions
 }
 
 func (p *Post) GetAuthorId() string {
@@ -42,26 +125,148 @@ func (p *Post) GetLastModifiedAt() string {
 	return p.LastModifiedAt
 }
 
+type userSet map[string]struct{}
+
 type InMemoryStorage struct {
 	mut           sync.RWMutex
 	posts         map[string]Post
 	postIdsByUser map[string][]string
+	// subscriptions[user] - users that user is subscribed to
+	subscriptions map[string]userSet
+	// subscribers[user] - users subscribed to user
+	subscribers map[string]userSet
+	// feeds[user] - ids of posts in user's feed, oldest first
+	feeds map[string][]string
+	// lastSeq is the seq of the newest post, post ids start with their seq (see newPostId)
+	lastSeq int64
+	// feedReadMarkers[user] - seq of the newest post of user's feed the user has read
+	feedReadMarkers map[string]int64
+	// revisions[post] - earlier versions of post, oldest first
+	revisions map[string][]Revision
+	// replies[post] - ids of direct replies to post, oldest first
+	replies map[string][]string
+	// postIdsByHashtag[hashtag] - ids of posts having hashtag, oldest first
+	postIdsByHashtag map[string][]string
+	// postIdsByMention[user] - ids of posts mentioning user, oldest first
+	postIdsByMention map[string][]string
+	// searchIndex[term][post] - occurrences of term in the text of post
+	searchIndex map[string]map[string]int
+	// plainReposts[post][user] - id of user's plain repost of post
+	plainReposts map[string]map[string]string
+	// repostedBy[user][post] - followed user whose plain repost brought post to user's feed
+	repostedBy map[string]map[string]string
+	// reactions[post][reaction] - users who left reaction on post, oldest first
+	reactions map[string]map[string][]string
+	users     map[string]User
+	// userIdsByHandle[handle] - id of the user owning handle
+	userIdsByHandle map[string]string
+	// userNames - names of users ordered by name, then by user id
+	userNames []userName
+	// feedEvents delivers posts added to feeds to their connected readers
+	feedEvents feedstream.Publisher
+	// trending counts hashtags of posts as they are added, patched and deleted
+	trending storage.HashtagTracker
 }
 
 func (s *InMemoryStorage) GetSubscriptions(ctx context.Context, userId string) ([]string, error) {
-	panic("implement me")
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return sortedUsers(s.subscriptions[userId]), nil
 }
 
 func (s *InMemoryStorage) GetSubscribers(ctx context.Context, userId string) ([]string, error) {
-	panic("implement me")
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return sortedUsers(s.subscribers[userId]), nil
+}
+
+// GetFanoutOnReadAuthors returns no users, since all posts are added to the feeds on write.
+func (s *InMemoryStorage) GetFanoutOnReadAuthors(ctx context.Context, userId string) ([]string, error) {
+	return nil, nil
 }
 
 func (s *InMemoryStorage) Feed(ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
-	panic("implement me")
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	posts, nextPage, err := s.paginate(s.feeds[*userId], page, size)
+	for _, post := range posts {
+		post.(*Post).RepostedBy = s.repostedBy[*userId][post.GetId()]
+	}
+	return posts, nextPage, err
 }
 
 func (s *InMemoryStorage) Subscribe(ctx context.Context, userId string, subscriber string) error {
-	panic("implement me")
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, found := s.subscriptions[subscriber][userId]; found {
+		return nil
+	}
+	if s.subscriptions[subscriber] == nil {
+		s.subscriptions[subscriber] = make(userSet)
+	}
+	s.subscriptions[subscriber][userId] = struct{}{}
+	if s.subscribers[userId] == nil {
+		s.subscribers[userId] = make(userSet)
+	}
+	s.subscribers[userId][subscriber] = struct{}{}
+	// posts published before the first subscription are read
+	if _, found := s.feedReadMarkers[subscriber]; !found {
+		s.feedReadMarkers[subscriber] = s.lastSeq
+	}
+
+	postIds := make([]string, 0, len(s.postIdsByUser[userId]))
+	var reposts []Post
+	for _, postId := range s.postIdsByUser[userId] {
+		post := s.posts[postId]
+		if storage.IsPlainRepost(&post) {
+			reposts = append(reposts, post)
+			continue
+		}
+		if s.inFeedOf(subscriber, post) {
+			postIds = append(postIds, postId)
+			// the post is not attributed to a repost anymore
+			delete(s.repostedBy[subscriber], postId)
+		}
+	}
+	s.feeds[subscriber] = s.mergeIntoFeed(s.feeds[subscriber], postIds)
+	for _, repost := range reposts {
+		s.addRepostToFeed(subscriber, userId, repost.RepostOfPostId)
+	}
+	s.publishSubscription(ctx, userId, subscriber)
+	return nil
+}
+
+func (s *InMemoryStorage) Unsubscribe(ctx context.Context, userId string, subscriber string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, found := s.subscriptions[subscriber][userId]; !found {
+		return nil
+	}
+	delete(s.subscriptions[subscriber], userId)
+	delete(s.subscribers[userId], subscriber)
+
+	feed := make([]string, 0, len(s.feeds[subscriber]))
+	var removed []string
+	for _, postId := range s.feeds[subscriber] {
+		reposter, reposted := s.repostedBy[subscriber][postId]
+		if (reposted && reposter == userId) || (!reposted && s.posts[postId].AuthorId == userId) {
+			delete(s.repostedBy[subscriber], postId)
+			removed = append(removed, postId)
+			continue
+		}
+		feed = append(feed, postId)
+	}
+	s.feeds[subscriber] = feed
+	// the removed posts may be reposted by other followed authors as well
+	for _, postId := range removed {
+		s.restoreRepost(subscriber, postId)
+	}
+	return nil
 }
 
 func (s *InMemoryStorage) PatchPost(
@@ -69,6 +274,7 @@ func (s *InMemoryStorage) PatchPost(
 	postId string,
 	userId string,
 	text string,
+	ifVersion *int64,
 ) (models.Post, error) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -80,61 +286,176 @@ func (s *InMemoryStorage) PatchPost(
 	if post.AuthorId != userId {
 		return nil, fmt.Errorf("post %s is owned by another user: %w", postId, storage.Forbidden)
 	}
+	if post.RepostOfPostId != "" && (post.Text == "" || text == "") {
+		return nil, fmt.Errorf("post %s cannot switch between plain repost and quote: %w", postId, storage.ClientError)
+	}
+	if ifVersion != nil && *ifVersion != post.version {
+		return nil, fmt.Errorf("post %s has version %d, not %d: %w", postId, post.version, *ifVersion, storage.PreconditionFailed)
+	}
+	s.revisions[postId] = append(s.revisions[postId], Revision{
+		Version:   post.version,
+		Text:      post.Text,
+		CreatedAt: post.LastModifiedAt,
+	})
+	previous := post
+	now := time.Now()
+	post.version++
 	post.Text = text
 	post.AuthorId = userId
-	post.LastModifiedAt = time.Now().UTC().Format(time.RFC3339)
+	post.LastModifiedAt = now.UTC().Format(time.RFC3339)
+	post.Hashtags = storage.ExtractHashtags(text)
+	post.Mentions = s.resolveMentions(text, userId)
+	var addedHashtags []string
+	var removedHashtags []storage.HashtagUse
+	post.hashtagUses, addedHashtags, removedHashtags = storage.UpdateHashtagUses(
+		previous.hashtagUses, previous.Hashtags, post.Hashtags, now)
+	// feeds keep post ids only, so subscribers see the patched post as well
 	s.posts[postId] = post
+	storage.RecordHashtagChanges(ctx, s.trending, postId, addedHashtags, now, removedHashtags)
+	s.reindexPost(s.postIdsByHashtag, postId, previous.Hashtags, post.Hashtags)
+	s.reindexPost(s.postIdsByMention, postId, previous.Mentions, post.Mentions)
+	s.indexText(postId, previous.Text, post.Text)
+	s.publishPostUpdate(ctx, postId)
 	return &post, nil
 }
 
-func (s *InMemoryStorage) GetPostsByUserId(
-	ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
+func (s *InMemoryStorage) DeletePost(ctx context.Context, postId string, userId string) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	postIds, found := s.postIdsByUser[*userId]
-	posts := make([]models.Post, 0)
+	post, found := s.posts[postId]
 	if !found {
-		if page != nil {
-			return nil, nil, fmt.Errorf("provided page for non-existent user", storage.ClientError)
+		return fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	if post.AuthorId != userId {
+		return fmt.Errorf("post %s is owned by another user: %w", postId, storage.Forbidden)
+	}
+	if parent, found := s.posts[post.ReplyToPostId]; found {
+		parent.ReplyCount--
+		s.posts[parent.Id] = parent
+		s.replies[parent.Id] = removePostId(s.replies[parent.Id], postId)
+	}
+	if reposted, found := s.posts[post.RepostOfPostId]; found {
+		if storage.IsPlainRepost(&post) {
+			reposted.RepostCount--
+			delete(s.plainReposts[reposted.Id], userId)
+			for subscriber := range s.subscribers[userId] {
+				s.removeRepostFromFeed(subscriber, userId, reposted.Id)
+			}
+		} else {
+			reposted.QuoteCount--
 		}
-		return posts, nil, nil
+		s.posts[reposted.Id] = reposted
 	}
-	postCount := len(postIds)
-	if page == nil {
-		first := 0
-		if postCount-size > 0 {
-			first = postCount - size
+	for reposter := range s.plainReposts[postId] {
+		for subscriber := range s.subscribers[reposter] {
+			delete(s.repostedBy[subscriber], postId)
+			s.feeds[subscriber] = removePostId(s.feeds[subscriber], postId)
 		}
+	}
+	delete(s.plainReposts, postId)
+	s.reindexPost(s.postIdsByHashtag, postId, post.Hashtags, nil)
+	s.reindexPost(s.postIdsByMention, postId, post.Mentions, nil)
+	s.indexText(postId, post.Text, "")
+	storage.RecordHashtagChanges(ctx, s.trending, postId, nil, time.Time{}, post.hashtagUses)
+	delete(s.posts, postId)
+	delete(s.replies, postId)
+	delete(s.revisions, postId)
+	delete(s.reactions, postId)
+	s.postIdsByUser[userId] = removePostId(s.postIdsByUser[userId], postId)
+	for subscriber := range s.subscribers[userId] {
+		s.feeds[subscriber] = removePostId(s.feeds[subscriber], postId)
+	}
+	s.publishPostUpdate(ctx, post.ReplyToPostId)
+	s.publishPostUpdate(ctx, post.RepostOfPostId)
+	s.publishPostDeleted(ctx, postId)
+	return nil
+}
 
-		for idx := range postIds[first:] {
-			i := postCount - idx - 1
-			post := s.posts[postIds[i]]
-			posts = append(posts, &post)
+func (s *InMemoryStorage) GetRevisions(
+	ctx context.Context, postId string, page *string, size int) ([]models.Revision, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if _, found := s.posts[postId]; !found {
+		return nil, nil, fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	revisions := s.revisions[postId]
+	last := len(revisions) - 1
+	if page != nil {
+		version, err := strconv.ParseInt(*page, 10, 64)
+		if err != nil || version < 0 || version > int64(last) {
+			return nil, nil, fmt.Errorf("invalid revisions page %s: %w", *page, storage.ClientError)
 		}
-		if first == 0 {
-			return posts, nil, nil
+		// revisions[i] has version i
+		last = int(version)
+	}
+	result := make([]models.Revision, 0, size)
+	for i := last; i >= 0; i-- {
+		if len(result) == size {
+			nextPage := strconv.FormatInt(revisions[i].Version, 10)
+			return result, &nextPage, nil
 		}
-		return posts, &postIds[first-1], nil
+		revision := revisions[i]
+		result = append(result, &revision)
 	}
+	return result, nil, nil
+}
 
-	var last *int
-	for i := postCount - 1; i >= 0; i-- {
-		if postIds[i] == *page {
-			last = new(int)
-			*last = i
-			break
+func (s *InMemoryStorage) GetReplies(
+	ctx context.Context, postId string, page *string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if _, found := s.posts[postId]; !found {
+		return nil, nil, fmt.Errorf("post %s not found: %w", postId, storage.NotFoundError)
+	}
+	replyIds := s.replies[postId]
+	first := 0
+	if page != nil {
+		first = indexOf(replyIds, *page)
+		if first < 0 {
+			return nil, nil, fmt.Errorf("invalid replies page %s: %w", *page, storage.ClientError)
 		}
 	}
-	if last == nil {
-		return nil, nil, fmt.Errorf("page not found", storage.ClientError)
+	result := make([]models.Post, 0, size)
+	for _, replyId := range replyIds[first:] {
+		if len(result) == size {
+			nextPage := replyId
+			return result, &nextPage, nil
+		}
+		reply := s.posts[replyId]
+		result = append(result, &reply)
+	}
+	return result, nil, nil
+}
+
+func (s *InMemoryStorage) GetPostsByUserId(
+	ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return s.paginate(s.postIdsByUser[*userId], page, size)
+}
+
+// paginate returns up to size posts from postIds (ordered oldest first) in reverse
+// chronological order, starting from the post with id page, and the next page token.
+// The page post may be deleted meanwhile, the page then starts at its former position.
+func (s *InMemoryStorage) paginate(postIds []string, page *string, size int) ([]models.Post, *string, error) {
+	last := len(postIds) - 1
+	if page != nil {
+		pageSeq, found := s.seqOf(*page)
+		if !found {
+			return nil, nil, fmt.Errorf("page not found: %w", storage.ClientError)
+		}
+		last = s.indexAfter(postIds, pageSeq) - 1
 	}
 	first := 0
-	if *last-size+1 >= 0 {
-		first = *last - size + 1
+	if last-size+1 > 0 {
+		first = last - size + 1
 	}
-	for idx := range postIds[first : *last+1] {
-		i := *last - idx
+	posts := make([]models.Post, 0, last-first+1)
+	for i := last; i >= first; i-- {
 		post := s.posts[postIds[i]]
 		posts = append(posts, &post)
 	}
@@ -142,30 +463,191 @@ func (s *InMemoryStorage) GetPostsByUserId(
 		return posts, nil, nil
 	}
 	return posts, &postIds[first-1], nil
+}
 
+// newPostId returns the id of the post with seq. The seq is kept in the id, like the creation time
+// in the ids of MongoDB, so that tokens pointing at a deleted post keep their position.
+func newPostId(seq int64) string {
+	return fmt.Sprintf("%016x-%s", seq, uuid.New().String())
+}
+
+// seqOf returns the seq of the post, which may be deleted. Must be called with the lock held.
+func (s *InMemoryStorage) seqOf(postId string) (int64, bool) {
+	if post, found := s.posts[postId]; found {
+		return post.seq, true
+	}
+	i := strings.IndexByte(postId, '-')
+	if i < 0 {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(postId[:i], 16, 64)
+	if err != nil || seq <= 0 || seq > s.lastSeq {
+		return 0, false
+	}
+	return seq, true
 }
 
-func (s *InMemoryStorage) AddPost(ctx context.Context, userId, text string) (models.Post, error) {
+// indexAfter returns the index of the first of postIds (ordered oldest first) created after the post with seq.
+// Must be called with the lock held.
+func (s *InMemoryStorage) indexAfter(postIds []string, seq int64) int {
+	return sort.Search(len(postIds), func(i int) bool {
+		return s.posts[postIds[i]].seq > seq
+	})
+}
+
+// reindexPost moves the post between lists of index when the keys of the post change.
+// The post must be stored before the call. Must be called with the write lock held.
+func (s *InMemoryStorage) reindexPost(index map[string][]string, postId string, previous []string, current []string) {
+	kept := make(map[string]bool, len(current))
+	for _, key := range current {
+		kept[key] = true
+	}
+	for _, key := range previous {
+		if kept[key] {
+			delete(kept, key)
+			continue
+		}
+		index[key] = removePostId(index[key], postId)
+		if len(index[key]) == 0 {
+			delete(index, key)
+		}
+	}
+	for key := range kept {
+		// a patched post keeps its place in the list
+		index[key] = s.mergeIntoFeed(index[key], []string{postId})
+	}
+}
+
+// mergeIntoFeed merges postIds into feed keeping it ordered by post creation time.
+// Both slices must be ordered oldest first.
+func (s *InMemoryStorage) mergeIntoFeed(feed []string, postIds []string) []string {
+	merged := make([]string, 0, len(feed)+len(postIds))
+	i, j := 0, 0
+	for i < len(feed) || j < len(postIds) {
+		if j == len(postIds) || (i < len(feed) && s.posts[feed[i]].seq < s.posts[postIds[j]].seq) {
+			merged = append(merged, feed[i])
+			i++
+			continue
+		}
+		if i < len(feed) && feed[i] == postIds[j] {
+			i++
+		}
+		merged = append(merged, postIds[j])
+		j++
+	}
+	return merged
+}
+
+// inFeedOf tells if post belongs to the feed of subscriber: replies are shown only to readers
+// following the author of the replied post. Must be called with the lock held.
+func (s *InMemoryStorage) inFeedOf(subscriber string, post Post) bool {
+	if post.replyToAuthorId == "" || post.replyToAuthorId == subscriber {
+		return true
+	}
+	_, found := s.subscriptions[subscriber][post.replyToAuthorId]
+	return found
+}
+
+func (s *InMemoryStorage) AddPost(ctx context.Context, userId, text string, options storage.PostOptions) (models.Post, error) {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
-	id := uuid.New().String()
-	createdAt := time.Now().UTC().Format(time.RFC3339)
+	if options.ReplyToPostId != nil && options.RepostOfPostId != nil {
+		return nil, fmt.Errorf("post cannot be both a reply and a repost: %w", storage.ClientError)
+	}
+	var parent Post
+	if options.ReplyToPostId != nil {
+		var found bool
+		parent, found = s.posts[*options.ReplyToPostId]
+		if !found {
+			return nil, fmt.Errorf("replied post %s not found: %w", *options.ReplyToPostId, storage.NotFoundError)
+		}
+	}
+	var reposted Post
+	if options.RepostOfPostId != nil {
+		// reposting a plain repost reposts the original post
+		var found bool
+		reposted, found = s.posts[*options.RepostOfPostId]
+		if found && storage.IsPlainRepost(&reposted) {
+			reposted, found = s.posts[reposted.RepostOfPostId]
+		}
+		if !found {
+			return nil, fmt.Errorf("reposted post %s not found: %w", *options.RepostOfPostId, storage.NotFoundError)
+		}
+		if _, found = s.plainReposts[reposted.Id][userId]; found && text == "" {
+			return nil, fmt.Errorf("post %s is already reposted by %s: %w", reposted.Id, userId, storage.Conflict)
+		}
+	}
+
+	s.lastSeq++
+	id := newPostId(s.lastSeq)
+	now := time.Now()
+	createdAt := now.UTC().Format(time.RFC3339)
 	p := Post{
 		Id:             id,
 		AuthorId:       userId,
 		Text:           text,
 		CreatedAt:      createdAt,
 		LastModifiedAt: createdAt,
+		Hashtags:       storage.ExtractHashtags(text),
+		Mentions:       s.resolveMentions(text, userId),
+		seq:            s.lastSeq,
+	}
+	p.hashtagUses, _, _ = storage.UpdateHashtagUses(nil, nil, p.Hashtags, now)
+	if options.ReplyToPostId != nil {
+		p.ReplyToPostId = parent.Id
+		p.RootPostId = parent.RootPostId
+		if p.RootPostId == "" {
+			p.RootPostId = parent.Id
+		}
+		p.replyToAuthorId = parent.AuthorId
+		parent.ReplyCount++
+		s.posts[parent.Id] = parent
+		s.replies[parent.Id] = append(s.replies[parent.Id], p.Id)
+	}
+	if options.RepostOfPostId != nil {
+		p.RepostOfPostId = reposted.Id
+		if text == "" {
+			reposted.RepostCount++
+			if s.plainReposts[reposted.Id] == nil {
+				s.plainReposts[reposted.Id] = make(map[string]string)
+			}
+			s.plainReposts[reposted.Id][userId] = p.Id
+		} else {
+			reposted.QuoteCount++
+		}
+		s.posts[reposted.Id] = reposted
 	}
 	s.posts[p.Id] = p
 	s.postIdsByUser[p.AuthorId] = append(s.postIdsByUser[p.AuthorId], p.Id)
+	s.reindexPost(s.postIdsByHashtag, p.Id, nil, p.Hashtags)
+	s.reindexPost(s.postIdsByMention, p.Id, nil, p.Mentions)
+	s.indexText(p.Id, "", p.Text)
+	var readers []string
+	for subscriber := range s.subscribers[p.AuthorId] {
+		if storage.IsPlainRepost(&p) {
+			if s.addRepostToFeed(subscriber, userId, reposted.Id) {
+				readers = append(readers, subscriber)
+			}
+		} else if s.inFeedOf(subscriber, p) {
+			s.feeds[subscriber] = append(s.feeds[subscriber], p.Id)
+			readers = append(readers, subscriber)
+		}
+	}
+	if options.ReplyToPostId != nil {
+		s.publishPostUpdate(ctx, parent.Id)
+	}
+	if options.RepostOfPostId != nil {
+		s.publishPostUpdate(ctx, reposted.Id)
+	}
+	s.publishNewPost(ctx, p, readers)
+	storage.RecordHashtagChanges(ctx, s.trending, p.Id, p.Hashtags, now, nil)
 	return &p, nil
 }
 
 func (s *InMemoryStorage) GetPost(ctx context.Context, postId string) (models.Post, error) {
-	s.mut.Lock()
-	defer s.mut.Unlock()
+	s.mut.RLock()
+	defer s.mut.RUnlock()
 
 	post, found := s.posts[postId]
 	if !found {
@@ -174,9 +656,83 @@ func (s *InMemoryStorage) GetPost(ctx context.Context, postId string) (models.Po
 	return &post, nil
 }
 
-func CreateInMemoryStorage() storage.Storage {
+// addRepostToFeed adds the post reposted by reposter to the feed of subscriber, unless the feed
+// has it already. Returns whether the post was added. Must be called with the write lock held.
+func (s *InMemoryStorage) addRepostToFeed(subscriber string, reposter string, postId string) bool {
+	post, found := s.posts[postId]
+	if !found || post.AuthorId == subscriber || indexOf(s.feeds[subscriber], postId) >= 0 {
+		return false
+	}
+	s.feeds[subscriber] = s.mergeIntoFeed(s.feeds[subscriber], []string{postId})
+	if s.repostedBy[subscriber] == nil {
+		s.repostedBy[subscriber] = make(map[string]string)
+	}
+	s.repostedBy[subscriber][postId] = reposter
+	return true
+}
+
+// removeRepostFromFeed removes the post from the feed of subscriber if the repost of reposter brought it there
+// and no other followed author reposted it. Must be called with the write lock held.
+func (s *InMemoryStorage) removeRepostFromFeed(subscriber string, reposter string, postId string) {
+	if s.repostedBy[subscriber][postId] != reposter {
+		return
+	}
+	delete(s.repostedBy[subscriber], postId)
+	s.feeds[subscriber] = removePostId(s.feeds[subscriber], postId)
+	s.restoreRepost(subscriber, postId)
+}
+
+// restoreRepost adds the post to the feed of subscriber if a followed author reposted it.
+// Must be called with the write lock held.
+func (s *InMemoryStorage) restoreRepost(subscriber string, postId string) {
+	reposters := make(userSet)
+	for reposter := range s.plainReposts[postId] {
+		if _, found := s.subscriptions[subscriber][reposter]; found && reposter != subscriber {
+			reposters[reposter] = struct{}{}
+		}
+	}
+	if len(reposters) > 0 {
+		s.addRepostToFeed(subscriber, sortedUsers(reposters)[0], postId)
+	}
+}
+
+func removePostId(postIds []string, postId string) []string {
+	for i, id := range postIds {
+		if id == postId {
+			return append(postIds[:i:i], postIds[i+1:]...)
+		}
+	}
+	return postIds
+}
+
+func sortedUsers(users userSet) []string {
+	result := make([]string, 0, len(users))
+	for user := range users {
+		result = append(result, user)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func CreateInMemoryStorage(feedEvents feedstream.Publisher, trending storage.HashtagTracker) storage.Storage {
 	return &InMemoryStorage{
-		posts:         make(map[string]Post),
-		postIdsByUser: make(map[string][]string),
+		feedEvents:       feedEvents,
+		trending:         trending,
+		posts:            make(map[string]Post),
+		postIdsByUser:    make(map[string][]string),
+		subscriptions:    make(map[string]userSet),
+		subscribers:      make(map[string]userSet),
+		feeds:            make(map[string][]string),
+		feedReadMarkers:  make(map[string]int64),
+		revisions:        make(map[string][]Revision),
+		replies:          make(map[string][]string),
+		postIdsByHashtag: make(map[string][]string),
+		postIdsByMention: make(map[string][]string),
+		searchIndex:      make(map[string]map[string]int),
+		plainReposts:     make(map[string]map[string]string),
+		repostedBy:       make(map[string]map[string]string),
+		reactions:        make(map[string]map[string][]string),
+		users:            make(map[string]User),
+		userIdsByHandle:  make(map[string]string),
 	}
 }
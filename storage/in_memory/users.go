@@ -0,0 +1,204 @@
+package in_memory
+
+import (
+	"context"
+	"fmt"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+type User struct {
+	Id          string `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	AvatarUrl   string `json:"avatarUrl,omitempty"`
+	CreatedAt   string `json:"createdAt"`
+}
+
+func (u *User) GetId() string {
+	return u.Id
+}
+
+func (u *User) GetHandle() string {
+	return u.Handle
+}
+
+func (u *User) GetDisplayName() string {
+	return u.DisplayName
+}
+
+func (u *User) GetBio() string {
+	return u.Bio
+}
+
+func (u *User) GetAvatarUrl() string {
+	return u.AvatarUrl
+}
+
+func (u *User) GetCreatedAt() string {
+	return u.CreatedAt
+}
+
+func (u *User) apply(profile storage.UserProfile) {
+	if profile.Handle != nil {
+		u.Handle = *profile.Handle
+	}
+	if profile.DisplayName != nil {
+		u.DisplayName = *profile.DisplayName
+	}
+	if profile.Bio != nil {
+		u.Bio = *profile.Bio
+	}
+	if profile.AvatarUrl != nil {
+		u.AvatarUrl = *profile.AvatarUrl
+	}
+}
+
+func (s *InMemoryStorage) CreateUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, found := s.users[userId]; found {
+		return nil, fmt.Errorf("user %s is already registered: %w", userId, storage.Conflict)
+	}
+	if profile.Handle == nil {
+		return nil, fmt.Errorf("handle is required: %w", storage.ClientError)
+	}
+	if _, found := s.userIdsByHandle[*profile.Handle]; found {
+		return nil, fmt.Errorf("handle %s is taken: %w", *profile.Handle, storage.Conflict)
+	}
+	user := User{
+		Id:        userId,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	user.apply(profile)
+	s.users[userId] = user
+	s.userIdsByHandle[user.Handle] = userId
+	s.indexUserNames(userId, nil, storage.UserSearchNames(user.Handle, user.DisplayName))
+	return &user, nil
+}
+
+func (s *InMemoryStorage) GetUser(ctx context.Context, userId string) (models.User, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	user, found := s.users[userId]
+	if !found {
+		return nil, fmt.Errorf("no user with id %s: %w", userId, storage.NotFoundError)
+	}
+	return &user, nil
+}
+
+func (s *InMemoryStorage) GetUsers(ctx context.Context, userIds []string) ([]models.User, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	users := make([]models.User, 0, len(userIds))
+	for _, userId := range userIds {
+		if user, found := s.users[userId]; found {
+			users = append(users, &user)
+		}
+	}
+	return users, nil
+}
+
+func (s *InMemoryStorage) PatchUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	user, found := s.users[userId]
+	if !found {
+		return nil, fmt.Errorf("no user with id %s: %w", userId, storage.NotFoundError)
+	}
+	if profile.Handle != nil && *profile.Handle != user.Handle {
+		if _, found := s.userIdsByHandle[*profile.Handle]; found {
+			return nil, fmt.Errorf("handle %s is taken: %w", *profile.Handle, storage.Conflict)
+		}
+		delete(s.userIdsByHandle, user.Handle)
+		s.userIdsByHandle[*profile.Handle] = userId
+	}
+	previousNames := storage.UserSearchNames(user.Handle, user.DisplayName)
+	user.apply(profile)
+	s.users[userId] = user
+	s.indexUserNames(userId, previousNames, storage.UserSearchNames(user.Handle, user.DisplayName))
+	return &user, nil
+}
+
+// userName is an entry of the index of users by names, see storage.UserSearchNames
+type userName struct {
+	name   string
+	userId string
+}
+
+func (n userName) less(other userName) bool {
+	return n.name < other.name || (n.name == other.name && n.userId < other.userId)
+}
+
+// indexUserNames replaces previous names of the user with current ones in the index ordered by names.
+// Must be called with the write lock held.
+func (s *InMemoryStorage) indexUserNames(userId string, previous []string, current []string) {
+	for _, name := range previous {
+		entry := userName{name, userId}
+		i := sort.Search(len(s.userNames), func(i int) bool { return !s.userNames[i].less(entry) })
+		if i < len(s.userNames) && s.userNames[i] == entry {
+			s.userNames = append(s.userNames[:i], s.userNames[i+1:]...)
+		}
+	}
+	for _, name := range current {
+		entry := userName{name, userId}
+		i := sort.Search(len(s.userNames), func(i int) bool { return !s.userNames[i].less(entry) })
+		s.userNames = append(s.userNames, userName{})
+		copy(s.userNames[i+1:], s.userNames[i:])
+		s.userNames[i] = entry
+	}
+}
+
+// usersByPrefix returns ids of users having a name starting with prefix.
+// Must be called with the lock held.
+func (s *InMemoryStorage) usersByPrefix(prefix string) map[string]bool {
+	userIds := make(map[string]bool)
+	i := sort.Search(len(s.userNames), func(i int) bool { return s.userNames[i].name >= prefix })
+	for ; i < len(s.userNames) && strings.HasPrefix(s.userNames[i].name, prefix); i++ {
+		userIds[s.userNames[i].userId] = true
+	}
+	return userIds
+}
+
+func (s *InMemoryStorage) SearchUsers(ctx context.Context, prefixes []string, size int) ([]models.User, error) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	var found map[string]bool
+	for _, prefix := range prefixes {
+		matching := s.usersByPrefix(prefix)
+		if found == nil {
+			found = matching
+			continue
+		}
+		for userId := range found {
+			if !matching[userId] {
+				delete(found, userId)
+			}
+		}
+	}
+	users := make([]User, 0, len(found))
+	for userId := range found {
+		users = append(users, s.users[userId])
+	}
+	sort.Slice(users, func(i, j int) bool {
+		followers, otherFollowers := len(s.subscribers[users[i].Id]), len(s.subscribers[users[j].Id])
+		return followers > otherFollowers || (followers == otherFollowers && users[i].Handle < users[j].Handle)
+	})
+	if len(users) > size {
+		users = users[:size]
+	}
+	result := make([]models.User, 0, len(users))
+	for i := range users {
+		result = append(result, &users[i])
+	}
+	return result, nil
+}
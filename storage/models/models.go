@@ -7,4 +7,38 @@ type Post interface {
 	GetCreatedAt() string
 	GetLastModifiedAt() string
 	GetVersion() int64
+	GetLikeCount() int64
+	// GetReactionCounts returns counts of reactions other than likes
+	GetReactionCounts() map[string]int64
+	// GetReplyToPostId returns the id of the replied post, or "" if the post is not a reply
+	GetReplyToPostId() string
+	// GetRootPostId returns the id of the first post of the conversation, or "" if the post is not a reply
+	GetRootPostId() string
+	GetReplyCount() int64
+	// GetRepostOfPostId returns the id of the reposted or quoted post, or "" if the post is not a repost
+	GetRepostOfPostId() string
+	// GetRepostCount returns the number of reposts of the post without text
+	GetRepostCount() int64
+	// GetQuoteCount returns the number of reposts of the post with text
+	GetQuoteCount() int64
+	// GetHashtags returns distinct normalized hashtags of the text, see storage.ExtractHashtags
+	GetHashtags() []string
+	// GetMentions returns ids of users mentioned in the text, see storage.ResolveMentions
+	GetMentions() []string
+}
+
+type User interface {
+	GetId() string
+	GetHandle() string
+	GetDisplayName() string
+	GetBio() string
+	GetAvatarUrl() string
+	GetCreatedAt() string
+}
+
+// Revision is a version of a post before it was edited.
+type Revision interface {
+	GetVersion() int64
+	GetText() string
+	GetCreatedAt() string
 }
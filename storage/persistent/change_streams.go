@@ -0,0 +1,300 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+	"strings"
+	"time"
+)
+
+// FeedSource defines where the worker takes feed updates from.
+type FeedSource string
+
+const (
+	// OutboxFeedSource - tasks written to the outbox are published to the Redis broker.
+	OutboxFeedSource FeedSource = "outbox"
+	// ChangeStreamFeedSource - tasks are derived from the change stream of posts
+	// and are run by the worker itself.
+	ChangeStreamFeedSource FeedSource = "changestream"
+)
+
+const (
+	WATCH_RETRY_PERIOD time.Duration = time.Second
+	// WATCH_MAX_ATTEMPTS is the number of failed runs of the task of a change after which the change is skipped,
+	// the task is stored in the outbox as failed
+	WATCH_MAX_ATTEMPTS int = 10
+)
+
+// changeStreamTasks are derived from change events and are not written to the outbox
+// in ChangeStreamFeedSource mode. Subscriptions are keyed by both users (see SubscriptionKey),
+// so their deletes carry the subscription, and a single watch keeps the tasks of a subscription in order.
+var changeStreamTasks = map[string]bool{
+	"addPost":             true,
+	"patchPost":           true,
+	"updatePostReactions": true,
+	"deletePost":          true,
+	"addSubscription":     true,
+	"removeSubscription":  true,
+}
+
+type ResumeToken struct {
+	Stream string   `bson:"_id"`
+	Token  bson.Raw `bson:"token"`
+}
+
+type postChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		Id primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *Post `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// isReactionCountField tells if field of a post is one of the reaction counters, which updatePostReactions copies to feeds.
+func isReactionCountField(field string) bool {
+	return field == "likeCount" || field == "reactionCounts" || strings.HasPrefix(field, "reactionCounts.")
+}
+
+// reactionsOnly tells if the update changed reaction counters only.
+func (e *postChangeEvent) reactionsOnly() bool {
+	fields := e.UpdateDescription.RemovedFields
+	for field := range e.UpdateDescription.UpdatedFields {
+		fields = append(fields, field)
+	}
+	for _, field := range fields {
+		if !isReactionCountField(field) {
+			return false
+		}
+	}
+	return len(fields) > 0
+}
+
+type subscriptionChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		Id bson.RawValue `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+func subscriptionChangeTask(event subscriptionChangeEvent) *tasks.Signature {
+	var key SubscriptionKey
+	if event.DocumentKey.Id.Type != bsontype.EmbeddedDocument || event.DocumentKey.Id.Unmarshal(&key) != nil {
+		// subscriptions made before they were keyed are removed through the outbox
+		return nil
+	}
+	var task tasks.Signature
+	switch event.OperationType {
+	case "insert":
+		task = createAddSubscriptionTask(key.SubscriptionId, key.UserId)
+	case "delete":
+		task = createRemoveSubscriptionTask(key.SubscriptionId, key.UserId)
+	default:
+		return nil
+	}
+	return &task
+}
+
+func ParseFeedSource(feedSource string) (FeedSource, error) {
+	switch FeedSource(feedSource) {
+	case OutboxFeedSource, ChangeStreamFeedSource:
+		return FeedSource(feedSource), nil
+	}
+	return "", fmt.Errorf("invalid feed source '%s'", feedSource)
+}
+
+func postChangeTask(event postChangeEvent) *tasks.Signature {
+	var task tasks.Signature
+	switch event.OperationType {
+	case "insert":
+		task = createAddPostTask(event.DocumentKey.Id, event.FullDocument.AuthorId)
+	case "update":
+		if event.reactionsOnly() {
+			task = createUpdatePostReactionsTask(event.DocumentKey.Id)
+		} else {
+			task = createPatchPostTask(event.DocumentKey.Id)
+		}
+	case "replace":
+		task = createPatchPostTask(event.DocumentKey.Id)
+	case "delete":
+		task = createDeletePostTask(event.DocumentKey.Id)
+	default:
+		return nil
+	}
+	return &task
+}
+
+func (s *MongoStorageWithBroker) loadResumeToken(ctx context.Context, stream string) (bson.Raw, error) {
+	var token ResumeToken
+	err := s.mongo.resumeTokens.FindOne(ctx, bson.M{"_id": stream}).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load resume token for %s: %s %w", stream, err.Error(), storage.InternalError)
+	}
+	return token.Token, nil
+}
+
+func (s *MongoStorageWithBroker) saveResumeToken(ctx context.Context, stream string, token bson.Raw) error {
+	_, err := s.mongo.resumeTokens.UpdateOne(
+		ctx,
+		bson.M{"_id": stream},
+		bson.M{"$set": bson.M{"token": token}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save resume token for %s: %s %w", stream, err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// watchFailure counts the failed attempts to process the change with the resume token.
+type watchFailure struct {
+	token    string
+	attempts int
+}
+
+// add counts a failed attempt to process the change with token and returns the number of attempts.
+func (f *watchFailure) add(token bson.Raw) int {
+	if f.token != token.String() {
+		f.token = token.String()
+		f.attempts = 0
+	}
+	f.attempts++
+	return f.attempts
+}
+
+// deadLetter stores task of the change that could not be processed in the outbox as failed, so the watch
+// proceeds without it and the task is kept with its error for investigation.
+func (s *MongoStorageWithBroker) deadLetter(ctx context.Context, task tasks.Signature, attempts int, taskErr error) error {
+	entry := newOutboxEntry(task)
+	entry.Status = OutboxFailed
+	entry.Attempts = attempts
+	entry.Error = taskErr.Error()
+	_, err := s.mongo.outbox.InsertOne(ctx, entry)
+	if err != nil {
+		return fmt.Errorf("failed to store failed %s task: %s %w", task.Name, err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// watch runs the task derived from every change of collection and persists the resume token
+// after it, so a restarted watch continues from the first unprocessed change.
+// A change whose task failed with a permanent error or WATCH_MAX_ATTEMPTS times is skipped (see deadLetter),
+// as well as a change no task could be derived from WATCH_MAX_ATTEMPTS times.
+func (s *MongoStorageWithBroker) watch(
+	ctx context.Context,
+	collection *mongo.Collection,
+	toTask func(cursor *mongo.ChangeStream) (*tasks.Signature, error),
+	failure *watchFailure,
+) error {
+	stream := collection.Name()
+	token, err := s.loadResumeToken(ctx, stream)
+	if err != nil {
+		return err
+	}
+	streamOptions := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		streamOptions.SetResumeAfter(token)
+	}
+	cursor, err := collection.Watch(ctx, mongo.Pipeline{}, streamOptions)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %s %w", stream, err.Error(), storage.InternalError)
+	}
+	defer func(cursor *mongo.ChangeStream, ctx context.Context) {
+		err := cursor.Close(ctx)
+		if err != nil {
+			log.Printf("Change stream closing failed: %s", err.Error())
+		}
+	}(cursor, ctx)
+
+	for cursor.Next(ctx) {
+		task, err := toTask(cursor)
+		if err != nil {
+			attempts := failure.add(cursor.ResumeToken())
+			if attempts < WATCH_MAX_ATTEMPTS {
+				return err
+			}
+			// there is no task to keep, the event is logged instead
+			log.Printf("Skipped change of %s after %d attempts: %s, event: %s", stream, attempts, err.Error(), cursor.Current.String())
+		}
+		if task != nil {
+			err = runTask(*task)
+			// post was deleted before its change was processed, the delete event follows
+			if errors.Is(err, storage.NotFoundError) {
+				log.Printf("Skipped %s task for %s: %s", task.Name, stream, err.Error())
+				err = nil
+			}
+			if err != nil {
+				attempts := failure.add(cursor.ResumeToken())
+				permanent := errors.Is(err, invalidTaskError) || errors.Is(err, storage.ClientError)
+				if !permanent && attempts < WATCH_MAX_ATTEMPTS {
+					return fmt.Errorf("failed to run %s task for %s: %w", task.Name, stream, err)
+				}
+				log.Printf("Skipped %s task for %s after %d attempts: %s", task.Name, stream, attempts, err.Error())
+				if err = s.deadLetter(ctx, *task, attempts, err); err != nil {
+					return err
+				}
+			}
+		}
+		if err = s.saveResumeToken(ctx, stream, cursor.ResumeToken()); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *MongoStorageWithBroker) watchUntilDone(
+	ctx context.Context,
+	collection *mongo.Collection,
+	toTask func(cursor *mongo.ChangeStream) (*tasks.Signature, error),
+) {
+	var failure watchFailure
+	for ctx.Err() == nil {
+		err := s.watch(ctx, collection, toTask, &failure)
+		if err != nil {
+			log.Printf("Watching %s failed, restarting: %s", collection.Name(), err.Error())
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(WATCH_RETRY_PERIOD):
+		}
+	}
+}
+
+// CreateChangeStreamWorker updates feeds from the change streams of posts and subscriptions
+// and runs tasks from the outbox in process, without the Redis broker.
+func CreateChangeStreamWorker(ctx context.Context) error {
+	s := GetMongoStorageWithoutBroker()
+
+	go s.watchUntilDone(ctx, s.mongo.posts, func(cursor *mongo.ChangeStream) (*tasks.Signature, error) {
+		var event postChangeEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+		}
+		return postChangeTask(event), nil
+	})
+	go s.watchUntilDone(ctx, s.mongo.subscriptions, func(cursor *mongo.ChangeStream) (*tasks.Signature, error) {
+		var event subscriptionChangeEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+		}
+		return subscriptionChangeTask(event), nil
+	})
+
+	RelayOutbox(ctx, CreateInProcessTaskQueue(IN_PROCESS_WORKERS))
+	return ctx.Err()
+}
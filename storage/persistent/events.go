@@ -0,0 +1,106 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"miniblog/feedstream"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"time"
+)
+
+// SetFeedEvents makes feed tasks publish events of feeds, notifications and posts to feedEvents.
+// Must be called before the storage is used by workers.
+func (s *MongoStorageWithBroker) SetFeedEvents(feedEvents feedstream.Publisher) {
+	s.feedEvents = feedEvents
+}
+
+// publish sends events to the connected readers of their topics unless err is set by building them.
+// Publishing is best effort, since readers fall back to reading the storage.
+func (s *MongoStorageWithBroker) publish(ctx context.Context, events []feedstream.Event, err error) {
+	if err == nil {
+		err = s.feedEvents.Publish(ctx, events)
+	}
+	if err != nil {
+		log.Printf("Failed to publish events: %s", err.Error())
+	}
+}
+
+// publishFeedPost sends the post added to feeds of readers to the connected ones.
+// Replayed tasks do not publish posts already in the feeds.
+func (s *MongoStorageWithBroker) publishFeedPost(ctx context.Context, post *Post, readers []string) {
+	if s.feedEvents == nil || len(readers) == 0 {
+		return
+	}
+	events, err := feedstream.NewFeedEvents(post, readers)
+	s.publish(ctx, events, err)
+}
+
+// publishAuthorPost sends the post merged into feeds on read to the connected readers following its author.
+func (s *MongoStorageWithBroker) publishAuthorPost(ctx context.Context, post *Post) {
+	if s.feedEvents == nil {
+		return
+	}
+	event, err := feedstream.NewAuthorPostEvent(post, post.ReplyToAuthorId)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
+
+type notifiedPost struct {
+	PostId     primitive.ObjectID `bson:"_id"`
+	NotifiedAt time.Time          `bson:"notifiedAt"`
+}
+
+// publishNewPostNotifications notifies the users the new post replies to, reposts or mentions.
+// Only the first task of the post notifies, replayed tasks find the post in notifiedPosts.
+func (s *MongoStorageWithBroker) publishNewPostNotifications(ctx context.Context, post *Post) {
+	if s.feedEvents == nil {
+		return
+	}
+	_, err := s.mongo.notifiedPosts.InsertOne(ctx, notifiedPost{PostId: post.Id, NotifiedAt: time.Now().UTC()})
+	if mongo.IsDuplicateKeyError(err) {
+		log.Printf("Users were notified of post %s before", post.Id.Hex())
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to mark post %s notified, users are not notified: %s", post.Id.Hex(), err.Error())
+		return
+	}
+	repostOfAuthorId := ""
+	if post.RepostOfPostId != "" {
+		reposted, err := s.findPost(ctx, post.RepostOfPostId)
+		if err == nil {
+			repostOfAuthorId = reposted.AuthorId
+		} else if !errors.Is(err, storage.NotFoundError) {
+			log.Printf("Failed to get reposted post to notify its author: %s", err.Error())
+		}
+	}
+	events, err := feedstream.NewPostNotifications(post, post.ReplyToAuthorId, repostOfAuthorId)
+	s.publish(ctx, events, err)
+}
+
+func (s *MongoStorageWithBroker) publishPostUpdate(ctx context.Context, post models.Post) {
+	if s.feedEvents == nil {
+		return
+	}
+	event, err := feedstream.NewPostUpdatedEvent(post)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
+
+func (s *MongoStorageWithBroker) publishPostDeleted(ctx context.Context, postId string) {
+	if s.feedEvents == nil {
+		return
+	}
+	event, err := feedstream.NewPostDeletedEvent(postId)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
+
+func (s *MongoStorageWithBroker) publishSubscription(ctx context.Context, userId string, subscriber string) {
+	if s.feedEvents == nil {
+		return
+	}
+	event, err := feedstream.NewSubscriptionNotification(userId, subscriber)
+	s.publish(ctx, []feedstream.Event{event}, err)
+}
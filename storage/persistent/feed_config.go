@@ -0,0 +1,47 @@
+package persistent
+
+import (
+	"fmt"
+	"miniblog/utils"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_FANOUT_FOLLOWER_THRESHOLD = "10000"
+
+type FeedConfig struct {
+	Source FeedSource
+	// Posts of authors with more subscribers are not fanned out on write,
+	// they are merged into subscribers' feeds on read. Non-positive value disables it.
+	FanoutFollowerThreshold int64
+	// At most MaxItems latest items are kept in a user's feed. Non-positive value disables the limit.
+	MaxItems int64
+	// Feed items of posts older than MaxAge are removed. Non-positive value disables the limit.
+	MaxAge time.Duration
+}
+
+func FeedConfigFromEnv() (FeedConfig, error) {
+	feedSource, err := ParseFeedSource(utils.GetEnvVarWithDefault("FEED_SOURCE", string(OutboxFeedSource)))
+	if err != nil {
+		return FeedConfig{}, err
+	}
+	threshold, err := strconv.ParseInt(
+		utils.GetEnvVarWithDefault("FANOUT_FOLLOWER_THRESHOLD", DEFAULT_FANOUT_FOLLOWER_THRESHOLD), 10, 64)
+	if err != nil {
+		return FeedConfig{}, fmt.Errorf("invalid fan-out follower threshold: %w", err)
+	}
+	maxItems, err := strconv.ParseInt(utils.GetEnvVarWithDefault("FEED_MAX_ITEMS", "0"), 10, 64)
+	if err != nil {
+		return FeedConfig{}, fmt.Errorf("invalid feed max items: %w", err)
+	}
+	maxAge, err := time.ParseDuration(utils.GetEnvVarWithDefault("FEED_MAX_AGE", "0"))
+	if err != nil {
+		return FeedConfig{}, fmt.Errorf("invalid feed max age: %w", err)
+	}
+	return FeedConfig{
+		Source:                  feedSource,
+		FanoutFollowerThreshold: threshold,
+		MaxItems:                maxItems,
+		MaxAge:                  maxAge,
+	}, nil
+}
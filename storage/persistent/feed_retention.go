@@ -0,0 +1,226 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+	"time"
+)
+
+const FEED_TRIM_PERIOD = 10 * time.Minute
+
+// FEED_TRIM_OVERLAP makes a run of the periodic job check the feeds changed shortly before the previous run,
+// since ids of feed items are generated by the clock of MongoDB rather than of the worker
+const FEED_TRIM_OVERLAP = time.Minute
+
+// laterId returns the greater of two object ids.
+func laterId(a, b primitive.ObjectID) primitive.ObjectID {
+	if a.Hex() > b.Hex() {
+		return a
+	}
+	return b
+}
+
+// earlierId returns the smaller of two object ids.
+func earlierId(a, b primitive.ObjectID) primitive.ObjectID {
+	if a.Hex() < b.Hex() {
+		return a
+	}
+	return b
+}
+
+func (s *MongoStorageWithBroker) ageBoundary() primitive.ObjectID {
+	if s.feedConfig.MaxAge <= 0 {
+		return primitive.NilObjectID
+	}
+	return primitive.NewObjectIDFromTimestamp(time.Now().Add(-s.feedConfig.MaxAge))
+}
+
+// feedBoundary returns the id of the newest post that may have been trimmed from user's feed.
+// The feed is complete for greater ids only, older posts are read from the authors' posts.
+// Returns NilObjectID if nothing was trimmed.
+func (s *MongoStorageWithBroker) feedBoundary(ctx context.Context, userId string) (primitive.ObjectID, error) {
+	boundary := s.ageBoundary()
+	if s.feedConfig.MaxItems <= 0 {
+		return boundary, nil
+	}
+	var stats UserStats
+	err := s.mongo.userStats.FindOne(ctx, bson.M{"_id": userId}).Decode(&stats)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return boundary, nil
+	}
+	if err != nil {
+		return boundary, fmt.Errorf("failed to get user stats: %s %w", err.Error(), storage.InternalError)
+	}
+	return s.feedBoundaryOf(&stats), nil
+}
+
+// feedBoundaryOf returns the feed boundary of the user with the stats, see feedBoundary.
+func (s *MongoStorageWithBroker) feedBoundaryOf(stats *UserStats) primitive.ObjectID {
+	boundary := s.ageBoundary()
+	if s.feedConfig.MaxItems <= 0 {
+		return boundary
+	}
+	return laterId(boundary, stats.FeedTrimmedBefore)
+}
+
+// subscriptionsPosts returns up to limit posts of user's subscriptions with ids in the range.
+// It is used for the part of the feed that is trimmed.
+func (s *MongoStorageWithBroker) subscriptionsPosts(ctx context.Context, userId string, ids postIdRange, limit int) ([]Post, error) {
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if len(subscriptions) == 0 {
+		return nil, nil
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: ids.order()}})
+	queryOptions.SetLimit(int64(limit))
+	cursor, err := s.mongo.posts.Find(ctx, subscriptionsPostsFilter(userId, subscriptions, ids), queryOptions)
+	if err != nil {
+		return nil, fmt.Errorf("feed: failed to find posts of subscriptions: %s, %w", err.Error(), storage.InternalError)
+	}
+	var posts []Post
+	if err = cursor.All(ctx, &posts); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	return posts, nil
+}
+
+// subscriptionsPostsFilter matches the posts of subscriptions with ids in the range that user's feed shows.
+func subscriptionsPostsFilter(userId string, subscriptions []string, ids postIdRange) bson.M {
+	return bson.M{
+		"authorId": bson.M{"$in": subscriptions},
+		"_id":      ids.filter(),
+		"$and": bson.A{
+			bson.M{"$or": inFeedOfCondition(userId, subscriptions)},
+			// reposted posts are not shown in the trimmed part of the feed
+			bson.M{"$or": bson.A{
+				bson.M{"repostOfPostId": bson.M{"$exists": false}},
+				bson.M{"text": bson.M{"$exists": true}},
+			}},
+		},
+	}
+}
+
+// trimFeed removes items exceeding the feed length limit from user's feed.
+func (s *MongoStorageWithBroker) trimFeed(ctx context.Context, userId string) (int, error) {
+	if s.feedConfig.MaxItems <= 0 {
+		return 0, nil
+	}
+	var newestTrimmed FeedItem
+	err := s.mongo.feed.FindOne(
+		ctx,
+		bson.M{"userId": userId},
+		options.FindOne().SetSort(bson.D{{Key: "postId", Value: -1}}).SetSkip(s.feedConfig.MaxItems),
+	).Decode(&newestTrimmed)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("trim feed: failed to find feed item: %s %w", err.Error(), storage.InternalError)
+	}
+
+	// the boundary is moved before deleting, so readers never see a gap in the feed
+	_, err = s.mongo.userStats.UpdateOne(
+		ctx,
+		bson.M{"_id": userId},
+		bson.M{"$max": bson.M{"feedTrimmedBefore": newestTrimmed.PostId}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("trim feed: failed to update boundary: %s %w", err.Error(), storage.InternalError)
+	}
+	deleteResult, err := s.mongo.feed.DeleteMany(ctx, bson.M{
+		"userId": userId,
+		"postId": bson.M{"$lte": newestTrimmed.PostId},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("trim feed: failed to delete feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	return int(deleteResult.DeletedCount), nil
+}
+
+// trimFeedsOf enforces the length limit on feeds of users, e.g. of the readers a fan-out added items to.
+func (s *MongoStorageWithBroker) trimFeedsOf(ctx context.Context, userIds []string) (int, error) {
+	trimmed := 0
+	for _, userId := range userIds {
+		deleted, err := s.trimFeed(ctx, userId)
+		if err != nil {
+			return trimmed, err
+		}
+		trimmed += deleted
+	}
+	return trimmed, nil
+}
+
+// trimExpiredFeedItems removes feed items of posts older than the feed age limit.
+func (s *MongoStorageWithBroker) trimExpiredFeedItems(ctx context.Context) (int, error) {
+	boundary := s.ageBoundary()
+	if boundary.IsZero() {
+		return 0, nil
+	}
+	deleteResult, err := s.mongo.feed.DeleteMany(ctx, bson.M{"postId": bson.M{"$lte": boundary}})
+	if err != nil {
+		return 0, fmt.Errorf("trim feed: failed to delete expired feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	return int(deleteResult.DeletedCount), nil
+}
+
+// trimFeeds enforces the retention policy on the feeds with items added after since.
+// Feed items get ids when they are inserted, so the feeds are found by the _id index instead of scanning all feeds.
+func (s *MongoStorageWithBroker) trimFeeds(ctx context.Context, since primitive.ObjectID) (int, error) {
+	trimmed, err := s.trimExpiredFeedItems(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if s.feedConfig.MaxItems <= 0 {
+		return trimmed, nil
+	}
+
+	changed, err := s.mongo.feed.Distinct(ctx, "userId", bson.M{"_id": bson.M{"$gt": since}})
+	if err != nil {
+		return trimmed, fmt.Errorf("trim feed: failed to find changed feeds: %s %w", err.Error(), storage.InternalError)
+	}
+	userIds := make([]string, 0, len(changed))
+	for _, userId := range changed {
+		if id, ok := userId.(string); ok {
+			userIds = append(userIds, id)
+		}
+	}
+	deleted, err := s.trimFeedsOf(ctx, userIds)
+	return trimmed + deleted, err
+}
+
+// TrimFeeds periodically enforces the retention policy until ctx is done. Fan-out trims the feeds
+// it adds items to, so the length limit is checked only on the feeds changed since the previous run.
+func TrimFeeds(ctx context.Context) {
+	mongo := GetMongoStorageWithoutBroker()
+	if mongo.feedConfig.MaxItems <= 0 && mongo.feedConfig.MaxAge <= 0 {
+		return
+	}
+	since := time.Now().Add(-FEED_TRIM_PERIOD)
+	for {
+		started := time.Now()
+		trimmed, err := mongo.trimFeeds(ctx, primitive.NewObjectIDFromTimestamp(since.Add(-FEED_TRIM_OVERLAP)))
+		if err != nil {
+			log.Printf("Failed to trim feeds: %s", err.Error())
+		} else {
+			log.Printf("Trimmed %d feed items", trimmed)
+			since = started
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(FEED_TRIM_PERIOD):
+		}
+	}
+}
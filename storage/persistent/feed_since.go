@@ -0,0 +1,152 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+var maxObjectId = primitive.ObjectID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (s *MongoStorageWithBroker) FeedSince(ctx context.Context, userId string, since string, size int) ([]models.Post, *string, error) {
+	sinceMongoId, err := primitive.ObjectIDFromHex(since)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert provided since to Mongo object id: %s, %w", err.Error(), storage.ClientError)
+	}
+	merged, err := s.feedPostsAfter(ctx, userId, sinceMongoId, size+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	posts := make([]models.Post, 0, size)
+	for i := range merged {
+		if len(posts) == size {
+			nextSince := merged[i-1].Id.Hex()
+			return posts, &nextSince, nil
+		}
+		posts = append(posts, &merged[i])
+	}
+	return posts, nil, nil
+}
+
+// feedPostsAfter returns up to limit posts of user's feed with ids greater than after, oldest first.
+func (s *MongoStorageWithBroker) feedPostsAfter(ctx context.Context, userId string, after primitive.ObjectID, limit int) ([]Post, error) {
+	boundary, err := s.feedBoundary(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	if after.Hex() < boundary.Hex() {
+		// the oldest of the posts are trimmed from the feed, they are read from the authors' posts
+		posts, err = s.subscriptionsPosts(ctx, userId, postIdRange{after: after, until: boundary, ascending: true}, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(posts) < limit {
+		feedPosts, err := s.feedRangePosts(
+			ctx, userId, postIdRange{after: laterId(after, boundary), until: maxObjectId, ascending: true}, limit-len(posts))
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, feedPosts...)
+	}
+	return posts, nil
+}
+
+func (s *MongoStorageWithBroker) SetFeedReadMarker(ctx context.Context, userId string, postId string) error {
+	post, err := s.findPost(ctx, postId)
+	if err != nil {
+		return err
+	}
+	// the marker only moves forward, so a client with a stale view of the feed does not unread newer posts
+	_, err = s.mongo.userStats.UpdateOne(
+		ctx,
+		bson.M{"_id": userId},
+		bson.M{"$max": bson.M{"feedReadMarker": post.Id}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update feed read marker: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// startFeedReadMarker sets the feed read marker of a user who has none to now,
+// so that the posts published before are read and the unread count does not scan the whole history.
+func (s *MongoStorageWithBroker) startFeedReadMarker(ctx context.Context, userId string) error {
+	_, err := s.mongo.userStats.UpdateOne(
+		ctx,
+		bson.M{"_id": userId},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"feedReadMarker": bson.M{"$ifNull": bson.A{"$feedReadMarker", primitive.NewObjectID()}},
+		}}}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to start feed read marker: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// GetFeedUnreadCount counts posts of the feed, of the authors merged into it on read and of its trimmed part
+// that are newer than the read marker, up to MAX_FEED_UNREAD_COUNT.
+func (s *MongoStorageWithBroker) GetFeedUnreadCount(ctx context.Context, userId string) (int, error) {
+	var stats UserStats
+	err := s.mongo.userStats.FindOne(ctx, bson.M{"_id": userId}).Decode(&stats)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, fmt.Errorf("failed to get user stats: %s %w", err.Error(), storage.InternalError)
+	}
+	if stats.FeedReadMarker.IsZero() {
+		// users subscribed before the marker was started on subscription read their feed from now on
+		return 0, s.startFeedReadMarker(ctx, userId)
+	}
+
+	boundary := s.feedBoundaryOf(&stats)
+	feedIds := postIdRange{after: laterId(stats.FeedReadMarker, boundary), until: maxObjectId}
+	unread, err := s.mongo.feed.CountDocuments(
+		ctx,
+		bson.M{"userId": userId, "postId": feedIds.filter()},
+		options.Count().SetLimit(storage.MAX_FEED_UNREAD_COUNT),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unread feed posts: %s %w", err.Error(), storage.InternalError)
+	}
+	if unread >= storage.MAX_FEED_UNREAD_COUNT {
+		return storage.MAX_FEED_UNREAD_COUNT, nil
+	}
+
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	authorIds, err := s.fanoutOnReadAuthors(ctx, subscriptions)
+	if err != nil {
+		return 0, err
+	}
+	filters := make([]bson.M, 0, 2)
+	if len(authorIds) > 0 {
+		filters = append(filters, fanoutOnReadPostsFilter(userId, subscriptions, authorIds, feedIds))
+	}
+	if len(subscriptions) > 0 && stats.FeedReadMarker.Hex() < boundary.Hex() {
+		trimmedIds := postIdRange{after: stats.FeedReadMarker, until: boundary}
+		filters = append(filters, subscriptionsPostsFilter(userId, subscriptions, trimmedIds))
+	}
+	for _, filter := range filters {
+		count, err := s.mongo.posts.CountDocuments(
+			ctx, filter, options.Count().SetLimit(storage.MAX_FEED_UNREAD_COUNT-unread))
+		if err != nil {
+			return 0, fmt.Errorf("failed to count unread feed posts: %s %w", err.Error(), storage.InternalError)
+		}
+		unread += count
+		if unread >= storage.MAX_FEED_UNREAD_COUNT {
+			break
+		}
+	}
+	return int(unread), nil
+}
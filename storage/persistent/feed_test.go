@@ -0,0 +1,695 @@
+package persistent
+
+import (
+	"context"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miniblog/feedstream"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"os"
+	"testing"
+	"time"
+)
+
+func createTestStorage(t *testing.T) *MongoStorageWithBroker {
+	mongoUrl, found := os.LookupEnv("MONGO_URL")
+	if !found {
+		t.Skip("'MONGO_URL' not specified")
+	}
+	// tasks use the same storage as tests
+	onceStorage.Do(func() {
+		mongoStorageWithoutBroker = CreateMongoStorageWithBroker(mongoUrl, "miniblog_test", FeedConfig{Source: OutboxFeedSource})
+	})
+	return GetMongoStorageWithoutBroker()
+}
+
+func createTestPost(t *testing.T, s *MongoStorageWithBroker, authorId string) models.Post {
+	post := Post{AuthorId: authorId, Text: "text"}
+	id, err := s.mongo.posts.InsertOne(context.Background(), post)
+	require.NoError(t, err)
+	post.Id = id.InsertedID.(primitive.ObjectID)
+	return &post
+}
+
+func countFeedItems(t *testing.T, s *MongoStorageWithBroker, filter bson.M) int64 {
+	count, err := s.mongo.feed.CountDocuments(context.Background(), filter)
+	require.NoError(t, err)
+	return count
+}
+
+func TestReplayedNewPostTaskDoesNotDuplicateFeedItems(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscribers := []string{primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()}
+	post := createTestPost(t, s, author)
+
+	for i := 0; i < 3; i++ {
+		added, err := s.UpdateFeedNewPost(ctx, post.GetId(), subscribers)
+		require.NoError(t, err)
+		require.Equal(t, len(subscribers), added)
+	}
+
+	for _, subscriber := range subscribers {
+		require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": subscriber}))
+	}
+}
+
+func TestDuplicateFeedItemsAreRemovedBeforeUniqueIndex(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	feed := s.mongo.feed.Database().Collection("feed_duplicates_test")
+	require.NoError(t, feed.Drop(ctx))
+	defer feed.Drop(ctx)
+
+	userId := primitive.NewObjectID().Hex()
+	postId := primitive.NewObjectID()
+	for i := 0; i < 3; i++ {
+		_, err := feed.InsertOne(ctx, FeedItem{UserId: userId, PostId: postId})
+		require.NoError(t, err)
+	}
+	_, err := feed.InsertOne(ctx, FeedItem{UserId: userId, PostId: primitive.NewObjectID()})
+	require.NoError(t, err)
+
+	ensureFeedItemKeyIndex(ctx, feed)
+	count, err := feed.CountDocuments(ctx, bson.M{"userId": userId})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, count)
+	_, err = feed.InsertOne(ctx, FeedItem{UserId: userId, PostId: postId})
+	require.Error(t, err)
+}
+
+func TestReplayedNewSubscriptionTaskDoesNotDuplicateFeedItems(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	posts := []models.Post{createTestPost(t, s, author), createTestPost(t, s, author)}
+
+	require.NoError(t, s.UpdateFeedNewSubscription(ctx, subscriber, posts))
+	// a new post is fanned out before the subscription task is retried
+	_, err := s.UpdateFeedNewPost(ctx, posts[1].GetId(), []string{subscriber})
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateFeedNewSubscription(ctx, subscriber, posts))
+
+	require.EqualValues(t, len(posts), countFeedItems(t, s, bson.M{"userId": subscriber}))
+}
+
+func TestDeletePostTaskAcceptsLegacyArgs(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	post := createTestPost(t, s, author)
+	_, err := s.UpdateFeedNewPost(ctx, post.GetId(), []string{subscriber})
+	require.NoError(t, err)
+
+	// tasks queued by earlier versions pass the author id as well
+	task := createDeletePostTask(post.(*Post).Id)
+	task.Args = append(task.Args, tasks.Arg{Type: "string", Value: author})
+	require.NoError(t, runTask(task))
+	require.EqualValues(t, 0, countFeedItems(t, s, bson.M{"userId": subscriber}))
+}
+
+func TestOutboxTasksUpdateFeed(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	queue := CreateInProcessTaskQueue(IN_PROCESS_WORKERS)
+	drain := func() {
+		for {
+			relayed, err := s.relayOutboxBatch(ctx, queue)
+			require.NoError(t, err)
+			if relayed == 0 {
+				return
+			}
+		}
+	}
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	old, err := s.AddPost(ctx, author, "before subscription", storage.PostOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.Subscribe(ctx, author, subscriber))
+	drain()
+
+	post, err := s.AddPost(ctx, author, "after subscription", storage.PostOptions{})
+	require.NoError(t, err)
+	_, err = s.PatchPost(ctx, post.GetId(), author, "patched", nil)
+	require.NoError(t, err)
+	drain()
+
+	feed, _, err := s.Feed(ctx, &subscriber, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, feed, 2)
+	require.Equal(t, post.GetId(), feed[0].GetId())
+	require.Equal(t, "patched", feed[0].GetText())
+	require.Equal(t, old.GetId(), feed[1].GetId())
+
+	require.NoError(t, s.DeletePost(ctx, post.GetId(), author))
+	require.NoError(t, s.Unsubscribe(ctx, author, subscriber))
+	drain()
+	require.EqualValues(t, 0, countFeedItems(t, s, bson.M{"userId": subscriber}))
+}
+
+func TestOutboxMarksInvalidTasksFailed(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	queue := CreateInProcessTaskQueue(IN_PROCESS_WORKERS)
+
+	// the post was deleted before the task was relayed
+	deleted := newOutboxEntry(createAddPostTask(primitive.NewObjectID(), primitive.NewObjectID().Hex()))
+	invalid := newOutboxEntry(tasks.Signature{Name: "unknownTask"})
+	ids := make([]interface{}, 0, 2)
+	for _, entry := range []OutboxEntry{deleted, invalid} {
+		result, err := s.mongo.outbox.InsertOne(ctx, entry)
+		require.NoError(t, err)
+		ids = append(ids, result.InsertedID)
+	}
+	for {
+		relayed, err := s.relayOutboxBatch(ctx, queue)
+		require.NoError(t, err)
+		if relayed == 0 {
+			break
+		}
+	}
+
+	for i, status := range []string{OutboxDone, OutboxFailed} {
+		var entry OutboxEntry
+		require.NoError(t, s.mongo.outbox.FindOne(ctx, bson.M{"_id": ids[i]}).Decode(&entry))
+		require.Equal(t, status, entry.Status)
+	}
+}
+
+func TestFeedMergesPostsOfHighFollowerAuthors(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	s.feedConfig.FanoutFollowerThreshold = 1
+	defer func() { s.feedConfig.FanoutFollowerThreshold = 0 }()
+	queue := CreateInProcessTaskQueue(IN_PROCESS_WORKERS)
+	drain := func() {
+		for {
+			relayed, err := s.relayOutboxBatch(ctx, queue)
+			require.NoError(t, err)
+			if relayed == 0 {
+				return
+			}
+		}
+	}
+
+	celebrity := primitive.NewObjectID().Hex()
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	require.NoError(t, s.Subscribe(ctx, celebrity, subscriber))
+	require.NoError(t, s.Subscribe(ctx, celebrity, primitive.NewObjectID().Hex()))
+	require.NoError(t, s.Subscribe(ctx, author, subscriber))
+	drain()
+
+	var expected []string
+	for i := 0; i < 3; i++ {
+		for _, userId := range []string{celebrity, author} {
+			post, err := s.AddPost(ctx, userId, "text", storage.PostOptions{})
+			require.NoError(t, err)
+			expected = append([]string{post.GetId()}, expected...)
+		}
+	}
+	drain()
+	require.EqualValues(t, 0, countFeedItems(t, s, bson.M{"userId": subscriber, "authorId": celebrity}))
+	require.EqualValues(t, 3, countFeedItems(t, s, bson.M{"userId": subscriber, "authorId": author}))
+
+	var actual []string
+	var page *string
+	for {
+		feed, nextPage, err := s.Feed(ctx, &subscriber, page, 4)
+		require.NoError(t, err)
+		for _, post := range feed {
+			actual = append(actual, post.GetId())
+		}
+		if nextPage == nil {
+			break
+		}
+		page = nextPage
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestFeedReadsTrimmedPostsFromAuthors(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	s.feedConfig.MaxItems = 2
+	defer func() { s.feedConfig.MaxItems = 0 }()
+
+	authors := []string{primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()}
+	subscriber := primitive.NewObjectID().Hex()
+	var expected []string
+	for i := 0; i < 3; i++ {
+		for _, author := range authors {
+			post := createTestPost(t, s, author)
+			_, err := s.UpdateFeedNewPost(ctx, post.GetId(), []string{subscriber})
+			require.NoError(t, err)
+			expected = append([]string{post.GetId()}, expected...)
+		}
+	}
+	for _, author := range authors {
+		_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{UserId: subscriber, SubscriptionId: author})
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 2, countFeedItems(t, s, bson.M{"userId": subscriber}))
+
+	var actual []string
+	var page *string
+	for {
+		feed, nextPage, err := s.Feed(ctx, &subscriber, page, 4)
+		require.NoError(t, err)
+		for _, post := range feed {
+			actual = append(actual, post.GetId())
+		}
+		if nextPage == nil {
+			break
+		}
+		page = nextPage
+	}
+	require.Equal(t, expected, actual)
+}
+
+func TestTrimFeedsChecksChangedFeedsOnly(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	s.feedConfig.MaxItems = 2
+	defer func() { s.feedConfig.MaxItems = 0 }()
+
+	unchanged := primitive.NewObjectID().Hex()
+	changed := primitive.NewObjectID().Hex()
+	hourAgo := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		_, err := s.mongo.feed.InsertMany(ctx, []interface{}{
+			FeedItem{Id: primitive.NewObjectIDFromTimestamp(hourAgo), UserId: unchanged, PostId: primitive.NewObjectID()},
+			FeedItem{Id: primitive.NewObjectID(), UserId: changed, PostId: primitive.NewObjectID()},
+		})
+		require.NoError(t, err)
+	}
+
+	trimmed, err := s.trimFeeds(ctx, primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Minute)))
+	require.NoError(t, err)
+	require.Equal(t, 1, trimmed)
+	require.EqualValues(t, 2, countFeedItems(t, s, bson.M{"userId": changed}))
+	require.EqualValues(t, 3, countFeedItems(t, s, bson.M{"userId": unchanged}))
+}
+
+func TestFeedSinceReadsTrimmedAndFeedPostsOldestFirst(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	s.feedConfig.MaxItems = 2
+	defer func() { s.feedConfig.MaxItems = 0 }()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	var postIds []string
+	for i := 0; i < 5; i++ {
+		post := createTestPost(t, s, author)
+		_, err := s.UpdateFeedNewPost(ctx, post.GetId(), []string{subscriber})
+		require.NoError(t, err)
+		postIds = append(postIds, post.GetId())
+	}
+	_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{UserId: subscriber, SubscriptionId: author})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, countFeedItems(t, s, bson.M{"userId": subscriber}))
+
+	var actual []string
+	since := postIds[0]
+	for {
+		feed, nextSince, err := s.FeedSince(ctx, subscriber, since, 3)
+		require.NoError(t, err)
+		for _, post := range feed {
+			actual = append(actual, post.GetId())
+		}
+		if nextSince == nil {
+			break
+		}
+		since = *nextSince
+	}
+	require.Equal(t, postIds[1:], actual)
+
+	// the subscription was inserted directly, so the first count starts the read marker
+	count, err := s.GetFeedUnreadCount(ctx, subscriber)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	firstPostId, err := primitive.ObjectIDFromHex(postIds[0])
+	require.NoError(t, err)
+	_, err = s.mongo.userStats.UpdateOne(ctx, bson.M{"_id": subscriber}, bson.M{"$set": bson.M{"feedReadMarker": firstPostId}})
+	require.NoError(t, err)
+	count, err = s.GetFeedUnreadCount(ctx, subscriber)
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+	require.NoError(t, s.SetFeedReadMarker(ctx, subscriber, postIds[3]))
+	require.NoError(t, s.SetFeedReadMarker(ctx, subscriber, postIds[1]))
+	count, err = s.GetFeedUnreadCount(ctx, subscriber)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSubscribeStartsFeedReadMarker(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	before := createTestPost(t, s, author)
+	_, err := s.UpdateFeedNewPost(ctx, before.GetId(), []string{subscriber})
+	require.NoError(t, err)
+	require.NoError(t, s.Subscribe(ctx, author, subscriber))
+	after := createTestPost(t, s, author)
+	_, err = s.UpdateFeedNewPost(ctx, after.GetId(), []string{subscriber})
+	require.NoError(t, err)
+
+	count, err := s.GetFeedUnreadCount(ctx, subscriber)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestRebuildFeedRestoresFeedItems(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{UserId: subscriber, SubscriptionId: author})
+	require.NoError(t, err)
+	lost := createTestPost(t, s, author)
+	kept := createTestPost(t, s, author)
+	_, err = s.UpdateFeedNewPost(ctx, kept.GetId(), []string{subscriber})
+	require.NoError(t, err)
+	stranger := createTestPost(t, s, primitive.NewObjectID().Hex())
+	_, err = s.UpdateFeedNewPost(ctx, stranger.GetId(), []string{subscriber})
+	require.NoError(t, err)
+
+	diff, err := s.rebuildFeed(ctx, subscriber, true)
+	require.NoError(t, err)
+	require.Len(t, diff.Missing, 1)
+	require.Equal(t, lost.GetId(), diff.Missing[0].Hex())
+	require.Len(t, diff.Extra, 1)
+	require.Equal(t, stranger.GetId(), diff.Extra[0].Hex())
+	require.EqualValues(t, 2, countFeedItems(t, s, bson.M{"userId": subscriber}))
+
+	_, err = s.rebuildFeed(ctx, subscriber, false)
+	require.NoError(t, err)
+	diff, err = s.rebuildFeed(ctx, subscriber, true)
+	require.NoError(t, err)
+	require.True(t, diff.Empty())
+	require.EqualValues(t, 2, countFeedItems(t, s, bson.M{"userId": subscriber, "authorId": author}))
+}
+
+func TestReactionCountsAreCopiedToFeedItems(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	queue := CreateInProcessTaskQueue(IN_PROCESS_WORKERS)
+	drain := func() {
+		for {
+			relayed, err := s.relayOutboxBatch(ctx, queue)
+			require.NoError(t, err)
+			if relayed == 0 {
+				return
+			}
+		}
+	}
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	post := createTestPost(t, s, author)
+	_, err := s.UpdateFeedNewPost(ctx, post.GetId(), []string{subscriber})
+	require.NoError(t, err)
+
+	for _, userId := range []string{subscriber, author, subscriber} {
+		require.NoError(t, s.AddReaction(ctx, post.GetId(), userId, storage.Like))
+	}
+	require.NoError(t, s.AddReaction(ctx, post.GetId(), author, "wow"))
+	require.NoError(t, s.AddReaction(ctx, post.GetId(), author, "sad"))
+	require.NoError(t, s.RemoveReaction(ctx, post.GetId(), author, "sad"))
+	drain()
+
+	feed, _, err := s.Feed(ctx, &subscriber, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, feed, 1)
+	require.EqualValues(t, 2, feed[0].GetLikeCount())
+	require.Equal(t, map[string]int64{"wow": 1}, feed[0].GetReactionCounts())
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": subscriber, "likeCount": 2, "reactionCounts.wow": 1}))
+
+	userIds, _, err := s.GetReactions(ctx, post.GetId(), storage.Like, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{author, subscriber}, userIds)
+}
+
+func TestReactionChangeEventsUpdateFeedReactionsOnly(t *testing.T) {
+	event := postChangeEvent{OperationType: "update"}
+	event.UpdateDescription.UpdatedFields = bson.M{"likeCount": 3, "reactionCounts.wow": 1}
+	require.Equal(t, "updatePostReactions", postChangeTask(event).Name)
+
+	event.UpdateDescription.UpdatedFields = nil
+	event.UpdateDescription.RemovedFields = []string{"reactionCounts.sad"}
+	require.Equal(t, "updatePostReactions", postChangeTask(event).Name)
+
+	event.UpdateDescription.UpdatedFields = bson.M{"likeCount": 3, "text": "patched"}
+	require.Equal(t, "patchPost", postChangeTask(event).Name)
+}
+
+func TestSubscriptionDeleteEventsCarryBothUsers(t *testing.T) {
+	decode := func(id interface{}) subscriptionChangeEvent {
+		raw, err := bson.Marshal(bson.M{"operationType": "delete", "documentKey": bson.M{"_id": id}})
+		require.NoError(t, err)
+		var event subscriptionChangeEvent
+		require.NoError(t, bson.Unmarshal(raw, &event))
+		return event
+	}
+
+	task := subscriptionChangeTask(decode(SubscriptionKey{UserId: "subscriber", SubscriptionId: "author"}))
+	require.Equal(t, createRemoveSubscriptionTask("author", "subscriber"), *task)
+	// subscriptions made before they were keyed are removed through the outbox
+	require.Nil(t, subscriptionChangeTask(decode(primitive.NewObjectID())))
+}
+
+func TestWatchFailureCountsAttemptsOfOneChange(t *testing.T) {
+	var failure watchFailure
+	first, err := bson.Marshal(bson.M{"_data": "1"})
+	require.NoError(t, err)
+	second, err := bson.Marshal(bson.M{"_data": "2"})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, failure.add(first))
+	require.Equal(t, 2, failure.add(first))
+	require.Equal(t, 1, failure.add(second))
+}
+
+func TestRepliesAreCopiedToFeedsOfRepliedAuthorFollowers(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	replier := primitive.NewObjectID().Hex()
+	follower := primitive.NewObjectID().Hex()
+	stranger := primitive.NewObjectID().Hex()
+	for _, subscription := range []Subscription{
+		{UserId: follower, SubscriptionId: author},
+		{UserId: follower, SubscriptionId: replier},
+		{UserId: stranger, SubscriptionId: replier},
+	} {
+		_, err := s.mongo.subscriptions.InsertOne(ctx, subscription)
+		require.NoError(t, err)
+	}
+
+	root, err := s.AddPost(ctx, author, "root", storage.PostOptions{})
+	require.NoError(t, err)
+	rootId := root.GetId()
+	reply, err := s.AddPost(ctx, replier, "reply", storage.PostOptions{ReplyToPostId: &rootId})
+	require.NoError(t, err)
+	require.Equal(t, rootId, reply.GetRootPostId())
+
+	_, err = s.UpdateFeedNewPost(ctx, reply.GetId(), []string{follower, stranger})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": follower}))
+	require.EqualValues(t, 0, countFeedItems(t, s, bson.M{"userId": stranger}))
+
+	replies, _, err := s.GetReplies(ctx, rootId, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	require.Equal(t, reply.GetId(), replies[0].GetId())
+	root, err = s.GetPost(ctx, rootId)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, root.GetReplyCount())
+
+	require.NoError(t, s.DeletePost(ctx, reply.GetId(), replier))
+	root, err = s.GetPost(ctx, rootId)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, root.GetReplyCount())
+}
+
+func TestPlainRepostsAreDeduplicatedInFeeds(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	first := primitive.NewObjectID().Hex()
+	second := primitive.NewObjectID().Hex()
+	follower := primitive.NewObjectID().Hex()
+	for _, subscription := range []Subscription{
+		{UserId: follower, SubscriptionId: first},
+		{UserId: follower, SubscriptionId: second},
+	} {
+		_, err := s.mongo.subscriptions.InsertOne(ctx, subscription)
+		require.NoError(t, err)
+	}
+
+	original, err := s.AddPost(ctx, author, "original", storage.PostOptions{})
+	require.NoError(t, err)
+	originalId := original.GetId()
+	firstRepost, err := s.AddPost(ctx, first, "", storage.PostOptions{RepostOfPostId: &originalId})
+	require.NoError(t, err)
+	_, err = s.AddPost(ctx, first, "", storage.PostOptions{RepostOfPostId: &originalId})
+	require.ErrorIs(t, err, storage.Conflict)
+	secondRepost, err := s.AddPost(ctx, second, "", storage.PostOptions{RepostOfPostId: &originalId})
+	require.NoError(t, err)
+
+	_, err = s.UpdateFeedNewPost(ctx, firstRepost.GetId(), []string{follower})
+	require.NoError(t, err)
+	_, err = s.UpdateFeedNewPost(ctx, secondRepost.GetId(), []string{follower})
+	require.NoError(t, err)
+	postObjId, _ := primitive.ObjectIDFromHex(originalId)
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": follower}))
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": follower, "postId": postObjId, "repostedBy": first}))
+
+	original, err = s.GetPost(ctx, originalId)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, original.GetRepostCount())
+
+	// the second repost keeps the post in the feed
+	_, err = s.UpdateFeedDeleteRepost(ctx, originalId, first)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": follower, "postId": postObjId, "repostedBy": second}))
+	_, err = s.UpdateFeedDeleteRepost(ctx, originalId, second)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, countFeedItems(t, s, bson.M{"userId": follower}))
+}
+
+func TestUnsubscribeKeepsPostsRepostedByFollowedAuthors(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	reposter := primitive.NewObjectID().Hex()
+	follower := primitive.NewObjectID().Hex()
+	_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{UserId: follower, SubscriptionId: reposter})
+	require.NoError(t, err)
+
+	post := createTestPost(t, s, author)
+	postId := post.GetId()
+	_, err = s.UpdateFeedNewPost(ctx, postId, []string{follower})
+	require.NoError(t, err)
+	_, err = s.AddPost(ctx, reposter, "", storage.PostOptions{RepostOfPostId: &postId})
+	require.NoError(t, err)
+
+	// the follower no longer follows the author, but still follows the reposter
+	_, err = s.UpdateFeedRemoveSubscription(ctx, follower, author)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, countFeedItems(t, s, bson.M{"userId": follower, "postId": post.(*Post).Id, "repostedBy": reposter}))
+}
+
+func TestReplayedNewPostTaskPublishesPostOnce(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	feedEvents := feedstream.CreateInMemoryBroadcaster()
+	s.SetFeedEvents(feedEvents)
+	defer s.SetFeedEvents(nil)
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	events, unsubscribe, err := feedEvents.Subscribe(ctx, feedstream.FeedTopic(subscriber))
+	require.NoError(t, err)
+	defer unsubscribe()
+	post := createTestPost(t, s, author)
+
+	for i := 0; i < 2; i++ {
+		_, err = s.UpdateFeedNewPost(ctx, post.GetId(), []string{subscriber})
+		require.NoError(t, err)
+	}
+	require.Len(t, events, 1)
+	require.Equal(t, post.GetId(), (<-events).Id)
+}
+
+func TestReplayedNewPostTaskNotifiesOnce(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	feedEvents := feedstream.CreateInMemoryBroadcaster()
+	s.SetFeedEvents(feedEvents)
+	defer s.SetFeedEvents(nil)
+
+	author := primitive.NewObjectID().Hex()
+	replied := createTestPost(t, s, author)
+	events, unsubscribe, err := feedEvents.Subscribe(ctx, feedstream.NotificationsTopic(author))
+	require.NoError(t, err)
+	defer unsubscribe()
+	repliedId := replied.GetId()
+	reply, err := s.AddPost(ctx, primitive.NewObjectID().Hex(), "reply", storage.PostOptions{ReplyToPostId: &repliedId})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = s.UpdateFeedNewPost(ctx, reply.GetId(), nil)
+		require.NoError(t, err)
+	}
+	require.Len(t, events, 1)
+	require.Equal(t, reply.GetId(), (<-events).Id)
+}
+
+func TestPatchPostTaskPublishesUpdate(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	feedEvents := feedstream.CreateInMemoryBroadcaster()
+	s.SetFeedEvents(feedEvents)
+	defer s.SetFeedEvents(nil)
+
+	post := createTestPost(t, s, primitive.NewObjectID().Hex())
+	events, unsubscribe, err := feedEvents.Subscribe(ctx, feedstream.PostTopic(post.GetId()))
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	_, err = s.UpdateFeedPatchPost(ctx, post.GetId())
+	require.NoError(t, err)
+	_, err = s.UpdateFeedDeletePost(ctx, post.GetId())
+	require.NoError(t, err)
+	require.Equal(t, feedstream.PostUpdatedEvent, (<-events).Type)
+	require.Equal(t, feedstream.PostDeletedEvent, (<-events).Type)
+}
+
+func TestPostOfHighFollowerAuthorIsPublishedToAuthorTopic(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+	s.feedConfig.FanoutFollowerThreshold = 1
+	defer func() { s.feedConfig.FanoutFollowerThreshold = 0 }()
+	feedEvents := feedstream.CreateInMemoryBroadcaster()
+	s.SetFeedEvents(feedEvents)
+	defer s.SetFeedEvents(nil)
+
+	celebrity := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	require.NoError(t, s.Subscribe(ctx, celebrity, subscriber))
+	require.NoError(t, s.Subscribe(ctx, celebrity, primitive.NewObjectID().Hex()))
+	post, err := s.AddPost(ctx, celebrity, "text", storage.PostOptions{})
+	require.NoError(t, err)
+	require.True(t, post.(*Post).FanoutOnRead)
+
+	authors, err := s.GetFanoutOnReadAuthors(ctx, subscriber)
+	require.NoError(t, err)
+	require.Equal(t, []string{celebrity}, authors)
+	events, unsubscribe, err := feedEvents.Subscribe(ctx, feedstream.AuthorTopic(celebrity))
+	require.NoError(t, err)
+	defer unsubscribe()
+
+	_, err = s.UpdateFeedNewPost(ctx, post.GetId(), nil)
+	require.NoError(t, err)
+	event := <-events
+	require.Equal(t, feedstream.FeedPostEvent, event.Type)
+	require.Equal(t, post.GetId(), event.Id)
+}
@@ -0,0 +1,33 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+// SetTrending makes the storage count hashtags of posts as they are added, patched and deleted.
+// Must be called before the storage is used.
+func (s *MongoStorageWithBroker) SetTrending(trending storage.HashtagTracker) {
+	s.trending = trending
+}
+
+func (s *MongoStorageWithBroker) setHashtagUses(sessCtx mongo.SessionContext, postId primitive.ObjectID, uses []storage.HashtagUse) error {
+	update := bson.M{"$set": bson.M{"hashtagUses": uses}}
+	if len(uses) == 0 {
+		update = bson.M{"$unset": bson.M{"hashtagUses": ""}}
+	}
+	if _, err := s.mongo.posts.UpdateOne(sessCtx, bson.M{"_id": postId}, update); err != nil {
+		return fmt.Errorf("failed to update hashtag uses: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+func (s *MongoStorageWithBroker) GetPostsByHashtag(
+	ctx context.Context, hashtag string, page *string, size int) ([]models.Post, *string, error) {
+	return s.findPostsPage(ctx, bson.M{"hashtags": hashtag}, page, size)
+}
@@ -0,0 +1,191 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+)
+
+// UserStats are denormalized counters of a user.
+type UserStats struct {
+	UserId        string `bson:"_id"`
+	FollowerCount int64  `bson:"followerCount"`
+	// HasFanoutOnReadPosts is set once the user publishes a post that is merged into feeds on read
+	HasFanoutOnReadPosts bool `bson:"hasFanoutOnReadPosts,omitempty"`
+	// FeedTrimmedBefore is the newest post trimmed from the user's feed by the length limit
+	FeedTrimmedBefore primitive.ObjectID `bson:"feedTrimmedBefore,omitempty"`
+	// FeedReadMarker is the newest post of the feed the user has read
+	FeedReadMarker primitive.ObjectID `bson:"feedReadMarker,omitempty"`
+}
+
+func (s *MongoStorageWithBroker) incFollowerCount(ctx context.Context, userId string, delta int) error {
+	_, err := s.mongo.userStats.UpdateOne(
+		ctx,
+		bson.M{"_id": userId},
+		bson.M{"$inc": bson.M{"followerCount": delta}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update follower count: %s %w", err.Error(), storage.InternalError)
+	}
+	// users without a profile get the count from the stats when it is created
+	_, err = s.mongo.users.UpdateOne(ctx, bson.M{"_id": userId}, bson.M{"$inc": bson.M{"followerCount": delta}})
+	if err != nil {
+		return fmt.Errorf("failed to update user follower count: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+func (s *MongoStorageWithBroker) markFanoutOnReadAuthor(ctx context.Context, userId string) error {
+	_, err := s.mongo.userStats.UpdateOne(
+		ctx,
+		bson.M{"_id": userId},
+		bson.M{"$set": bson.M{"hasFanoutOnReadPosts": true}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark fan-out on read author: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// isHighFollowerAuthor tells if posts of the user are too expensive to fan out on write.
+func (s *MongoStorageWithBroker) isHighFollowerAuthor(ctx context.Context, userId string) (bool, error) {
+	if s.feedConfig.FanoutFollowerThreshold <= 0 {
+		return false, nil
+	}
+	var stats UserStats
+	err := s.mongo.userStats.FindOne(ctx, bson.M{"_id": userId}).Decode(&stats)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get user stats: %s %w", err.Error(), storage.InternalError)
+	}
+	return stats.FollowerCount > s.feedConfig.FanoutFollowerThreshold, nil
+}
+
+func (s *MongoStorageWithBroker) GetFanoutOnReadAuthors(ctx context.Context, userId string) ([]string, error) {
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return s.fanoutOnReadAuthors(ctx, subscriptions)
+}
+
+// fanoutOnReadAuthors returns the users of subscriptions having posts merged into feeds on read.
+func (s *MongoStorageWithBroker) fanoutOnReadAuthors(ctx context.Context, subscriptions []string) ([]string, error) {
+	if len(subscriptions) == 0 {
+		return nil, nil
+	}
+	cursor, err := s.mongo.userStats.Find(
+		ctx,
+		bson.M{"_id": bson.M{"$in": subscriptions}, "hasFanoutOnReadPosts": true},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("feed: failed to find high follower authors: %s, %w", err.Error(), storage.InternalError)
+	}
+	var authors []UserStats
+	if err = cursor.All(ctx, &authors); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	authorIds := make([]string, 0, len(authors))
+	for _, author := range authors {
+		authorIds = append(authorIds, author.UserId)
+	}
+	return authorIds, nil
+}
+
+// fanoutOnReadPosts returns up to limit posts with ids in the range that are not copied
+// to user's feed because their authors have too many subscribers.
+func (s *MongoStorageWithBroker) fanoutOnReadPosts(ctx context.Context, userId string, ids postIdRange, limit int) ([]Post, error) {
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	authorIds, err := s.fanoutOnReadAuthors(ctx, subscriptions)
+	if err != nil || len(authorIds) == 0 {
+		return nil, err
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: ids.order()}})
+	queryOptions.SetLimit(int64(limit))
+	cursor, err := s.mongo.posts.Find(ctx, fanoutOnReadPostsFilter(userId, subscriptions, authorIds, ids), queryOptions)
+	if err != nil {
+		return nil, fmt.Errorf("feed: failed to find posts of high follower authors: %s, %w", err.Error(), storage.InternalError)
+	}
+	var posts []Post
+	if err = cursor.All(ctx, &posts); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	log.Printf("feed: merged %d posts of %d high follower authors", len(posts), len(authorIds))
+	return posts, nil
+}
+
+// fanoutOnReadPostsFilter matches the posts of authorIds with ids in the range that are merged into user's feed on read.
+func fanoutOnReadPostsFilter(userId string, subscriptions []string, authorIds []string, ids postIdRange) bson.M {
+	return bson.M{
+		"authorId":     bson.M{"$in": authorIds},
+		"_id":          ids.filter(),
+		"fanoutOnRead": true,
+		"$or":          inFeedOfCondition(userId, subscriptions),
+	}
+}
+
+// postIdRange selects posts with ids greater than after and not greater than until.
+type postIdRange struct {
+	after primitive.ObjectID
+	until primitive.ObjectID
+	// ascending orders posts oldest first, they are ordered newest first otherwise
+	ascending bool
+}
+
+func (r postIdRange) filter() bson.M {
+	return bson.M{"$gt": r.after, "$lte": r.until}
+}
+
+func (r postIdRange) order() int {
+	if r.ascending {
+		return 1
+	}
+	return -1
+}
+
+// feedRangePosts returns up to limit posts of user's feed with ids in the range, both copied to the feed
+// and merged on read. The range must not reach below the feed boundary.
+func (s *MongoStorageWithBroker) feedRangePosts(ctx context.Context, userId string, ids postIdRange, limit int) ([]Post, error) {
+	feedPosts, err := s.feedItemPosts(ctx, userId, ids, limit)
+	if err != nil {
+		return nil, err
+	}
+	fanoutOnReadPosts, err := s.fanoutOnReadPosts(ctx, userId, ids, limit)
+	if err != nil {
+		return nil, err
+	}
+	return mergePosts(feedPosts, fanoutOnReadPosts, limit, ids.ascending), nil
+}
+
+// mergePosts merges two lists of posts ordered by id into one, up to limit posts.
+// Post ids are unique across lists: a post is either copied to feeds or merged on read.
+func mergePosts(first []Post, second []Post, limit int, ascending bool) []Post {
+	merged := make([]Post, 0, limit)
+	i, j := 0, 0
+	for len(merged) < limit && (i < len(first) || j < len(second)) {
+		if j == len(second) || (i < len(first) && (first[i].Id.Hex() > second[j].Id.Hex()) != ascending) {
+			merged = append(merged, first[i])
+			i++
+		} else {
+			merged = append(merged, second[j])
+			j++
+		}
+	}
+	return merged
+}
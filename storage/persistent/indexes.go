@@ -3,9 +3,12 @@ package persistent
 import (
 	"context"
 	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx"
+	"log"
 	"time"
 )
 
@@ -17,6 +20,17 @@ func ensureFeedIndexes(ctx context.Context, feed *mongo.Collection) {
 				{Key: "postId", Value: bsonx.Int32(1)},
 			},
 		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "userId", Value: bsonx.Int32(1)},
+				{Key: "authorId", Value: bsonx.Int32(1)},
+			},
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "postId", Value: bsonx.Int32(1)},
+			},
+		},
 	}
 	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
 
@@ -24,6 +38,76 @@ func ensureFeedIndexes(ctx context.Context, feed *mongo.Collection) {
 	if err != nil {
 		panic(fmt.Errorf("feed: failed to ensure indexes %w", err))
 	}
+	ensureFeedItemKeyIndex(ctx, feed)
+}
+
+// feedItemKeyIndex makes fan-out tasks idempotent: a post is added to a feed at most once
+var feedItemKeyIndex = mongo.IndexModel{
+	Keys: bsonx.Doc{
+		{Key: "userId", Value: bsonx.Int32(1)},
+		{Key: "postId", Value: bsonx.Int32(1)},
+	},
+	Options: options.Index().SetUnique(true),
+}
+
+// ensureFeedItemKeyIndex creates the unique index of feed items. Feeds filled before fan-out became
+// idempotent may have duplicate items, they are removed before the index is created again.
+func ensureFeedItemKeyIndex(ctx context.Context, feed *mongo.Collection) {
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+	_, err := feed.Indexes().CreateOne(ctx, feedItemKeyIndex, opts)
+	if err == nil {
+		return
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		panic(fmt.Errorf("feed: failed to ensure unique index %w", err))
+	}
+
+	removed, err := removeDuplicateFeedItems(ctx, feed)
+	if err != nil {
+		log.Printf("feed: failed to remove duplicate feed items: %s", err.Error())
+		return
+	}
+	log.Printf("feed: removed %d duplicate feed items", removed)
+	if _, err = feed.Indexes().CreateOne(ctx, feedItemKeyIndex, opts); err != nil {
+		// feeds are still updated without the index, the duplicates written meanwhile are removed on the next start
+		log.Printf("feed: failed to ensure unique index: %s", err.Error())
+	}
+}
+
+// removeDuplicateFeedItems keeps one item of each post in each feed and returns the number of removed items.
+func removeDuplicateFeedItems(ctx context.Context, feed *mongo.Collection) (int64, error) {
+	cursor, err := feed.Aggregate(
+		ctx,
+		mongo.Pipeline{
+			{{Key: "$group", Value: bson.M{
+				"_id":   bson.M{"userId": "$userId", "postId": "$postId"},
+				"ids":   bson.M{"$push": "$_id"},
+				"count": bson.M{"$sum": 1},
+			}}},
+			{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		},
+		options.Aggregate().SetAllowDiskUse(true),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var removed int64
+	for cursor.Next(ctx) {
+		var duplicates struct {
+			Ids []primitive.ObjectID `bson:"ids"`
+		}
+		if err = cursor.Decode(&duplicates); err != nil {
+			return removed, err
+		}
+		result, err := feed.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": duplicates.Ids[1:]}})
+		if err != nil {
+			return removed, err
+		}
+		removed += result.DeletedCount
+	}
+	return removed, cursor.Err()
 }
 
 func ensurePostsIndexes(ctx context.Context, posts *mongo.Collection) {
@@ -34,6 +118,41 @@ func ensurePostsIndexes(ctx context.Context, posts *mongo.Collection) {
 				{Key: "_id", Value: bsonx.Int32(1)},
 			},
 		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "replyToPostId", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "repostOfPostId", Value: bsonx.Int32(1)},
+				{Key: "authorId", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "hashtags", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(-1)},
+			},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "mentions", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(-1)},
+			},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			// words are not stemmed, so that search works the same for any language and the in-memory storage
+			Keys: bsonx.Doc{
+				{Key: "text", Value: bsonx.String("text")},
+			},
+			Options: options.Index().SetDefaultLanguage("none"),
+		},
 	}
 	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
 
@@ -51,6 +170,12 @@ func ensureSubscriptionsIndexes(ctx context.Context, posts *mongo.Collection) {
 				{Key: "subscriptionId", Value: bsonx.Int32(1)},
 			},
 		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "subscriptionId", Value: bsonx.Int32(1)},
+				{Key: "userId", Value: bsonx.Int32(1)},
+			},
+		},
 	}
 	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
 
@@ -59,3 +184,148 @@ func ensureSubscriptionsIndexes(ctx context.Context, posts *mongo.Collection) {
 		panic(fmt.Errorf("failed to ensure indexes %w", err))
 	}
 }
+
+func ensureOutboxIndexes(ctx context.Context, outbox *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{
+				{Key: "status", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(1)},
+			},
+		},
+		{
+			// published entries are kept for a day
+			Keys: bsonx.Doc{
+				{Key: "processedAt", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := outbox.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("outbox: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureUserStatsIndexes(ctx context.Context, userStats *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{
+				{Key: "hasFanoutOnReadPosts", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetSparse(true),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := userStats.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("user stats: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureUsersIndexes(ctx context.Context, users *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{
+				{Key: "handle", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "searchNames", Value: bsonx.Int32(1)},
+				{Key: "followerCount", Value: bsonx.Int32(-1)},
+			},
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := users.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("users: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureRevisionsIndexes(ctx context.Context, revisions *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{
+				{Key: "postId", Value: bsonx.Int32(1)},
+				{Key: "version", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := revisions.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("revisions: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureReactionsIndexes(ctx context.Context, reactions *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bsonx.Doc{
+				{Key: "postId", Value: bsonx.Int32(1)},
+				{Key: "reaction", Value: bsonx.Int32(1)},
+				{Key: "userId", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bsonx.Doc{
+				{Key: "postId", Value: bsonx.Int32(1)},
+				{Key: "reaction", Value: bsonx.Int32(1)},
+				{Key: "_id", Value: bsonx.Int32(1)},
+			},
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := reactions.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("reactions: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureSearchResultsIndexes(ctx context.Context, searchResults *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			// results are paged through while they are kept, see SearchPosts
+			Keys: bsonx.Doc{
+				{Key: "createdAt", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetExpireAfterSeconds(int32(SEARCH_RESULTS_TTL / time.Second)),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := searchResults.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("search results: failed to ensure indexes %w", err))
+	}
+}
+
+func ensureNotifiedPostsIndexes(ctx context.Context, notifiedPosts *mongo.Collection) {
+	indexModels := []mongo.IndexModel{
+		{
+			// tasks are replayed while their outbox entries are kept, see ensureOutboxIndexes
+			Keys: bsonx.Doc{
+				{Key: "notifiedAt", Value: bsonx.Int32(1)},
+			},
+			Options: options.Index().SetExpireAfterSeconds(24 * 60 * 60),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
+
+	_, err := notifiedPosts.Indexes().CreateMany(ctx, indexModels, opts)
+	if err != nil {
+		panic(fmt.Errorf("notified posts: failed to ensure indexes %w", err))
+	}
+}
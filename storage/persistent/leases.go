@@ -0,0 +1,52 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"time"
+)
+
+// Lease makes one of the replicas the only one doing a job, until the lease expires.
+// Expiry is compared with the clocks of the replicas, so they should be kept in sync.
+type Lease struct {
+	Id        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// acquireLease takes the lease leaseId for owner or prolongs it for duration.
+// Returns false if the lease is held by another owner.
+func (s *MongoStorageWithBroker) acquireLease(ctx context.Context, leaseId, owner string, duration time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	_, err := s.mongo.leases.UpdateOne(
+		ctx,
+		bson.M{"_id": leaseId, "$or": bson.A{bson.M{"owner": owner}, bson.M{"expiresAt": bson.M{"$lt": now}}}},
+		bson.M{"$set": bson.M{"owner": owner, "expiresAt": now.Add(duration)}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// the lease exists and is held by another owner
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire %s lease: %s %w", leaseId, err.Error(), storage.InternalError)
+	}
+	return true, nil
+}
+
+// releaseLease lets other owners take the lease leaseId without waiting for it to expire.
+func (s *MongoStorageWithBroker) releaseLease(ctx context.Context, leaseId, owner string) error {
+	_, err := s.mongo.leases.UpdateOne(
+		ctx,
+		bson.M{"_id": leaseId, "owner": owner},
+		bson.M{"$set": bson.M{"expiresAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release %s lease: %s %w", leaseId, err.Error(), storage.InternalError)
+	}
+	return nil
+}
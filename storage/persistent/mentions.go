@@ -0,0 +1,98 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"strings"
+)
+
+// resolveMentions returns ids of users mentioned in the text of the post of authorId.
+// The author exists even before the first post is stored.
+func (s *MongoStorageWithBroker) resolveMentions(ctx context.Context, text string, authorId string) ([]string, error) {
+	mentions := storage.ExtractMentions(text)
+	if len(mentions) == 0 {
+		return nil, nil
+	}
+	lowered := make([]string, len(mentions))
+	for i, mention := range mentions {
+		lowered[i] = strings.ToLower(mention)
+	}
+	cursor, err := s.mongo.users.Find(
+		ctx,
+		bson.M{"$or": bson.A{bson.M{"handle": bson.M{"$in": lowered}}, bson.M{"_id": bson.M{"$in": mentions}}}},
+		options.Find().SetProjection(bson.M{"_id": 1, "handle": 1}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find mentioned users: %s %w", err.Error(), storage.InternalError)
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	handles := make(map[string]string, len(users))
+	existing := make(map[string]bool, len(users))
+	for _, user := range users {
+		if user.Handle != "" {
+			handles[user.Handle] = user.Id
+		}
+		existing[user.Id] = true
+	}
+	existing[authorId] = true
+
+	// users without a profile are known by their posts or subscriptions
+	var unknown []string
+	for _, mention := range mentions {
+		if _, found := handles[strings.ToLower(mention)]; !found && !existing[mention] {
+			unknown = append(unknown, mention)
+		}
+	}
+	if len(unknown) > 0 {
+		if err = s.findUsersWithoutProfile(ctx, unknown, existing); err != nil {
+			return nil, err
+		}
+	}
+	return storage.ResolveMentions(mentions, handles, func(userId string) bool { return existing[userId] }), nil
+}
+
+// findUsersWithoutProfile marks those of userIds that have posts or subscriptions as existing.
+func (s *MongoStorageWithBroker) findUsersWithoutProfile(ctx context.Context, userIds []string, existing map[string]bool) error {
+	lookups := []struct {
+		collection *mongo.Collection
+		field      string
+	}{
+		{s.mongo.posts, "authorId"},
+		{s.mongo.subscriptions, "userId"},
+		{s.mongo.subscriptions, "subscriptionId"},
+	}
+	for _, lookup := range lookups {
+		var candidates []string
+		for _, userId := range userIds {
+			if !existing[userId] {
+				candidates = append(candidates, userId)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil
+		}
+		found, err := lookup.collection.Distinct(ctx, lookup.field, bson.M{lookup.field: bson.M{"$in": candidates}})
+		if err != nil {
+			return fmt.Errorf("failed to find mentioned users: %s %w", err.Error(), storage.InternalError)
+		}
+		for _, userId := range found {
+			if id, ok := userId.(string); ok {
+				existing[id] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MongoStorageWithBroker) GetPostsMentioning(
+	ctx context.Context, userId string, page *string, size int) ([]models.Post, *string, error) {
+	return s.findPostsPage(ctx, bson.M{"mentions": userId}, page, size)
+}
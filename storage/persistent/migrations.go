@@ -0,0 +1,205 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+	"time"
+)
+
+// migration backfills data written by earlier versions. Migrations must be idempotent:
+// the server and the worker may run one at the same time, and a failed one is run again on the next start.
+type migration struct {
+	name string
+	run  func(ctx context.Context, db *MongoStorage) error
+}
+
+// migrations are run in order on start, each one once per database.
+var migrations = []migration{
+	{name: "backfillFollowerCount", run: backfillFollowerCount},
+	{name: "backfillHashtags", run: backfillHashtags},
+	{name: "backfillUserSearchNames", run: backfillUserSearchNames},
+	{name: "backfillUserFollowerCount", run: backfillUserFollowerCount},
+}
+
+const MIGRATION_BATCH_SIZE = 1000
+
+type appliedMigration struct {
+	Name      string    `bson:"_id"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// runMigrations runs migrations not applied to the database yet. Stops at the first failed one,
+// so that the following ones may rely on it.
+func runMigrations(ctx context.Context, db *MongoStorage) {
+	for _, m := range migrations {
+		err := db.migrations.FindOne(ctx, bson.M{"_id": m.name}).Err()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("Failed to check migration %s: %s", m.name, err.Error())
+			return
+		}
+
+		log.Printf("Running migration %s", m.name)
+		if err = m.run(ctx, db); err != nil {
+			log.Printf("Migration %s failed, it is run again on the next start: %s", m.name, err.Error())
+			return
+		}
+		_, err = db.migrations.UpdateOne(
+			ctx,
+			bson.M{"_id": m.name},
+			bson.M{"$set": appliedMigration{Name: m.name, AppliedAt: time.Now().UTC()}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			log.Printf("Failed to record migration %s: %s", m.name, err.Error())
+			return
+		}
+		log.Printf("Migration %s applied", m.name)
+	}
+}
+
+// backfillFollowerCount computes follower counts of the users followed before the counters were kept.
+// Counts of users subscribed to while it runs may be off by these subscriptions until the next run.
+func backfillFollowerCount(ctx context.Context, db *MongoStorage) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$subscriptionId", "followerCount": bson.M{"$sum": 1}}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           db.userStats.Name(),
+			"on":             "_id",
+			"whenMatched":    "merge",
+			"whenNotMatched": "insert",
+		}}},
+	}
+	cursor, err := db.subscriptions.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("failed to count followers: %s %w", err.Error(), storage.InternalError)
+	}
+	return cursor.Close(ctx)
+}
+
+// migrationBatch updates documents of the collection in batches of MIGRATION_BATCH_SIZE.
+type migrationBatch struct {
+	collection *mongo.Collection
+	writes     []mongo.WriteModel
+}
+
+func (b *migrationBatch) add(ctx context.Context, write mongo.WriteModel) error {
+	b.writes = append(b.writes, write)
+	if len(b.writes) < MIGRATION_BATCH_SIZE {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+func (b *migrationBatch) flush(ctx context.Context) error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	_, err := b.collection.BulkWrite(ctx, b.writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %s %w", b.collection.Name(), err.Error(), storage.InternalError)
+	}
+	b.writes = b.writes[:0]
+	return nil
+}
+
+func closeMigrationCursor(cursor *mongo.Cursor, ctx context.Context) {
+	err := cursor.Close(ctx)
+	if err != nil {
+		log.Printf("Migration cursor closing failed: %s", err.Error())
+	}
+}
+
+// backfillHashtags indexes hashtags of the posts written before hashtags were extracted.
+func backfillHashtags(ctx context.Context, db *MongoStorage) error {
+	cursor, err := db.posts.Find(
+		ctx,
+		bson.M{"hashtags": bson.M{"$exists": false}, "text": bson.M{"$regex": "#"}},
+		options.Find().SetProjection(bson.M{"text": 1}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to find posts: %s %w", err.Error(), storage.InternalError)
+	}
+	defer closeMigrationCursor(cursor, ctx)
+
+	batch := migrationBatch{collection: db.posts}
+	for cursor.Next(ctx) {
+		var post Post
+		if err = cursor.Decode(&post); err != nil {
+			return fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+		}
+		hashtags := storage.ExtractHashtags(post.Text)
+		if len(hashtags) == 0 {
+			continue
+		}
+		err = batch.add(ctx, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": post.Id, "hashtags": bson.M{"$exists": false}}).
+			SetUpdate(bson.M{"$set": bson.M{"hashtags": hashtags}}))
+		if err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return fmt.Errorf("failed to read posts: %s %w", err.Error(), storage.InternalError)
+	}
+	return batch.flush(ctx)
+}
+
+// backfillUserSearchNames makes the users created before user search was added findable.
+// Users updated while it runs get their search names from the update and are skipped.
+func backfillUserSearchNames(ctx context.Context, db *MongoStorage) error {
+	cursor, err := db.users.Find(
+		ctx,
+		bson.M{"searchNames": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"handle": 1, "displayName": 1}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to find users: %s %w", err.Error(), storage.InternalError)
+	}
+	defer closeMigrationCursor(cursor, ctx)
+
+	batch := migrationBatch{collection: db.users}
+	for cursor.Next(ctx) {
+		var user User
+		if err = cursor.Decode(&user); err != nil {
+			return fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+		}
+		err = batch.add(ctx, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": user.Id, "searchNames": bson.M{"$exists": false}}).
+			SetUpdate(bson.M{"$set": bson.M{"searchNames": storage.UserSearchNames(user.Handle, user.DisplayName)}}))
+		if err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return fmt.Errorf("failed to read users: %s %w", err.Error(), storage.InternalError)
+	}
+	return batch.flush(ctx)
+}
+
+// backfillUserFollowerCount copies follower counts to the users created before search ranked by them.
+// Counts of users subscribed to while it runs may be off by these subscriptions until the next run.
+func backfillUserFollowerCount(ctx context.Context, db *MongoStorage) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{"followerCount": 1}}},
+		{{Key: "$merge", Value: bson.M{
+			"into":           db.users.Name(),
+			"on":             "_id",
+			"whenMatched":    "merge",
+			"whenNotMatched": "discard",
+		}}},
+	}
+	cursor, err := db.userStats.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return fmt.Errorf("failed to copy follower counts: %s %w", err.Error(), storage.InternalError)
+	}
+	return cursor.Close(ctx)
+}
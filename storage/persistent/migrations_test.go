@@ -0,0 +1,82 @@
+package persistent
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+)
+
+func TestBackfillFollowerCount(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// subscriptions made before the counters were kept
+	userId := primitive.NewObjectID().Hex()
+	for i := 0; i < 3; i++ {
+		_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{SubscriptionId: userId, UserId: primitive.NewObjectID().Hex()})
+		require.NoError(t, err)
+	}
+	require.NoError(t, backfillFollowerCount(ctx, s.mongo))
+
+	var stats UserStats
+	require.NoError(t, s.mongo.userStats.FindOne(ctx, bson.M{"_id": userId}).Decode(&stats))
+	require.EqualValues(t, 3, stats.FollowerCount)
+
+	// other stats are kept and the migration may run again
+	require.NoError(t, s.markFanoutOnReadAuthor(ctx, userId))
+	require.NoError(t, backfillFollowerCount(ctx, s.mongo))
+	require.NoError(t, s.mongo.userStats.FindOne(ctx, bson.M{"_id": userId}).Decode(&stats))
+	require.EqualValues(t, 3, stats.FollowerCount)
+	require.True(t, stats.HasFanoutOnReadPosts)
+}
+
+func TestBackfillHashtags(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// a post written before hashtags were extracted
+	result, err := s.mongo.posts.InsertOne(ctx, bson.M{"authorId": primitive.NewObjectID().Hex(), "text": "old #Post about #go"})
+	require.NoError(t, err)
+	require.NoError(t, backfillHashtags(ctx, s.mongo))
+
+	var post Post
+	require.NoError(t, s.mongo.posts.FindOne(ctx, bson.M{"_id": result.InsertedID}).Decode(&post))
+	require.Equal(t, []string{"post", "go"}, post.Hashtags)
+}
+
+func TestBackfillUserSearchNames(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// a user created before user search was added
+	userId := primitive.NewObjectID().Hex()
+	handle := "old_" + userId[len(userId)-8:]
+	_, err := s.mongo.users.InsertOne(ctx, bson.M{"_id": userId, "handle": handle, "displayName": "Old Timer"})
+	require.NoError(t, err)
+	require.NoError(t, backfillUserSearchNames(ctx, s.mongo))
+
+	users, err := s.SearchUsers(ctx, []string{handle}, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, userId, users[0].GetId())
+}
+
+func TestBackfillUserFollowerCount(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// a user followed before follower counts were copied to users
+	userId := primitive.NewObjectID().Hex()
+	_, err := s.mongo.users.InsertOne(ctx, bson.M{"_id": userId, "handle": "old_" + userId[len(userId)-8:]})
+	require.NoError(t, err)
+	_, err = s.mongo.userStats.UpdateOne(ctx, bson.M{"_id": userId}, bson.M{"$set": bson.M{"followerCount": 2}}, options.Update().SetUpsert(true))
+	require.NoError(t, err)
+	require.NoError(t, backfillUserFollowerCount(ctx, s.mongo))
+
+	var user User
+	require.NoError(t, s.mongo.users.FindOne(ctx, bson.M{"_id": userId}).Decode(&user))
+	require.EqualValues(t, 2, user.FollowerCount)
+}
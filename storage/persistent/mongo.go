@@ -4,12 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/RichardKnop/machinery/v1"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"miniblog/feedstream"
 	"miniblog/storage"
 	"miniblog/storage/models"
 	"miniblog/utils"
@@ -24,12 +24,37 @@ type Post struct {
 	CreatedAt      string             `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
 	LastModifiedAt string             `bson:"lastModifiedAt,omitempty" json:"lastModifiedAt,omitempty"`
 	Version        int64              `bson:"version,omitempty"`
+	// FanoutOnRead posts are not copied to feeds, they are merged into feeds on read
+	FanoutOnRead   bool             `bson:"fanoutOnRead,omitempty" json:"-"`
+	LikeCount      int64            `bson:"likeCount,omitempty" json:"likeCount"`
+	ReactionCounts map[string]int64 `bson:"reactionCounts,omitempty" json:"reactionCounts,omitempty"`
+	ReplyToPostId  string           `bson:"replyToPostId,omitempty" json:"replyToPostId,omitempty"`
+	RootPostId     string           `bson:"rootPostId,omitempty" json:"rootPostId,omitempty"`
+	// ReplyToAuthorId is the author of the replied post, see inFeedOf
+	ReplyToAuthorId string   `bson:"replyToAuthorId,omitempty" json:"-"`
+	ReplyCount      int64    `bson:"replyCount,omitempty" json:"replyCount"`
+	RepostOfPostId  string   `bson:"repostOfPostId,omitempty" json:"repostOfPostId,omitempty"`
+	RepostCount     int64    `bson:"repostCount,omitempty" json:"repostCount"`
+	QuoteCount      int64    `bson:"quoteCount,omitempty" json:"quoteCount"`
+	Hashtags        []string `bson:"hashtags,omitempty" json:"hashtags,omitempty"`
+	Mentions        []string `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	// HashtagUses are the hashtags counted in trending hashtags and when they were recorded
+	HashtagUses []storage.HashtagUse `bson:"hashtagUses,omitempty" json:"-"`
+	// RepostedBy is set on feed posts that are in the feed because a followed user reposted them
+	RepostedBy string `bson:"-" json:"repostedBy,omitempty"`
 }
 
+// Subscription is keyed by SubscriptionKey, so that its change events, deletes included, carry both users.
+// Subscriptions made before have an ObjectID as the id.
 type Subscription struct {
-	Id             primitive.ObjectID `bson:"_id,omitempty"`
-	SubscriptionId string             `bson:"subscriptionId,omitempty"`
-	UserId         string             `bson:"userId,omitempty"`
+	Id             interface{} `bson:"_id,omitempty"`
+	SubscriptionId string      `bson:"subscriptionId,omitempty"`
+	UserId         string      `bson:"userId,omitempty"`
+}
+
+type SubscriptionKey struct {
+	UserId         string `bson:"userId"`
+	SubscriptionId string `bson:"subscriptionId"`
 }
 
 // TODO: rm json
@@ -42,6 +67,42 @@ type FeedItem struct {
 	Text           string             `bson:"text,omitempty" json:"text,omitempty"`
 	CreatedAt      string             `bson:"createdAt,omitempty" json:"createdAt,omitempty"`
 	LastModifiedAt string             `bson:"lastModifiedAt,omitempty" json:"lastModifiedAt,omitempty"`
+	ReplyToPostId  string             `bson:"replyToPostId,omitempty" json:"replyToPostId,omitempty"`
+	RootPostId     string             `bson:"rootPostId,omitempty" json:"rootPostId,omitempty"`
+	RepostOfPostId string             `bson:"repostOfPostId,omitempty" json:"repostOfPostId,omitempty"`
+	Hashtags       []string           `bson:"hashtags,omitempty" json:"hashtags,omitempty"`
+	Mentions       []string           `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	// RepostedBy is the followed user whose plain repost brought the post to the feed,
+	// empty if the user follows the author
+	RepostedBy string `bson:"repostedBy,omitempty" json:"repostedBy,omitempty"`
+	// counters are not omitted, so that upserts reset them
+	LikeCount      int64            `bson:"likeCount" json:"likeCount"`
+	ReactionCounts map[string]int64 `bson:"reactionCounts" json:"reactionCounts,omitempty"`
+	ReplyCount     int64            `bson:"replyCount" json:"replyCount"`
+	RepostCount    int64            `bson:"repostCount" json:"repostCount"`
+	QuoteCount     int64            `bson:"quoteCount" json:"quoteCount"`
+}
+
+func newFeedItem(userId string, post models.Post) FeedItem {
+	postId, _ := primitive.ObjectIDFromHex(post.GetId())
+	return FeedItem{
+		UserId:         userId,
+		PostId:         postId,
+		Text:           post.GetText(),
+		AuthorId:       post.GetAuthorId(),
+		CreatedAt:      post.GetCreatedAt(),
+		LastModifiedAt: post.GetLastModifiedAt(),
+		ReplyToPostId:  post.GetReplyToPostId(),
+		RootPostId:     post.GetRootPostId(),
+		RepostOfPostId: post.GetRepostOfPostId(),
+		Hashtags:       post.GetHashtags(),
+		Mentions:       post.GetMentions(),
+		LikeCount:      post.GetLikeCount(),
+		ReactionCounts: post.GetReactionCounts(),
+		ReplyCount:     post.GetReplyCount(),
+		RepostCount:    post.GetRepostCount(),
+		QuoteCount:     post.GetQuoteCount(),
+	}
 }
 
 func (p *Post) GetId() string {
@@ -52,6 +113,46 @@ func (p *Post) GetVersion() int64 {
 	return p.Version
 }
 
+func (p *Post) GetLikeCount() int64 {
+	return p.LikeCount
+}
+
+func (p *Post) GetReactionCounts() map[string]int64 {
+	return p.ReactionCounts
+}
+
+func (p *Post) GetReplyToPostId() string {
+	return p.ReplyToPostId
+}
+
+func (p *Post) GetRootPostId() string {
+	return p.RootPostId
+}
+
+func (p *Post) GetReplyCount() int64 {
+	return p.ReplyCount
+}
+
+func (p *Post) GetRepostOfPostId() string {
+	return p.RepostOfPostId
+}
+
+func (p *Post) GetRepostCount() int64 {
+	return p.RepostCount
+}
+
+func (p *Post) GetQuoteCount() int64 {
+	return p.QuoteCount
+}
+
+func (p *Post) GetHashtags() []string {
+	return p.Hashtags
+}
+
+func (p *Post) GetMentions() []string {
+	return p.Mentions
+}
+
 func (p *Post) GetAuthorId() string {
 	return p.AuthorId
 }
@@ -69,14 +170,32 @@ func (p *Post) GetLastModifiedAt() string {
 }
 
 type MongoStorage struct {
+	client        *mongo.Client
 	posts         *mongo.Collection
 	subscriptions *mongo.Collection
 	feed          *mongo.Collection
+	outbox        *mongo.Collection
+	resumeTokens  *mongo.Collection
+	userStats     *mongo.Collection
+	users         *mongo.Collection
+	revisions     *mongo.Collection
+	reactions     *mongo.Collection
+	migrations    *mongo.Collection
+	searchResults *mongo.Collection
+	notifiedPosts *mongo.Collection
+	leases        *mongo.Collection
 }
 
+// MongoStorageWithBroker hands feed updates over to the broker through the outbox
+// collection: tasks are written in the same transaction as the change they are caused by
+// and are published by the worker (see RelayOutbox).
 type MongoStorageWithBroker struct {
-	mongo  *MongoStorage
-	broker *machinery.Server
+	mongo      *MongoStorage
+	feedConfig FeedConfig
+	// feedEvents delivers posts added to feeds by the worker to their connected readers, nil disables it
+	feedEvents feedstream.Publisher
+	// trending counts hashtags of posts as they are added, patched and deleted, nil disables it
+	trending storage.HashtagTracker
 }
 
 func (s *MongoStorageWithBroker) Subscribe(ctx context.Context, userId string, subscriber string) error {
@@ -84,33 +203,66 @@ func (s *MongoStorageWithBroker) Subscribe(ctx context.Context, userId string, s
 		UserId:         subscriber,
 		SubscriptionId: userId,
 	}
-	upsertSubscribtion := bson.D{{"$set", subscription}}
-	queryOptions := options.Update().SetUpsert(true)
-	id, err := s.mongo.subscriptions.UpdateOne(ctx, subscription, upsertSubscribtion, queryOptions)
-	if err != nil {
-		return fmt.Errorf("failed to insert subscription: %w", storage.InternalError)
-	}
-	log.Printf("Created subscription with id %s: %s -> %s", id, subscriber, userId)
+	return s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		upsertSubscribtion := bson.M{
+			"$set":         subscription,
+			"$setOnInsert": bson.M{"_id": SubscriptionKey{UserId: subscriber, SubscriptionId: userId}},
+		}
+		queryOptions := options.Update().SetUpsert(true)
+		id, err := s.mongo.subscriptions.UpdateOne(sessCtx, subscription, upsertSubscribtion, queryOptions)
+		if err != nil {
+			return fmt.Errorf("failed to insert subscription: %s %w", err.Error(), storage.InternalError)
+		}
+		if id.UpsertedCount == 0 {
+			log.Printf("Subscription already exists: %s -> %s", subscriber, userId)
+			return nil
+		}
+		log.Printf("Created subscription with id %v: %s -> %s", id.UpsertedID, subscriber, userId)
 
-	task := createAddSubscriptionTask(userId, subscriber)
-	_, err = s.broker.SendTaskWithContext(context.Background(), &task)
-	if err != nil {
-		return fmt.Errorf("could not send task: %s %w", err.Error(), storage.InternalError)
+		if err = s.incFollowerCount(sessCtx, userId, 1); err != nil {
+			return err
+		}
+		// posts published before the first subscription are read
+		if err = s.startFeedReadMarker(sessCtx, subscriber); err != nil {
+			return err
+		}
+		return s.enqueue(sessCtx, createAddSubscriptionTask(userId, subscriber))
+	})
+}
+
+func (s *MongoStorageWithBroker) Unsubscribe(ctx context.Context, userId string, subscriber string) error {
+	subscription := Subscription{
+		UserId:         subscriber,
+		SubscriptionId: userId,
 	}
-	//results, err := asyncResult.Get(time.Duration(1 * time.Second))
-	//if err != nil {
-	//	return fmt.Errorf("getting task result failed with error: %s", err.Error())
-	//}
-	//log.Printf("%v\n", tasks.HumanReadableResults(results))
-	return nil
+	return s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var deleted Subscription
+		err := s.mongo.subscriptions.FindOneAndDelete(sessCtx, subscription).Decode(&deleted)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			log.Printf("No subscription to delete: %s -> %s", subscriber, userId)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete subscription: %s %w", err.Error(), storage.InternalError)
+		}
+		log.Printf("Deleted subscription: %s -> %s", subscriber, userId)
+
+		if err = s.incFollowerCount(sessCtx, userId, -1); err != nil {
+			return err
+		}
+		task := createRemoveSubscriptionTask(userId, subscriber)
+		if _, legacy := deleted.Id.(primitive.ObjectID); legacy {
+			// the delete event of a subscription without the key does not tell whose it was
+			return s.insertOutboxEntry(sessCtx, task)
+		}
+		return s.enqueue(sessCtx, task)
+	})
 }
 
 func (s *MongoStorageWithBroker) GetSubscriptions(ctx context.Context, userId string) ([]string, error) {
 	cursor, err := s.mongo.subscriptions.Find(
 		ctx,
-		bson.D{
-			{"userId", userId},
-		},
+		bson.M{"userId": userId},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find subscriptions for user: %s, %w", err.Error(), storage.InternalError)
@@ -136,9 +288,7 @@ func (s *MongoStorageWithBroker) GetSubscriptions(ctx context.Context, userId st
 func (s *MongoStorageWithBroker) GetSubscribers(ctx context.Context, userId string) ([]string, error) {
 	cursor, err := s.mongo.subscriptions.Find(
 		ctx,
-		bson.D{
-			{"subscriptionId", userId},
-		},
+		bson.M{"subscriptionId": userId},
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find subscribers for user: %s, %w", err.Error(), storage.InternalError)
@@ -162,10 +312,6 @@ func (s *MongoStorageWithBroker) GetSubscribers(ctx context.Context, userId stri
 }
 
 func (s *MongoStorageWithBroker) Feed(ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
-	queryOptions := options.Find()
-	queryOptions.SetSort(bson.D{{"postId", -1}})
-	queryOptions.SetLimit(int64(size + 1))
-
 	minPage := "ffffffffffffffffffffffff"
 	if page == nil {
 		page = &minPage
@@ -174,16 +320,55 @@ func (s *MongoStorageWithBroker) Feed(ctx context.Context, userId *string, page
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to convert provided page to Mongo object id: %s, %w", err.Error(), storage.ClientError)
 	}
+
+	boundary, err := s.feedBoundary(ctx, *userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, err := s.feedRangePosts(ctx, *userId, postIdRange{after: boundary, until: pageMongoId}, size+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(merged) < size+1 && !boundary.IsZero() {
+		// deeper pages are trimmed from the feed, they are read from the authors' posts
+		trimmedPosts, err := s.subscriptionsPosts(
+			ctx, *userId, postIdRange{until: earlierId(pageMongoId, boundary)}, size+1-len(merged))
+		if err != nil {
+			return nil, nil, err
+		}
+		merged = append(merged, trimmedPosts...)
+	}
+
+	if len(merged) == 0 && *page != minPage {
+		return nil, nil, fmt.Errorf("provided page for non-existent user: %w", storage.ClientError)
+	}
+	posts := make([]models.Post, 0, size)
+	for i := range merged {
+		if len(posts) == size {
+			nextPage := merged[i].Id.Hex()
+			return posts, &nextPage, nil
+		}
+		posts = append(posts, &merged[i])
+	}
+	return posts, nil, nil
+}
+
+// feedItemPosts returns up to limit posts copied to user's feed with ids in the range.
+func (s *MongoStorageWithBroker) feedItemPosts(ctx context.Context, userId string, ids postIdRange, limit int) ([]Post, error) {
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "postId", Value: ids.order()}})
+	queryOptions.SetLimit(int64(limit))
+
 	cursor, err := s.mongo.feed.Find(
 		ctx,
-		bson.D{
-			{"userId", userId},
-			{"postId", bson.D{{"$lte", pageMongoId}}},
+		bson.M{
+			"userId": userId,
+			"postId": ids.filter(),
 		},
 		queryOptions,
 	)
 	if err != nil {
-		return nil, nil, fmt.Errorf("feed: failed to find posts for user: %s, %w", err.Error(), storage.InternalError)
+		return nil, fmt.Errorf("feed: failed to find posts for user: %s, %w", err.Error(), storage.InternalError)
 	}
 	defer func(cursor *mongo.Cursor, ctx context.Context) {
 		err := cursor.Close(ctx)
@@ -192,86 +377,182 @@ func (s *MongoStorageWithBroker) Feed(ctx context.Context, userId *string, page
 		}
 	}(cursor, ctx)
 
-	posts := make([]models.Post, 0)
-	var nextPage string
-	for len(posts) != size+1 && cursor.Next(ctx) {
+	posts := make([]Post, 0)
+	for cursor.Next(ctx) {
 		var nextFeedItem FeedItem
 		if err = cursor.Decode(&nextFeedItem); err != nil {
-			return nil, nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+			return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
 		}
-		var nextPost = Post{
+		posts = append(posts, Post{
 			Id:             nextFeedItem.PostId,
 			AuthorId:       nextFeedItem.AuthorId,
 			Text:           nextFeedItem.Text,
 			CreatedAt:      nextFeedItem.CreatedAt,
 			LastModifiedAt: nextFeedItem.LastModifiedAt,
-		}
-		if len(posts) == size {
-			nextPage = nextPost.Id.Hex()
-			return posts, &nextPage, nil
-		}
-		posts = append(posts, &nextPost)
-	}
-	if len(posts) == 0 && *page != minPage {
-		return nil, nil, fmt.Errorf("provided page for non-existent user", storage.ClientError)
-	}
-	return posts, nil, nil
+			ReplyToPostId:  nextFeedItem.ReplyToPostId,
+			RootPostId:     nextFeedItem.RootPostId,
+			LikeCount:      nextFeedItem.LikeCount,
+			ReactionCounts: nextFeedItem.ReactionCounts,
+			ReplyCount:     nextFeedItem.ReplyCount,
+			RepostOfPostId: nextFeedItem.RepostOfPostId,
+			RepostCount:    nextFeedItem.RepostCount,
+			QuoteCount:     nextFeedItem.QuoteCount,
+			RepostedBy:     nextFeedItem.RepostedBy,
+			Hashtags:       nextFeedItem.Hashtags,
+			Mentions:       nextFeedItem.Mentions,
+		})
+	}
+	return posts, nil
 }
 
-func (s *MongoStorageWithBroker) PatchPost(ctx context.Context, postId string, userId string, text string) (models.Post, error) {
+func (s *MongoStorageWithBroker) PatchPost(
+	ctx context.Context, postId string, userId string, text string, ifVersion *int64) (models.Post, error) {
 	var result Post
 	postMongoId, err := primitive.ObjectIDFromHex(postId)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert provided id to Mongo object id %w", storage.NotFoundError)
 	}
+	now := time.Now()
+	lastModifiedAt := now.UTC().Format(time.RFC3339)
 	filter := bson.M{"_id": postMongoId, "authorId": userId}
+	if ifVersion != nil {
+		if *ifVersion == 0 {
+			// version is omitted until the first patch
+			filter["version"] = bson.M{"$in": bson.A{0, nil}}
+		} else {
+			filter["version"] = *ifVersion
+		}
+	}
+	hashtags := storage.ExtractHashtags(text)
 	update := bson.M{
 		"$set": bson.M{
 			"text":           text,
-			"lastModifiedAt": time.Now().UTC().Format(time.RFC3339),
+			"lastModifiedAt": lastModifiedAt,
 		},
 		"$inc": bson.M{
 			"version": 1,
 		},
 	}
+	mentions, err := s.resolveMentions(ctx, text, userId)
+	if err != nil {
+		return nil, err
+	}
+	// posts without hashtags or mentions are not in the sparse indexes
+	unset := bson.M{}
+	for field, values := range map[string][]string{"hashtags": hashtags, "mentions": mentions} {
+		if len(values) > 0 {
+			update["$set"].(bson.M)[field] = values
+		} else {
+			unset[field] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
 
+	// the post before the update is stored as a revision
 	upsert := false
-	after := options.After
+	before := options.Before
 	opt := options.FindOneAndUpdateOptions{
-		ReturnDocument: &after,
+		ReturnDocument: &before,
 		Upsert:         &upsert,
 	}
-	mongoResult := s.mongo.posts.FindOneAndUpdate(ctx, filter, update, &opt)
-	err = mongoResult.Err()
+	var addedHashtags []string
+	var removedHashtags []storage.HashtagUse
+	err = s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		err := s.mongo.posts.FindOneAndUpdate(sessCtx, filter, update, &opt).Decode(&result)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return s.ownershipError(sessCtx, postMongoId, userId)
+			}
+			return fmt.Errorf("failed to find post: %s %s %s %w", err.Error(), postMongoId, userId, storage.InternalError)
+		}
+		if result.RepostOfPostId != "" && (result.Text == "" || text == "") {
+			return fmt.Errorf("post %s cannot switch between plain repost and quote: %w", postId, storage.ClientError)
+		}
+		if _, err = s.mongo.revisions.InsertOne(sessCtx, newRevision(&result)); err != nil {
+			return fmt.Errorf("failed to insert revision: %s %w", err.Error(), storage.InternalError)
+		}
+		// trending counts change by the hashtags of the committed previous version
+		result.HashtagUses, addedHashtags, removedHashtags = storage.UpdateHashtagUses(
+			result.HashtagUses, result.Hashtags, hashtags, now)
+		if err = s.setHashtagUses(sessCtx, result.Id, result.HashtagUses); err != nil {
+			return err
+		}
+		result.Text = text
+		result.LastModifiedAt = lastModifiedAt
+		result.Hashtags = hashtags
+		result.Mentions = mentions
+		result.Version++
+		return s.enqueue(sessCtx, createPatchPostTask(result.Id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage.RecordHashtagChanges(ctx, s.trending, postId, addedHashtags, now, removedHashtags)
+	return &result, nil
+}
+
+func (s *MongoStorageWithBroker) DeletePost(ctx context.Context, postId string, userId string) error {
+	postMongoId, err := primitive.ObjectIDFromHex(postId)
 	if err != nil {
+		return fmt.Errorf("failed to convert provided id to Mongo object id %w", storage.NotFoundError)
+	}
+	var deleted Post
+	err = s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		err := s.mongo.posts.FindOneAndDelete(sessCtx, bson.M{"_id": postMongoId, "authorId": userId}).Decode(&deleted)
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			err = s.mongo.posts.FindOne(ctx, bson.M{"_id": postMongoId}).Decode(&result)
-			if err == nil {
-				return nil, fmt.Errorf("post %s is owned by another user: %s %w", postId, result.AuthorId, storage.Forbidden)
+			return s.ownershipError(sessCtx, postMongoId, userId)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete post: %s %w", err.Error(), storage.InternalError)
+		}
+		if deleted.ReplyToPostId != "" {
+			if err = s.updateReplyCount(sessCtx, deleted.ReplyToPostId, -1); err != nil {
+				return err
 			}
-			if errors.Is(err, mongo.ErrNoDocuments) {
-				return nil, fmt.Errorf("no document with id %v: %w", postId, storage.NotFoundError)
+		}
+		if deleted.RepostOfPostId != "" {
+			if err = s.unsetRepostOf(sessCtx, &deleted); err != nil {
+				return err
 			}
 		}
-
-		return nil, fmt.Errorf("failed to find post: %s %s %s %w", err.Error(), postMongoId, userId, storage.InternalError)
+		if _, err = s.mongo.revisions.DeleteMany(sessCtx, bson.M{"postId": postMongoId}); err != nil {
+			return fmt.Errorf("failed to delete revisions: %s %w", err.Error(), storage.InternalError)
+		}
+		if _, err = s.mongo.reactions.DeleteMany(sessCtx, bson.M{"postId": postMongoId}); err != nil {
+			return fmt.Errorf("failed to delete reactions: %s %w", err.Error(), storage.InternalError)
+		}
+		return s.enqueue(sessCtx, createDeletePostTask(postMongoId))
+	})
+	if err != nil {
+		return err
 	}
+	storage.RecordHashtagChanges(ctx, s.trending, postId, nil, time.Time{}, deleted.HashtagUses)
+	return nil
+}
 
-	mongoResult.Decode(&result)
-
-	task := createPatchPostTask(result.Id)
-	_, err = s.broker.SendTaskWithContext(context.Background(), &task)
-	if err != nil {
-		return nil, fmt.Errorf("could not send task: %s %w", err.Error(), storage.InternalError)
+// ownershipError explains why a post filtered by id, author and version was not found.
+func (s *MongoStorageWithBroker) ownershipError(ctx context.Context, postId primitive.ObjectID, userId string) error {
+	var result Post
+	err := s.mongo.posts.FindOne(ctx, bson.M{"_id": postId}).Decode(&result)
+	if err == nil && result.AuthorId != userId {
+		return fmt.Errorf("post %s is owned by another user: %s %w", postId.Hex(), result.AuthorId, storage.Forbidden)
 	}
-	return &result, nil
+	if err == nil {
+		return fmt.Errorf("post %s has version %d: %w", postId.Hex(), result.Version, storage.PreconditionFailed)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("no document with id %v: %w", postId.Hex(), storage.NotFoundError)
+	}
+	return fmt.Errorf("failed to find post: %s %s %w", err.Error(), postId.Hex(), storage.InternalError)
 }
 
 func (s *MongoStorageWithBroker) GetPostsByUserId(
 	ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
 
 	queryOptions := options.Find()
-	queryOptions.SetSort(bson.D{{"_id", -1}})
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
 	queryOptions.SetLimit(int64(size + 1))
 
 	minPage := "ffffffffffffffffffffffff"
@@ -284,9 +565,9 @@ func (s *MongoStorageWithBroker) GetPostsByUserId(
 	}
 	cursor, err := s.mongo.posts.Find(
 		ctx,
-		bson.D{
-			{"authorId", *userId},
-			{"_id", bson.D{{"$lte", pageMongoId}}},
+		bson.M{
+			"authorId": *userId,
+			"_id":      bson.M{"$lte": pageMongoId},
 		},
 		queryOptions,
 	)
@@ -314,40 +595,109 @@ func (s *MongoStorageWithBroker) GetPostsByUserId(
 		posts = append(posts, &nextPost)
 	}
 	if len(posts) == 0 && *page != minPage {
-		return nil, nil, fmt.Errorf("provided page for non-existent user", storage.ClientError)
+		return nil, nil, fmt.Errorf("provided page for non-existent user: %w", storage.ClientError)
 	}
 	return posts, nil, nil
 }
 
-func (s *MongoStorageWithBroker) AddPost(ctx context.Context, userId string, text string) (models.Post, error) {
-	now := time.Now().UTC().Format(time.RFC3339)
+// findPostsPage returns up to size posts matching filter, newest first, starting from the post with id page.
+func (s *MongoStorageWithBroker) findPostsPage(
+	ctx context.Context, filter bson.M, page *string, size int) ([]models.Post, *string, error) {
+	if page != nil {
+		pageId, err := primitive.ObjectIDFromHex(*page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid page %s: %w", *page, storage.ClientError)
+		}
+		filter["_id"] = bson.M{"$lte": pageId}
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	queryOptions.SetLimit(int64(size + 1))
+	cursor, err := s.mongo.posts.Find(ctx, filter, queryOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find posts: %s %w", err.Error(), storage.InternalError)
+	}
+	var posts []Post
+	if err = cursor.All(ctx, &posts); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+
+	result := make([]models.Post, 0, size)
+	for i := range posts {
+		if len(result) == size {
+			nextPage := posts[i].Id.Hex()
+			return result, &nextPage, nil
+		}
+		result = append(result, &posts[i])
+	}
+	return result, nil, nil
+}
+
+func (s *MongoStorageWithBroker) AddPost(
+	ctx context.Context, userId string, text string, postOptions storage.PostOptions) (models.Post, error) {
+	if postOptions.ReplyToPostId != nil && postOptions.RepostOfPostId != nil {
+		return nil, fmt.Errorf("post cannot be both a reply and a repost: %w", storage.ClientError)
+	}
+	recordedAt := time.Now()
+	now := recordedAt.UTC().Format(time.RFC3339)
 	post := Post{
 		Text:           text,
 		AuthorId:       userId,
 		CreatedAt:      now,
 		LastModifiedAt: now,
 		Version:        0,
+		Hashtags:       storage.ExtractHashtags(text),
 	}
-	id, err := s.mongo.posts.InsertOne(ctx, post)
+	post.HashtagUses, _, _ = storage.UpdateHashtagUses(nil, nil, post.Hashtags, recordedAt)
+	mentions, err := s.resolveMentions(ctx, text, userId)
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert post: %s %w", err.Error(), storage.InternalError)
+		return nil, err
 	}
-	post.Id = id.InsertedID.(primitive.ObjectID)
-
-	task := createAddPostTask(post.Id, post.AuthorId)
-	_, err = s.broker.SendTaskWithContext(context.Background(), &task)
+	post.Mentions = mentions
+	err = s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		fanoutOnRead, err := s.isHighFollowerAuthor(sessCtx, userId)
+		if err != nil {
+			return err
+		}
+		// plain reposts are shown as the reposted posts, they are fanned out on write only
+		fanoutOnRead = fanoutOnRead && !(postOptions.RepostOfPostId != nil && text == "")
+		post.FanoutOnRead = fanoutOnRead
+		if postOptions.ReplyToPostId != nil {
+			if err = s.setReplyTo(sessCtx, &post, *postOptions.ReplyToPostId); err != nil {
+				return err
+			}
+		}
+		if postOptions.RepostOfPostId != nil {
+			if err = s.setRepostOf(sessCtx, &post, *postOptions.RepostOfPostId); err != nil {
+				return err
+			}
+		}
+		id, err := s.mongo.posts.InsertOne(sessCtx, post)
+		if err != nil {
+			return fmt.Errorf("failed to insert post: %s %w", err.Error(), storage.InternalError)
+		}
+		post.Id = id.InsertedID.(primitive.ObjectID)
+		if fanoutOnRead {
+			if err = s.markFanoutOnReadAuthor(sessCtx, userId); err != nil {
+				return err
+			}
+		}
+		// posts merged into feeds on read are not fanned out, but still streamed to connected readers
+		return s.enqueue(sessCtx, createAddPostTask(post.Id, post.AuthorId))
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not send task: %s %w", err.Error(), storage.InternalError)
+		return nil, err
 	}
-	//results, err := asyncResult.Get(time.Duration(1 * time.Second))
-	//if err != nil {
-	//	return fmt.Errorf("getting task result failed with error: %s", err.Error())
-	//}
-	//log.Printf("%v\n", tasks.HumanReadableResults(results))
+	storage.RecordHashtagChanges(ctx, s.trending, post.GetId(), post.Hashtags, recordedAt, nil)
 	return &post, nil
 }
 
 func (s *MongoStorageWithBroker) GetPost(ctx context.Context, postId string) (models.Post, error) {
+	return s.findPost(ctx, postId)
+}
+
+func (s *MongoStorageWithBroker) findPost(ctx context.Context, postId string) (*Post, error) {
 	var result Post
 	postMongoId, err := primitive.ObjectIDFromHex(postId)
 	if err != nil {
@@ -364,67 +714,160 @@ func (s *MongoStorageWithBroker) GetPost(ctx context.Context, postId string) (mo
 }
 
 func (s *MongoStorageWithBroker) UpdateFeedNewSubscription(ctx context.Context, userId string, posts []models.Post) error {
-	var feedItems []interface{}
+	boundary, err := s.feedBoundary(ctx, userId)
+	if err != nil {
+		return err
+	}
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	following := userSet(subscriptions)
+	var feedItems []FeedItem
+	var reposts []*Post
 	for _, post := range posts {
+		p, ok := post.(*Post)
+		if ok && storage.IsPlainRepost(p) {
+			reposts = append(reposts, p)
+			continue
+		}
+		if ok && (p.FanoutOnRead || !p.inFeedOf(userId, following)) {
+			continue
+		}
 		postId, _ := primitive.ObjectIDFromHex(post.GetId())
-		feedItem := FeedItem{
-			UserId:         userId,
-			PostId:         postId,
-			Text:           post.GetText(),
-			AuthorId:       post.GetAuthorId(),
-			CreatedAt:      post.GetCreatedAt(),
-			LastModifiedAt: post.GetLastModifiedAt(),
+		if postId.Hex() <= boundary.Hex() {
+			// trimmed part of the feed is read from the authors' posts
+			continue
 		}
-		feedItems = append(feedItems, feedItem)
+		feedItems = append(feedItems, newFeedItem(userId, post))
 	}
-	if len(feedItems) == 0 {
+	if len(feedItems) > 0 {
+		if _, err = s.upsertFeedItems(ctx, feedItems); err != nil {
+			return err
+		}
+	}
+	// reposted posts are added after the author's own posts, which they must not override
+	for _, repost := range reposts {
+		if _, _, err = s.updateFeedNewRepost(ctx, repost, []string{userId}); err != nil {
+			return err
+		}
+	}
+	if len(feedItems) == 0 && len(reposts) == 0 {
 		log.Printf("Update feed: nothing to insert")
 		return nil
 	}
-	// TODO: upsert instead of insert
-	_, err := s.mongo.feed.InsertMany(ctx, feedItems)
+	_, err = s.trimFeed(ctx, userId)
+	return err
+}
+
+func (s *MongoStorageWithBroker) UpdateFeedRemoveSubscription(ctx context.Context, userId string, authorId string) (int, error) {
+	filter := bson.M{"userId": userId, "$or": bson.A{
+		bson.M{"authorId": authorId, "repostedBy": bson.M{"$exists": false}},
+		bson.M{"repostedBy": authorId},
+	}}
+	removed, err := s.mongo.feed.Distinct(ctx, "postId", filter)
 	if err != nil {
-		return fmt.Errorf("failed to insert post: %s %w", err.Error(), storage.InternalError)
+		return 0, fmt.Errorf("failed to find author's feed items: %s %w", err.Error(), storage.InternalError)
 	}
-	return nil
+	deleteResult, err := s.mongo.feed.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete author's posts from feed: %s %w", err.Error(), storage.InternalError)
+	}
+	// both the author's posts and the posts the author reposted may be reposted by other followed authors
+	postIds := make([]string, 0, len(removed))
+	for _, postId := range removed {
+		if id, ok := postId.(primitive.ObjectID); ok {
+			postIds = append(postIds, id.Hex())
+		}
+	}
+	if err = s.restoreFollowedReposts(ctx, userId, postIds); err != nil {
+		return 0, err
+	}
+	return int(deleteResult.DeletedCount), nil
 }
 
 func (s *MongoStorageWithBroker) UpdateFeedNewPost(ctx context.Context, postId string, subscribers []string) (int, error) {
-	post, err := s.GetPost(ctx, postId)
+	post, err := s.findPost(ctx, postId)
 	if err != nil {
-		return 0, fmt.Errorf("update feed: failed to get post by id: %s %w", err.Error(), storage.InternalError)
+		return 0, fmt.Errorf("update feed: failed to get post by id: %w", err)
+	}
+	s.publishNewPostNotifications(ctx, post)
+	if post.FanoutOnRead {
+		log.Printf("Update feed: post %s is merged into feeds on read", postId)
+		s.publishAuthorPost(ctx, post)
+		return 0, nil
+	}
+	if storage.IsPlainRepost(post) {
+		reposted, readers, err := s.updateFeedNewRepost(ctx, post, subscribers)
+		if err != nil {
+			return 0, err
+		}
+		if reposted != nil {
+			s.publishFeedPost(ctx, reposted, readers)
+		}
+		return len(readers), nil
 	}
 
-	var feedItems []interface{}
-	for _, subscriber := range subscribers {
-		postId, _ := primitive.ObjectIDFromHex(post.GetId())
-		feedItem := FeedItem{
-			UserId:         subscriber,
-			PostId:         postId,
-			Text:           post.GetText(),
-			AuthorId:       post.GetAuthorId(),
-			CreatedAt:      post.GetCreatedAt(),
-			LastModifiedAt: post.GetLastModifiedAt(),
+	if post.ReplyToAuthorId != "" {
+		if subscribers, err = s.followersOf(ctx, post.ReplyToAuthorId, subscribers); err != nil {
+			return 0, err
 		}
-		feedItems = append(feedItems, feedItem)
+	}
+	var feedItems []FeedItem
+	for _, subscriber := range subscribers {
+		feedItems = append(feedItems, newFeedItem(subscriber, post))
 	}
 	if len(feedItems) == 0 {
 		log.Printf("Update feed: nothing to insert")
 		return 0, nil
 	}
-	// TODO: upsert instead of insert
-	ids, err := s.mongo.feed.InsertMany(ctx, feedItems)
-	log.Printf("update feed - added post: Inserted %s feedItems", ids)
+	upserted, err := s.upsertFeedItems(ctx, feedItems)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert post: %s %w", err.Error(), storage.InternalError)
+		return 0, err
+	}
+	log.Printf("update feed - added post: Upserted %d feedItems", len(upserted))
+	readers := make([]string, 0, len(upserted))
+	for _, feedItem := range upserted {
+		readers = append(readers, feedItem.UserId)
 	}
+	if _, err = s.trimFeedsOf(ctx, readers); err != nil {
+		return 0, err
+	}
+	s.publishFeedPost(ctx, post, readers)
 	return len(feedItems), nil
 }
 
+// upsertFeedItems writes feed items keyed by (userId, postId), so replaying
+// a fan-out task does not create duplicates. Returns the items that were not in the feeds.
+func (s *MongoStorageWithBroker) upsertFeedItems(ctx context.Context, feedItems []FeedItem) ([]FeedItem, error) {
+	writes := make([]mongo.WriteModel, 0, len(feedItems))
+	for _, feedItem := range feedItems {
+		update := bson.M{"$set": feedItem}
+		if feedItem.RepostedBy == "" {
+			// the post reached the feed from its author, a repost brought it before
+			update["$unset"] = bson.M{"repostedBy": ""}
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"userId": feedItem.UserId, "postId": feedItem.PostId}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+	result, err := s.mongo.feed.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to upsert feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	// UpsertedIDs is keyed by indices of the writes
+	upserted := make([]FeedItem, 0, len(result.UpsertedIDs))
+	for i := range result.UpsertedIDs {
+		upserted = append(upserted, feedItems[i])
+	}
+	return upserted, nil
+}
+
 func (s *MongoStorageWithBroker) UpdateFeedPatchPost(ctx context.Context, postId string) (int, error) {
 	post, err := s.GetPost(ctx, postId)
 	if err != nil {
-		return 0, fmt.Errorf("update feed: failed to get post by id: %s %w", err.Error(), storage.InternalError)
+		return 0, fmt.Errorf("update feed: failed to get post by id: %w", err)
 	}
 	postObjId, _ := primitive.ObjectIDFromHex(postId)
 	filter := bson.M{"postId": postObjId}
@@ -432,16 +875,58 @@ func (s *MongoStorageWithBroker) UpdateFeedPatchPost(ctx context.Context, postId
 		"$set": bson.M{
 			"text":           post.GetText(),
 			"lastModifiedAt": post.GetLastModifiedAt(),
+			"likeCount":      post.GetLikeCount(),
+			"reactionCounts": post.GetReactionCounts(),
+			"replyCount":     post.GetReplyCount(),
+			"repostCount":    post.GetRepostCount(),
+			"quoteCount":     post.GetQuoteCount(),
+			"hashtags":       post.GetHashtags(),
+			"mentions":       post.GetMentions(),
 		},
 	}
 	ids, err := s.mongo.feed.UpdateMany(ctx, filter, updateInfo)
-	log.Printf("update feed - patched post: Updated %d feedItems: %s", ids.ModifiedCount, ids)
+	log.Printf("update feed - patched post: Updated %d feedItems", ids.ModifiedCount)
 	if err != nil {
 		return 0, fmt.Errorf("failed to patch post: %s %w", err.Error(), storage.InternalError)
 	}
+	s.publishPostUpdate(ctx, post)
 	return int(ids.ModifiedCount), nil
 }
 
+// UpdateFeedPostReactions copies the reaction counters of the post to its feed items.
+func (s *MongoStorageWithBroker) UpdateFeedPostReactions(ctx context.Context, postId string) (int, error) {
+	post, err := s.GetPost(ctx, postId)
+	if err != nil {
+		return 0, fmt.Errorf("update feed: failed to get post by id: %w", err)
+	}
+	postObjId, _ := primitive.ObjectIDFromHex(postId)
+	updateInfo := bson.M{
+		"$set": bson.M{
+			"likeCount":      post.GetLikeCount(),
+			"reactionCounts": post.GetReactionCounts(),
+		},
+	}
+	ids, err := s.mongo.feed.UpdateMany(ctx, bson.M{"postId": postObjId}, updateInfo)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update post reactions: %s %w", err.Error(), storage.InternalError)
+	}
+	log.Printf("update feed - post reactions: Updated %d feedItems", ids.ModifiedCount)
+	s.publishPostUpdate(ctx, post)
+	return int(ids.ModifiedCount), nil
+}
+
+func (s *MongoStorageWithBroker) UpdateFeedDeletePost(ctx context.Context, postId string) (int, error) {
+	postObjId, _ := primitive.ObjectIDFromHex(postId)
+	filter := bson.M{"postId": postObjId}
+	deleteResult, err := s.mongo.feed.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete post from feed: %s %w", err.Error(), storage.InternalError)
+	}
+	log.Printf("update feed - deleted post: Deleted %d feedItems", deleteResult.DeletedCount)
+	s.publishPostDeleted(ctx, postId)
+	return int(deleteResult.DeletedCount), nil
+}
+
 var mongoStorage *MongoStorage
 var mongoStorageWithoutBroker *MongoStorageWithBroker
 var onceMongo sync.Once
@@ -458,27 +943,51 @@ func CreateMongoStorage(dbUrl, dbName string) *MongoStorage {
 		posts := client.Database(dbName).Collection("posts")
 		subscriptions := client.Database(dbName).Collection("subscriptions")
 		feed := client.Database(dbName).Collection("feed")
+		outbox := client.Database(dbName).Collection("outbox")
+		resumeTokens := client.Database(dbName).Collection("resumeTokens")
+		userStats := client.Database(dbName).Collection("userStats")
+		users := client.Database(dbName).Collection("users")
+		revisions := client.Database(dbName).Collection("revisions")
+		reactions := client.Database(dbName).Collection("reactions")
+		migrations := client.Database(dbName).Collection("migrations")
+		searchResults := client.Database(dbName).Collection("searchResults")
+		notifiedPosts := client.Database(dbName).Collection("notifiedPosts")
+		leases := client.Database(dbName).Collection("leases")
 		ensurePostsIndexes(ctx, posts)
 		ensureFeedIndexes(ctx, feed)
 		ensureSubscriptionsIndexes(ctx, subscriptions)
+		ensureUserStatsIndexes(ctx, userStats)
+		ensureUsersIndexes(ctx, users)
+		ensureRevisionsIndexes(ctx, revisions)
+		ensureReactionsIndexes(ctx, reactions)
+		ensureOutboxIndexes(ctx, outbox)
+		ensureSearchResultsIndexes(ctx, searchResults)
+		ensureNotifiedPostsIndexes(ctx, notifiedPosts)
 		mongoStorage = &MongoStorage{
+			client:        client,
 			posts:         posts,
 			subscriptions: subscriptions,
 			feed:          feed,
+			outbox:        outbox,
+			resumeTokens:  resumeTokens,
+			userStats:     userStats,
+			users:         users,
+			revisions:     revisions,
+			reactions:     reactions,
+			migrations:    migrations,
+			searchResults: searchResults,
+			notifiedPosts: notifiedPosts,
+			leases:        leases,
 		}
+		runMigrations(ctx, mongoStorage)
 	})
 	return mongoStorage
 }
 
-func CreateMongoStorageWithBroker(dbUrl, dbName, brokerUrl string) *MongoStorageWithBroker {
-	broker, err := startBroker(brokerUrl)
-	if err != nil {
-		panic("Failed to start broker: " + err.Error())
-	}
-
+func CreateMongoStorageWithBroker(dbUrl, dbName string, feedConfig FeedConfig) *MongoStorageWithBroker {
 	return &MongoStorageWithBroker{
-		mongo:  CreateMongoStorage(dbUrl, dbName),
-		broker: broker,
+		mongo:      CreateMongoStorage(dbUrl, dbName),
+		feedConfig: feedConfig,
 	}
 }
 
@@ -486,10 +995,11 @@ func GetMongoStorageWithoutBroker() *MongoStorageWithBroker {
 	onceStorage.Do(func() {
 		mongoUrl := utils.GetEnvVar("MONGO_URL")
 		mongoDbName := utils.GetEnvVar("MONGO_DBNAME")
-		mongoStorageWithoutBroker = &MongoStorageWithBroker{
-			mongo:  CreateMongoStorage(mongoUrl, mongoDbName),
-			broker: nil,
+		feedConfig, err := FeedConfigFromEnv()
+		if err != nil {
+			panic(err)
 		}
+		mongoStorageWithoutBroker = CreateMongoStorageWithBroker(mongoUrl, mongoDbName, feedConfig)
 	})
 	return mongoStorageWithoutBroker
 }
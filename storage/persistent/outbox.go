@@ -0,0 +1,244 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+	"time"
+)
+
+const (
+	OUTBOX_BATCH_SIZE  int           = 100
+	OUTBOX_POLL_PERIOD time.Duration = 500 * time.Millisecond
+	// OUTBOX_MAX_ATTEMPTS is the number of failed runs after which an entry is not retried.
+	// Only failures reported by the queue count, the machinery queue reports none (see MachineryTaskQueue.Wait)
+	OUTBOX_MAX_ATTEMPTS int = 10
+	// OUTBOX_RELAY_LEASE is how long a replica relays the outbox after it was the last to renew the lease.
+	// Only the holder of the lease relays, so entries are not published by several replicas at once
+	OUTBOX_RELAY_LEASE    time.Duration = 30 * time.Second
+	OUTBOX_RELAY_LEASE_ID string        = "outboxRelay"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxDone    = "done"
+	// OutboxFailed entries are not retried, they are kept with their error for investigation
+	OutboxFailed = "failed"
+)
+
+// OutboxEntry is a feed task waiting to be published to the broker.
+// All feed tasks take string arguments only.
+type OutboxEntry struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty"`
+	Task        string             `bson:"task"`
+	Args        []string           `bson:"args"`
+	Status      string             `bson:"status"`
+	CreatedAt   time.Time          `bson:"createdAt"`
+	ProcessedAt *time.Time         `bson:"processedAt,omitempty"`
+	Attempts    int                `bson:"attempts,omitempty"`
+	Error       string             `bson:"error,omitempty"`
+}
+
+func newOutboxEntry(task tasks.Signature) OutboxEntry {
+	args := make([]string, 0, len(task.Args))
+	for _, arg := range task.Args {
+		args = append(args, arg.Value.(string))
+	}
+	return OutboxEntry{
+		Task:      task.Name,
+		Args:      args,
+		Status:    OutboxPending,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func (e *OutboxEntry) signature() tasks.Signature {
+	args := make([]tasks.Arg, 0, len(e.Args))
+	for _, arg := range e.Args {
+		args = append(args, tasks.Arg{Type: "string", Value: arg})
+	}
+	return tasks.Signature{
+		Name: e.Task,
+		Args: args,
+	}
+}
+
+func (s *MongoStorageWithBroker) withTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	session, err := s.mongo.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %s %w", err.Error(), storage.InternalError)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
+
+// enqueue stores task in the outbox. Must be called inside the transaction
+// that makes the change the task is caused by.
+func (s *MongoStorageWithBroker) enqueue(sessCtx mongo.SessionContext, task tasks.Signature) error {
+	if s.feedConfig.Source == ChangeStreamFeedSource && changeStreamTasks[task.Name] {
+		return nil
+	}
+	return s.insertOutboxEntry(sessCtx, task)
+}
+
+// insertOutboxEntry stores task in the outbox whatever the feed source is.
+func (s *MongoStorageWithBroker) insertOutboxEntry(sessCtx mongo.SessionContext, task tasks.Signature) error {
+	_, err := s.mongo.outbox.InsertOne(sessCtx, newOutboxEntry(task))
+	if err != nil {
+		return fmt.Errorf("failed to insert %s task to outbox: %s %w", task.Name, err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// relayOutboxBatch sends pending outbox entries to queue in insertion order and marks every entry done
+// once queue has taken it over and reported no failure. Returns the number of relayed entries.
+func (s *MongoStorageWithBroker) relayOutboxBatch(ctx context.Context, queue TaskQueue) (int, error) {
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: 1}})
+	queryOptions.SetLimit(int64(OUTBOX_BATCH_SIZE))
+	cursor, err := s.mongo.outbox.Find(ctx, bson.M{"status": OutboxPending}, queryOptions)
+	if err != nil {
+		return 0, fmt.Errorf("outbox: failed to find pending entries: %s %w", err.Error(), storage.InternalError)
+	}
+	var entries []OutboxEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return 0, fmt.Errorf("outbox: decode error: %s %w", err.Error(), storage.InternalError)
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	// entries that were not sent stay pending and are sent again, feed tasks are idempotent
+	sent := entries
+	for i, entry := range entries {
+		err = queue.Send(ctx, entry.signature())
+		if err != nil {
+			log.Printf("outbox: could not send %s task: %s", entry.Task, err.Error())
+			sent = entries[:i]
+			break
+		}
+	}
+	results, err := queue.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("outbox: tasks were not handed over: %s %w", err.Error(), storage.InternalError)
+	}
+
+	done := make([]primitive.ObjectID, 0, len(sent))
+	for i, entry := range sent {
+		switch {
+		case results[i] == nil:
+			done = append(done, entry.Id)
+		case errors.Is(results[i], skippedTaskError):
+			// not run at all, so it is not an attempt
+		default:
+			if err = s.failOutboxEntry(ctx, entry, results[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(done) == 0 {
+		return 0, nil
+	}
+
+	_, err = s.mongo.outbox.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": done}},
+		bson.M{"$set": bson.M{"status": OutboxDone, "processedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return 0, fmt.Errorf("outbox: failed to mark entries done: %s %w", err.Error(), storage.InternalError)
+	}
+	return len(done), nil
+}
+
+// failOutboxEntry counts the failed attempt of entry. Entries failed with a permanent error or
+// too many times are marked failed, so they do not hold back the following tasks.
+func (s *MongoStorageWithBroker) failOutboxEntry(ctx context.Context, entry OutboxEntry, taskErr error) error {
+	set := bson.M{"error": taskErr.Error()}
+	permanent := errors.Is(taskErr, invalidTaskError) || errors.Is(taskErr, storage.ClientError)
+	if permanent || entry.Attempts+1 >= OUTBOX_MAX_ATTEMPTS {
+		log.Printf("outbox: %s task %s failed after %d attempts: %s", entry.Task, entry.Id.Hex(), entry.Attempts+1, taskErr.Error())
+		set["status"] = OutboxFailed
+	}
+	_, err := s.mongo.outbox.UpdateOne(
+		ctx,
+		bson.M{"_id": entry.Id},
+		bson.M{"$set": set, "$inc": bson.M{"attempts": 1}},
+	)
+	if err != nil {
+		return fmt.Errorf("outbox: failed to record failed entry: %s %w", err.Error(), storage.InternalError)
+	}
+	return nil
+}
+
+// RelayOutbox sends outbox entries to queue until ctx is done.
+// Replicas compete for the outbox relay lease, entries are relayed by its holder only.
+func RelayOutbox(ctx context.Context, queue TaskQueue) {
+	mongo := GetMongoStorageWithoutBroker()
+	owner := primitive.NewObjectID().Hex()
+	defer func() {
+		if err := mongo.releaseLease(context.Background(), OUTBOX_RELAY_LEASE_ID, owner); err != nil {
+			log.Printf("Outbox: %s", err.Error())
+		}
+	}()
+	for {
+		relayed := 0
+		leader, err := mongo.acquireLease(ctx, OUTBOX_RELAY_LEASE_ID, owner, OUTBOX_RELAY_LEASE)
+		if err != nil {
+			log.Printf("Outbox: %s", err.Error())
+		}
+		if leader {
+			relayed, err = mongo.relayOutboxBatchWithLease(ctx, queue, owner)
+			if err != nil {
+				log.Printf("Failed to relay outbox: %s", err.Error())
+			} else if relayed > 0 {
+				log.Printf("Relayed %d outbox entries", relayed)
+			}
+		}
+		if relayed == OUTBOX_BATCH_SIZE {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(OUTBOX_POLL_PERIOD):
+		}
+	}
+}
+
+// relayOutboxBatchWithLease relays a batch and renews the relay lease of owner while the batch runs.
+// The batch itself is not interrupted when the lease is lost: its entries are not marked done yet,
+// so the next holder sends them again, feed tasks are idempotent.
+func (s *MongoStorageWithBroker) relayOutboxBatchWithLease(ctx context.Context, queue TaskQueue, owner string) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(OUTBOX_RELAY_LEASE / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				leader, err := s.acquireLease(ctx, OUTBOX_RELAY_LEASE_ID, owner, OUTBOX_RELAY_LEASE)
+				if err != nil {
+					log.Printf("Outbox: %s", err.Error())
+				} else if !leader {
+					log.Printf("Outbox: relay lease was taken over by another replica during the batch")
+				}
+			}
+		}
+	}()
+	return s.relayOutboxBatch(ctx, queue)
+}
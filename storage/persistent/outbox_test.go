@@ -0,0 +1,99 @@
+package persistent
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miniblog/storage"
+	"testing"
+	"time"
+)
+
+func TestWritesEnqueueOutboxEntries(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	subscriber := primitive.NewObjectID().Hex()
+	post, err := s.AddPost(ctx, author, "text", storage.PostOptions{})
+	require.NoError(t, err)
+	_, err = s.PatchPost(ctx, post.GetId(), author, "patched", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.Subscribe(ctx, author, subscriber))
+	// repeated subscription does not enqueue another task
+	require.NoError(t, s.Subscribe(ctx, author, subscriber))
+
+	cursor, err := s.mongo.outbox.Find(ctx, bson.M{"args": bson.M{"$in": []string{author, subscriber}}})
+	require.NoError(t, err)
+	var entries []OutboxEntry
+	require.NoError(t, cursor.All(ctx, &entries))
+
+	tasks := make([]string, 0)
+	for _, entry := range entries {
+		require.Equal(t, OutboxPending, entry.Status)
+		tasks = append(tasks, entry.Task)
+	}
+	require.ElementsMatch(t, []string{"addPost", "addSubscription"}, tasks)
+
+	_, err = s.PatchPost(ctx, post.GetId(), subscriber, "forbidden", nil)
+	require.Error(t, err)
+	count, err := s.mongo.outbox.CountDocuments(ctx, bson.M{"task": "patchPost", "args": post.GetId()})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
+
+func TestOutboxRelayLeaseHasSingleOwner(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	leaseId := "test-" + primitive.NewObjectID().Hex()
+	first := primitive.NewObjectID().Hex()
+	second := primitive.NewObjectID().Hex()
+	leader, err := s.acquireLease(ctx, leaseId, first, time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+	leader, err = s.acquireLease(ctx, leaseId, second, time.Minute)
+	require.NoError(t, err)
+	require.False(t, leader)
+	// the owner renews its lease
+	leader, err = s.acquireLease(ctx, leaseId, first, time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+
+	require.NoError(t, s.releaseLease(ctx, leaseId, first))
+	leader, err = s.acquireLease(ctx, leaseId, second, time.Minute)
+	require.NoError(t, err)
+	require.True(t, leader)
+	leader, err = s.acquireLease(ctx, leaseId, first, time.Minute)
+	require.NoError(t, err)
+	require.False(t, leader)
+}
+
+func TestUnsubscribeEnqueuesRemovalOfLegacySubscriptionsOnly(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	keyed := primitive.NewObjectID().Hex()
+	legacy := primitive.NewObjectID().Hex()
+	require.NoError(t, s.Subscribe(ctx, author, keyed))
+	var subscription Subscription
+	require.NoError(t, s.mongo.subscriptions.FindOne(ctx, bson.M{"userId": keyed}).Decode(&subscription))
+	require.NotNil(t, subscription.Id)
+	_, isLegacy := subscription.Id.(primitive.ObjectID)
+	require.False(t, isLegacy)
+	_, err := s.mongo.subscriptions.InsertOne(ctx, Subscription{UserId: legacy, SubscriptionId: author})
+	require.NoError(t, err)
+
+	changeStream := &MongoStorageWithBroker{mongo: s.mongo, feedConfig: FeedConfig{Source: ChangeStreamFeedSource}}
+	require.NoError(t, changeStream.Unsubscribe(ctx, author, keyed))
+	require.NoError(t, changeStream.Unsubscribe(ctx, author, legacy))
+
+	count, err := s.mongo.outbox.CountDocuments(ctx, bson.M{"task": "removeSubscription", "args": author})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+	count, err = s.mongo.outbox.CountDocuments(ctx, bson.M{"task": "removeSubscription", "args": legacy})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, count)
+}
@@ -0,0 +1,178 @@
+package persistent
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miniblog/storage"
+	"testing"
+)
+
+func TestPatchPostChecksVersion(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	post, err := s.AddPost(ctx, author, "text", storage.PostOptions{})
+	require.NoError(t, err)
+
+	version := int64(0)
+	patched, err := s.PatchPost(ctx, post.GetId(), author, "first", &version)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, patched.GetVersion())
+
+	_, err = s.PatchPost(ctx, post.GetId(), author, "second", &version)
+	require.ErrorIs(t, err, storage.PreconditionFailed)
+	_, err = s.PatchPost(ctx, post.GetId(), primitive.NewObjectID().Hex(), "forbidden", &version)
+	require.ErrorIs(t, err, storage.Forbidden)
+
+	version = patched.GetVersion()
+	_, err = s.PatchPost(ctx, post.GetId(), author, "second", &version)
+	require.NoError(t, err)
+}
+
+func TestPatchPostStoresRevisions(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	author := primitive.NewObjectID().Hex()
+	post, err := s.AddPost(ctx, author, "v0", storage.PostOptions{})
+	require.NoError(t, err)
+	for _, text := range []string{"v1", "v2"} {
+		_, err = s.PatchPost(ctx, post.GetId(), author, text, nil)
+		require.NoError(t, err)
+	}
+
+	revisions, nextPage, err := s.GetRevisions(ctx, post.GetId(), nil, 1)
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	require.Equal(t, "v1", revisions[0].GetText())
+	require.NotNil(t, nextPage)
+	revisions, nextPage, err = s.GetRevisions(ctx, post.GetId(), nextPage, 1)
+	require.NoError(t, err)
+	require.Equal(t, "v0", revisions[0].GetText())
+	require.EqualValues(t, 0, revisions[0].GetVersion())
+	require.Nil(t, nextPage)
+}
+
+func TestPostsByHashtagFollowPatches(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// hashtags are unique per run, since the test database is not cleaned
+	hashtag := "tag" + primitive.NewObjectID().Hex()
+	author := primitive.NewObjectID().Hex()
+	first, err := s.AddPost(ctx, author, "#"+hashtag, storage.PostOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{hashtag}, first.GetHashtags())
+	second, err := s.AddPost(ctx, author, "#"+hashtag+" again", storage.PostOptions{})
+	require.NoError(t, err)
+
+	posts, nextPage, err := s.GetPostsByHashtag(ctx, hashtag, nil, 1)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	require.Equal(t, second.GetId(), posts[0].GetId())
+	require.NotNil(t, nextPage)
+	posts, nextPage, err = s.GetPostsByHashtag(ctx, hashtag, nextPage, 1)
+	require.NoError(t, err)
+	require.Equal(t, first.GetId(), posts[0].GetId())
+	require.Nil(t, nextPage)
+
+	_, err = s.PatchPost(ctx, second.GetId(), author, "no hashtags", nil)
+	require.NoError(t, err)
+	posts, _, err = s.GetPostsByHashtag(ctx, hashtag, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	require.Equal(t, first.GetId(), posts[0].GetId())
+}
+
+func TestPatchPostUpdatesMentions(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	mentioned := primitive.NewObjectID().Hex()
+	handle := "u" + mentioned[len(mentioned)-12:]
+	_, err := s.CreateUser(ctx, mentioned, storage.UserProfile{Handle: &handle})
+	require.NoError(t, err)
+	other := primitive.NewObjectID().Hex()
+	author := primitive.NewObjectID().Hex()
+
+	post, err := s.AddPost(ctx, author, "hi @"+handle+" and @"+other, storage.PostOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{mentioned, other}, post.GetMentions())
+	posts, _, err := s.GetPostsMentioning(ctx, mentioned, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+
+	_, err = s.PatchPost(ctx, post.GetId(), author, "hi @"+other, nil)
+	require.NoError(t, err)
+	posts, _, err = s.GetPostsMentioning(ctx, mentioned, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, posts)
+	posts, _, err = s.GetPostsMentioning(ctx, other, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+}
+
+func TestSearchPostsRanksByRelevance(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// words are unique per run, since the test database is not cleaned
+	word := "w" + primitive.NewObjectID().Hex()
+	author := primitive.NewObjectID().Hex()
+	frequent, err := s.AddPost(ctx, author, word+" "+word, storage.PostOptions{})
+	require.NoError(t, err)
+	rare, err := s.AddPost(ctx, author, word+" once", storage.PostOptions{})
+	require.NoError(t, err)
+	query := storage.SearchQuery{Terms: []string{word}, AuthorId: author}
+
+	posts, nextPage, err := s.SearchPosts(ctx, query, nil, 1)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	require.Equal(t, frequent.GetId(), posts[0].GetId())
+	require.NotNil(t, nextPage)
+	posts, nextPage, err = s.SearchPosts(ctx, query, nextPage, 1)
+	require.NoError(t, err)
+	require.Equal(t, rare.GetId(), posts[0].GetId())
+	require.Nil(t, nextPage)
+
+	_, err = s.PatchPost(ctx, frequent.GetId(), author, "patched", nil)
+	require.NoError(t, err)
+	require.NoError(t, s.DeletePost(ctx, rare.GetId(), author))
+	posts, _, err = s.SearchPosts(ctx, query, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, posts)
+}
+
+func TestSearchPostsPagesKeepRankingOfFirstPage(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	word := "w" + primitive.NewObjectID().Hex()
+	author := primitive.NewObjectID().Hex()
+	first, err := s.AddPost(ctx, author, word+" "+word+" "+word, storage.PostOptions{})
+	require.NoError(t, err)
+	second, err := s.AddPost(ctx, author, word+" "+word, storage.PostOptions{})
+	require.NoError(t, err)
+	third, err := s.AddPost(ctx, author, word, storage.PostOptions{})
+	require.NoError(t, err)
+	query := storage.SearchQuery{Terms: []string{word}, AuthorId: author}
+
+	posts, nextPage, err := s.SearchPosts(ctx, query, nil, 1)
+	require.NoError(t, err)
+	require.Equal(t, first.GetId(), posts[0].GetId())
+
+	// posts written after the first page are not ranked into the next pages, deleted posts are skipped
+	_, err = s.AddPost(ctx, author, word+" "+word+" "+word+" "+word, storage.PostOptions{})
+	require.NoError(t, err)
+	require.NoError(t, s.DeletePost(ctx, second.GetId(), author))
+	posts, nextPage, err = s.SearchPosts(ctx, query, nextPage, 1)
+	require.NoError(t, err)
+	require.Len(t, posts, 1)
+	require.Equal(t, third.GetId(), posts[0].GetId())
+	require.Nil(t, nextPage)
+
+	_, _, err = s.SearchPosts(ctx, query, &word, 1)
+	require.ErrorIs(t, err, storage.ClientError)
+}
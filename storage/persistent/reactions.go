@@ -0,0 +1,132 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"time"
+)
+
+type Reaction struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty"`
+	PostId    primitive.ObjectID `bson:"postId"`
+	UserId    string             `bson:"userId"`
+	Reaction  string             `bson:"reaction"`
+	CreatedAt string             `bson:"createdAt"`
+}
+
+// counterField is the post field counting reaction.
+func counterField(reaction string) string {
+	if reaction == storage.Like {
+		return "likeCount"
+	}
+	return "reactionCounts." + reaction
+}
+
+// updateReactionCount changes the post's counter of reaction by delta and schedules
+// the updatePostReactions task copying the counters to feeds.
+func (s *MongoStorageWithBroker) updateReactionCount(
+	sessCtx mongo.SessionContext, postId primitive.ObjectID, reaction string, delta int) error {
+	result, err := s.mongo.posts.UpdateOne(sessCtx, bson.M{"_id": postId}, bson.M{"$inc": bson.M{counterField(reaction): delta}})
+	if err != nil {
+		return fmt.Errorf("failed to update %s count: %s %w", reaction, err.Error(), storage.InternalError)
+	}
+	if result.MatchedCount == 0 {
+		// the post was deleted concurrently, the transaction is aborted so that no reaction is left behind
+		return fmt.Errorf("post %s was deleted: %w", postId.Hex(), storage.NotFoundError)
+	}
+	if delta < 0 && reaction != storage.Like {
+		// keep reactionCounts free of zeros
+		_, err = s.mongo.posts.UpdateOne(
+			sessCtx,
+			bson.M{"_id": postId, counterField(reaction): 0},
+			bson.M{"$unset": bson.M{counterField(reaction): ""}},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update %s count: %s %w", reaction, err.Error(), storage.InternalError)
+		}
+	}
+	return s.enqueue(sessCtx, createUpdatePostReactionsTask(postId))
+}
+
+func (s *MongoStorageWithBroker) AddReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	return s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		post, err := s.findPost(sessCtx, postId)
+		if err != nil {
+			return err
+		}
+		result, err := s.mongo.reactions.UpdateOne(
+			sessCtx,
+			bson.M{"postId": post.Id, "reaction": reaction, "userId": userId},
+			bson.M{"$setOnInsert": bson.M{"createdAt": time.Now().UTC().Format(time.RFC3339)}},
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to add reaction: %s %w", err.Error(), storage.InternalError)
+		}
+		if result.UpsertedCount == 0 {
+			// the user has already reacted
+			return nil
+		}
+		return s.updateReactionCount(sessCtx, post.Id, reaction, 1)
+	})
+}
+
+func (s *MongoStorageWithBroker) RemoveReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	return s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		post, err := s.findPost(sessCtx, postId)
+		if err != nil {
+			return err
+		}
+		result, err := s.mongo.reactions.DeleteOne(sessCtx, bson.M{"postId": post.Id, "reaction": reaction, "userId": userId})
+		if err != nil {
+			return fmt.Errorf("failed to remove reaction: %s %w", err.Error(), storage.InternalError)
+		}
+		if result.DeletedCount == 0 {
+			return nil
+		}
+		return s.updateReactionCount(sessCtx, post.Id, reaction, -1)
+	})
+}
+
+func (s *MongoStorageWithBroker) GetReactions(
+	ctx context.Context, postId string, reaction string, page *string, size int) ([]string, *string, error) {
+	post, err := s.findPost(ctx, postId)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := bson.M{"postId": post.Id, "reaction": reaction}
+	if page != nil {
+		pageId, err := primitive.ObjectIDFromHex(*page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid reactions page %s: %w", *page, storage.ClientError)
+		}
+		filter["_id"] = bson.M{"$lte": pageId}
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: -1}})
+	queryOptions.SetLimit(int64(size + 1))
+	cursor, err := s.mongo.reactions.Find(ctx, filter, queryOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find reactions: %s %w", err.Error(), storage.InternalError)
+	}
+	var reactions []Reaction
+	if err = cursor.All(ctx, &reactions); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+
+	result := make([]string, 0, size)
+	for _, r := range reactions {
+		if len(result) == size {
+			nextPage := r.Id.Hex()
+			return result, &nextPage, nil
+		}
+		result = append(result, r.UserId)
+	}
+	return result, nil, nil
+}
@@ -0,0 +1,207 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+func sameCounters(a *FeedItem, b *FeedItem) bool {
+	if a.LikeCount != b.LikeCount || a.ReplyCount != b.ReplyCount || a.RepostCount != b.RepostCount ||
+		a.QuoteCount != b.QuoteCount || len(a.ReactionCounts) != len(b.ReactionCounts) {
+		return false
+	}
+	for reaction, count := range a.ReactionCounts {
+		if b.ReactionCounts[reaction] != count {
+			return false
+		}
+	}
+	return true
+}
+
+// FeedDiff describes how a user's feed differs from the one computed from subscriptions.
+type FeedDiff struct {
+	UserId string
+	// Missing posts are not in the feed
+	Missing []primitive.ObjectID
+	// Outdated feed items have text, counters or repost attribution different from the expected ones
+	Outdated []primitive.ObjectID
+	// Extra feed items belong to deleted posts or posts of authors the user is not subscribed to
+	Extra []primitive.ObjectID
+}
+
+func (d *FeedDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Outdated) == 0 && len(d.Extra) == 0
+}
+
+// expectedFeedItems computes user's feed from subscriptions and the authors' posts.
+func (s *MongoStorageWithBroker) expectedFeedItems(ctx context.Context, userId string) (map[primitive.ObjectID]FeedItem, error) {
+	boundary, err := s.feedBoundary(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	following := userSet(subscriptions)
+	feedItems := make(map[primitive.ObjectID]FeedItem)
+	var reposts []*Post
+	for _, authorId := range subscriptions {
+		err = s.forEachPostsPage(ctx, authorId, func(posts []models.Post) error {
+			for _, post := range posts {
+				p := post.(*Post)
+				if storage.IsPlainRepost(p) {
+					reposts = append(reposts, p)
+					continue
+				}
+				if p.FanoutOnRead || p.Id.Hex() <= boundary.Hex() || !p.inFeedOf(userId, following) {
+					continue
+				}
+				feedItems[p.Id] = newFeedItem(userId, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// posts of followed authors are not attributed to reposts
+	for _, repost := range reposts {
+		reposted, err := s.findPost(ctx, repost.RepostOfPostId)
+		if errors.Is(err, storage.NotFoundError) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, found := feedItems[reposted.Id]; found || reposted.AuthorId == userId || reposted.Id.Hex() <= boundary.Hex() {
+			continue
+		}
+		if reposted.FanoutOnRead && following[reposted.AuthorId] {
+			continue
+		}
+		feedItem := newFeedItem(userId, reposted)
+		feedItem.RepostedBy = repost.AuthorId
+		feedItems[reposted.Id] = feedItem
+	}
+	return feedItems, nil
+}
+
+// rebuildFeed recomputes user's feed from subscriptions and the authors' posts.
+// In dry run the feed is not changed, only the differences are returned.
+func (s *MongoStorageWithBroker) rebuildFeed(ctx context.Context, userId string, dryRun bool) (FeedDiff, error) {
+	diff := FeedDiff{UserId: userId}
+	expected, err := s.expectedFeedItems(ctx, userId)
+	if err != nil {
+		return diff, err
+	}
+	cursor, err := s.mongo.feed.Find(ctx, bson.M{"userId": userId})
+	if err != nil {
+		return diff, fmt.Errorf("rebuild feed: failed to find feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	var actual []FeedItem
+	if err = cursor.All(ctx, &actual); err != nil {
+		return diff, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+
+	var writes []FeedItem
+	for _, feedItem := range actual {
+		expectedItem, found := expected[feedItem.PostId]
+		if !found {
+			diff.Extra = append(diff.Extra, feedItem.PostId)
+			continue
+		}
+		delete(expected, feedItem.PostId)
+		// any of several reposts may have brought the post
+		reposted := expectedItem.RepostedBy != ""
+		if expectedItem.Text != feedItem.Text || expectedItem.LastModifiedAt != feedItem.LastModifiedAt ||
+			reposted != (feedItem.RepostedBy != "") || !sameCounters(&expectedItem, &feedItem) {
+			diff.Outdated = append(diff.Outdated, feedItem.PostId)
+			writes = append(writes, expectedItem)
+		}
+	}
+	for postId, feedItem := range expected {
+		diff.Missing = append(diff.Missing, postId)
+		writes = append(writes, feedItem)
+	}
+	if dryRun || diff.Empty() {
+		return diff, nil
+	}
+
+	if len(diff.Extra) > 0 {
+		_, err = s.mongo.feed.DeleteMany(ctx, bson.M{"userId": userId, "postId": bson.M{"$in": diff.Extra}})
+		if err != nil {
+			return diff, fmt.Errorf("rebuild feed: failed to delete feed items: %s %w", err.Error(), storage.InternalError)
+		}
+	}
+	if len(writes) > 0 {
+		if _, err = s.upsertFeedItems(ctx, writes); err != nil {
+			return diff, err
+		}
+	}
+	_, err = s.trimFeed(ctx, userId)
+	return diff, err
+}
+
+// feedOwners returns all users having subscriptions or feed items.
+func (s *MongoStorageWithBroker) feedOwners(ctx context.Context) ([]string, error) {
+	users := make(map[string]bool)
+	for _, collection := range []*mongo.Collection{s.mongo.subscriptions, s.mongo.feed} {
+		userIds, err := collection.Distinct(ctx, "userId", bson.M{})
+		if err != nil {
+			return nil, fmt.Errorf("rebuild feed: failed to list users: %s %w", err.Error(), storage.InternalError)
+		}
+		for _, userId := range userIds {
+			if id, ok := userId.(string); ok {
+				users[id] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(users))
+	for userId := range users {
+		result = append(result, userId)
+	}
+	return result, nil
+}
+
+// RebuildFeeds recomputes the feed of userId, or feeds of all users if userId is nil,
+// and logs the differences found. In dry run feeds are not changed.
+func RebuildFeeds(ctx context.Context, userId *string, dryRun bool) error {
+	s := GetMongoStorageWithoutBroker()
+	var userIds []string
+	if userId != nil {
+		userIds = []string{*userId}
+	} else {
+		var err error
+		if userIds, err = s.feedOwners(ctx); err != nil {
+			return err
+		}
+	}
+
+	changed := 0
+	for _, id := range userIds {
+		diff, err := s.rebuildFeed(ctx, id, dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to rebuild feed of user %s: %w", id, err)
+		}
+		if diff.Empty() {
+			continue
+		}
+		changed++
+		log.Printf("Feed of user %s: %d missing %v, %d outdated %v, %d extra %v",
+			id, len(diff.Missing), diff.Missing, len(diff.Outdated), diff.Outdated, len(diff.Extra), diff.Extra)
+	}
+	if dryRun {
+		log.Printf("Dry run: %d of %d feeds differ", changed, len(userIds))
+	} else {
+		log.Printf("Rebuilt %d of %d feeds", changed, len(userIds))
+	}
+	return nil
+}
@@ -2,59 +2,111 @@ package persistent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/RichardKnop/machinery/v1"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/RichardKnop/machinery/v1/tasks"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"reflect"
 )
 
 const (
 	PAGE_SIZE int = 100
+	// MACHINERY_QUEUES is the number of broker queues, every queue is consumed by one task at a time,
+	// so tasks with the same key are run in order
+	MACHINERY_QUEUES int = 4
 )
 
-func addSubscription(userId, subscriber string) (int, error) {
-	addedPostCount := 0
-	mongo := GetMongoStorageWithoutBroker()
-	var page *string
-	page = nil
+// invalidTaskError is returned for a task that can not be run by any attempt: unknown or with wrong args.
+var invalidTaskError = errors.New("invalid task")
 
-	for true {
-		posts, maybePage, err := mongo.GetPostsByUserId(context.Background(), &userId, page, PAGE_SIZE)
+// forEachPostsPage calls fn for every page of author's posts, newest first.
+func (s *MongoStorageWithBroker) forEachPostsPage(ctx context.Context, authorId string, fn func(posts []models.Post) error) error {
+	var page *string
+	for {
+		posts, maybePage, err := s.GetPostsByUserId(ctx, &authorId, page, PAGE_SIZE)
 		if err != nil {
-			log.Printf("Failed to process subscription: %s; %s -> %s", err.Error(), subscriber, userId)
-			return 0, err
+			return err
+		}
+		if err = fn(posts); err != nil {
+			return err
 		}
+		if maybePage == nil {
+			return nil
+		}
+		page = maybePage
+	}
+}
+
+func addSubscription(userId, subscriber string) (int, error) {
+	addedPostCount := 0
+	mongo := GetMongoStorageWithoutBroker()
 
-		err = mongo.UpdateFeedNewSubscription(context.Background(), subscriber, posts)
+	err := mongo.forEachPostsPage(context.Background(), userId, func(posts []models.Post) error {
+		err := mongo.UpdateFeedNewSubscription(context.Background(), subscriber, posts)
 		if err != nil {
-			log.Printf("Failed to process subscription: %s; %s -> %s", err.Error(), subscriber, userId)
-			return 0, err
+			return err
 		}
 		log.Printf("Added %d posts to feed from user %s to subscriber %s", len(posts), userId, subscriber)
-
 		addedPostCount += len(posts)
-		if maybePage != nil {
-			page = maybePage
-		} else {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to process subscription: %s; %s -> %s", err.Error(), subscriber, userId)
+		return 0, err
 	}
 	log.Printf("Added %d feed items for user %s", addedPostCount, subscriber)
+	mongo.publishSubscription(context.Background(), userId, subscriber)
 	return addedPostCount, nil
 }
 
+func removeSubscription(userId, subscriber string) (int, error) {
+	mongo := GetMongoStorageWithoutBroker()
+
+	removedFeedItems, err := mongo.UpdateFeedRemoveSubscription(context.Background(), subscriber, userId)
+	if err != nil {
+		log.Printf("Failed to process unsubscription: %s; %s -> %s", err.Error(), subscriber, userId)
+		return 0, err
+	}
+
+	log.Printf("Removed %d posts from feed from user %s to subscriber %s", removedFeedItems, userId, subscriber)
+	return removedFeedItems, nil
+}
+
 func addPost(postId string, authorId string) (int, error) {
 	mongo := GetMongoStorageWithoutBroker()
 
-	subscribers, err := mongo.GetSubscribers(context.Background(), authorId)
-	log.Printf("Got %d subscribers for post %s: %s", len(subscribers), postId, subscribers)
+	post, err := mongo.findPost(context.Background(), postId)
+	// post was deleted before the task, the deletePost task follows
+	if errors.Is(err, storage.NotFoundError) {
+		log.Printf("Skipped adding deleted post %s to feed", postId)
+		return 0, nil
+	}
 	if err != nil {
 		log.Printf("Failed to process adding post %s to feed: %s", postId, err.Error())
 		return 0, err
 	}
+	var subscribers []string
+	// subscribers of authors whose posts are merged into feeds on read are not needed
+	if !post.FanoutOnRead {
+		subscribers, err = mongo.GetSubscribers(context.Background(), authorId)
+		log.Printf("Got %d subscribers for post %s: %s", len(subscribers), postId, subscribers)
+		if err != nil {
+			log.Printf("Failed to process adding post %s to feed: %s", postId, err.Error())
+			return 0, err
+		}
+	}
 
 	addedFeedItems, err := mongo.UpdateFeedNewPost(context.Background(), postId, subscribers)
+	// post was deleted before the task, the deletePost task follows
+	if errors.Is(err, storage.NotFoundError) {
+		log.Printf("Skipped adding deleted post %s to feed", postId)
+		return 0, nil
+	}
 	if err != nil {
 		log.Printf("Failed to process adding post %s to feed: %s", postId, err.Error())
 		return 0, err
@@ -68,6 +120,11 @@ func patchPost(postId string) (int, error) {
 	mongo := GetMongoStorageWithoutBroker()
 
 	addedFeedItems, err := mongo.UpdateFeedPatchPost(context.Background(), postId)
+	// post was deleted after the change, the deletePost task follows
+	if errors.Is(err, storage.NotFoundError) {
+		log.Printf("Skipped patching deleted post %s in feed", postId)
+		return 0, nil
+	}
 	if err != nil {
 		log.Printf("Failed to process adding post %s to feed: %s", postId, err.Error())
 		return 0, err
@@ -77,6 +134,61 @@ func patchPost(postId string) (int, error) {
 	return addedFeedItems, nil
 }
 
+func updatePostReactions(postId string) (int, error) {
+	mongo := GetMongoStorageWithoutBroker()
+
+	updatedFeedItems, err := mongo.UpdateFeedPostReactions(context.Background(), postId)
+	// post was deleted after the reaction, the deletePost task follows
+	if errors.Is(err, storage.NotFoundError) {
+		log.Printf("Skipped updating reactions of deleted post %s in feed", postId)
+		return 0, nil
+	}
+	if err != nil {
+		log.Printf("Failed to process reactions of post %s: %s", postId, err.Error())
+		return 0, err
+	}
+
+	log.Printf("Updated reactions of %d feed items", updatedFeedItems)
+	return updatedFeedItems, nil
+}
+
+// deletePost takes the post id only, tasks queued by earlier versions also pass the author id, which is ignored.
+func deletePost(postId string, legacyArgs ...string) (int, error) {
+	mongo := GetMongoStorageWithoutBroker()
+
+	deletedFeedItems, err := mongo.UpdateFeedDeletePost(context.Background(), postId)
+	if err != nil {
+		log.Printf("Failed to process deleting post %s from feed: %s", postId, err.Error())
+		return 0, err
+	}
+
+	log.Printf("Deleted %d feed items", deletedFeedItems)
+	return deletedFeedItems, nil
+}
+
+func deleteRepost(postId string, reposter string) (int, error) {
+	mongo := GetMongoStorageWithoutBroker()
+
+	deletedFeedItems, err := mongo.UpdateFeedDeleteRepost(context.Background(), postId, reposter)
+	if err != nil {
+		log.Printf("Failed to process deleting repost of post %s by %s from feed: %s", postId, reposter, err.Error())
+		return 0, err
+	}
+
+	log.Printf("Deleted %d reposted feed items", deletedFeedItems)
+	return deletedFeedItems, nil
+}
+
+var feedTasks = map[string]interface{}{
+	"addSubscription":     addSubscription,
+	"removeSubscription":  removeSubscription,
+	"addPost":             addPost,
+	"patchPost":           patchPost,
+	"updatePostReactions": updatePostReactions,
+	"deletePost":          deletePost,
+	"deleteRepost":        deleteRepost,
+}
+
 func CreateWorker(redisUrl string) error {
 	consumerTag := "machinery_worker"
 
@@ -85,15 +197,53 @@ func CreateWorker(redisUrl string) error {
 		return err
 	}
 
-	worker := broker.NewWorker(consumerTag, 0)
-
 	errorhandler := func(err error) {
 		log.Printf("Something went wrong: %s", err)
 	}
 
-	worker.SetErrorHandler(errorhandler)
+	// the default queue holds tasks sent by earlier versions only
+	workers := []*machinery.Worker{broker.NewWorker(consumerTag, 0)}
+	for i := 0; i < MACHINERY_QUEUES; i++ {
+		workers = append(workers, broker.NewCustomQueueWorker(fmt.Sprintf("%s_%d", consumerTag, i), 1, machineryQueue(i)))
+	}
+
+	go RelayOutbox(context.Background(), &MachineryTaskQueue{server: broker})
+	go TrimFeeds(context.Background())
 
-	return worker.Launch()
+	errorsChan := make(chan error, len(workers))
+	for _, worker := range workers {
+		worker.SetErrorHandler(errorhandler)
+		worker.LaunchAsync(errorsChan)
+	}
+	return <-errorsChan
+}
+
+func machineryQueue(shard int) string {
+	return fmt.Sprintf("machinery_tasks_%d", shard)
+}
+
+// MachineryTaskQueue sends tasks to the Redis broker, they are run by the machinery worker.
+type MachineryTaskQueue struct {
+	server *machinery.Server
+	sent   int
+}
+
+func (q *MachineryTaskQueue) Send(ctx context.Context, task tasks.Signature) error {
+	task.RoutingKey = machineryQueue(taskShard(taskKey(task), MACHINERY_QUEUES))
+	_, err := q.server.SendTaskWithContext(ctx, &task)
+	if err == nil {
+		q.sent++
+	}
+	return err
+}
+
+// Wait returns immediately with a nil result for every sent task: sent tasks are already stored by the broker.
+// Results of the tasks are not tracked, so only publishing to the broker is retried. A task failed in the machinery
+// worker is logged and not run again, OUTBOX_MAX_ATTEMPTS does not apply to it.
+func (q *MachineryTaskQueue) Wait(ctx context.Context) ([]error, error) {
+	results := make([]error, q.sent)
+	q.sent = 0
+	return results, nil
 }
 
 func startBroker(brokerUrl string) (*machinery.Server, error) {
@@ -117,13 +267,29 @@ func startBroker(brokerUrl string) (*machinery.Server, error) {
 		return nil, err
 	}
 
-	// Register tasks
-	tasks := map[string]interface{}{
-		"addSubscription": addSubscription,
-		"addPost":         addPost,
-		"patchPost":       patchPost,
+	return server, server.RegisterTasks(feedTasks)
+}
+
+// runTask runs a feed task in the current process.
+func runTask(task tasks.Signature) error {
+	fn, found := feedTasks[task.Name]
+	if !found {
+		return fmt.Errorf("unknown task %s %w", task.Name, invalidTaskError)
+	}
+	fnValue := reflect.ValueOf(fn)
+	fnType := fnValue.Type()
+	if len(task.Args) != fnType.NumIn() && !(fnType.IsVariadic() && len(task.Args) >= fnType.NumIn()-1) {
+		return fmt.Errorf("task %s expects %d args, got %d %w", task.Name, fnType.NumIn(), len(task.Args), invalidTaskError)
+	}
+	args := make([]reflect.Value, 0, len(task.Args))
+	for _, arg := range task.Args {
+		args = append(args, reflect.ValueOf(arg.Value))
+	}
+	results := fnValue.Call(args)
+	if err, ok := results[len(results)-1].Interface().(error); ok && err != nil {
+		return err
 	}
-	return server, server.RegisterTasks(tasks)
+	return nil
 }
 
 func createAddSubscriptionTask(userId, subscriber string) tasks.Signature {
@@ -143,6 +309,23 @@ func createAddSubscriptionTask(userId, subscriber string) tasks.Signature {
 	return task
 }
 
+func createRemoveSubscriptionTask(userId, subscriber string) tasks.Signature {
+	task := tasks.Signature{
+		Name: "removeSubscription",
+		Args: []tasks.Arg{
+			{
+				Type:  "string",
+				Value: userId,
+			},
+			{
+				Type:  "string",
+				Value: subscriber,
+			},
+		},
+	}
+	return task
+}
+
 func createAddPostTask(postId primitive.ObjectID, authorId string) tasks.Signature {
 	task := tasks.Signature{
 		Name: "addPost",
@@ -172,3 +355,46 @@ func createPatchPostTask(postId primitive.ObjectID) tasks.Signature {
 	}
 	return task
 }
+
+func createUpdatePostReactionsTask(postId primitive.ObjectID) tasks.Signature {
+	task := tasks.Signature{
+		Name: "updatePostReactions",
+		Args: []tasks.Arg{
+			{
+				Type:  "string",
+				Value: postId.Hex(),
+			},
+		},
+	}
+	return task
+}
+
+func createDeletePostTask(postId primitive.ObjectID) tasks.Signature {
+	task := tasks.Signature{
+		Name: "deletePost",
+		Args: []tasks.Arg{
+			{
+				Type:  "string",
+				Value: postId.Hex(),
+			},
+		},
+	}
+	return task
+}
+
+func createDeleteRepostTask(postId primitive.ObjectID, reposter string) tasks.Signature {
+	task := tasks.Signature{
+		Name: "deleteRepost",
+		Args: []tasks.Arg{
+			{
+				Type:  "string",
+				Value: postId.Hex(),
+			},
+			{
+				Type:  "string",
+				Value: reposter,
+			},
+		},
+	}
+	return task
+}
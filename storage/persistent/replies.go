@@ -0,0 +1,137 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+)
+
+func userSet(userIds []string) map[string]bool {
+	result := make(map[string]bool, len(userIds))
+	for _, userId := range userIds {
+		result[userId] = true
+	}
+	return result
+}
+
+// inFeedOf tells if the post belongs to the feed of userId following subscriptions:
+// replies are shown only to readers following the author of the replied post.
+func (p *Post) inFeedOf(userId string, subscriptions map[string]bool) bool {
+	return p.ReplyToAuthorId == "" || p.ReplyToAuthorId == userId || subscriptions[p.ReplyToAuthorId]
+}
+
+// inFeedOfCondition is the "$or" query condition matching posts for which inFeedOf holds.
+func inFeedOfCondition(userId string, subscriptions []string) bson.A {
+	return bson.A{
+		bson.M{"replyToAuthorId": bson.M{"$exists": false}},
+		bson.M{"replyToAuthorId": bson.M{"$in": append([]string{userId}, subscriptions...)}},
+	}
+}
+
+// followersOf returns the users of userIds that are authorId or follow authorId.
+func (s *MongoStorageWithBroker) followersOf(ctx context.Context, authorId string, userIds []string) ([]string, error) {
+	followers, err := s.mongo.subscriptions.Distinct(
+		ctx,
+		"userId",
+		bson.M{"subscriptionId": authorId, "userId": bson.M{"$in": userIds}},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find followers: %s %w", err.Error(), storage.InternalError)
+	}
+	following := make(map[string]bool, len(followers))
+	for _, follower := range followers {
+		if id, ok := follower.(string); ok {
+			following[id] = true
+		}
+	}
+	result := make([]string, 0, len(followers)+1)
+	for _, userId := range userIds {
+		if userId == authorId || following[userId] {
+			result = append(result, userId)
+		}
+	}
+	return result, nil
+}
+
+// setReplyTo makes post a reply to the post with id replyToPostId and counts the reply.
+func (s *MongoStorageWithBroker) setReplyTo(sessCtx mongo.SessionContext, post *Post, replyToPostId string) error {
+	parentId, err := primitive.ObjectIDFromHex(replyToPostId)
+	if err != nil {
+		return fmt.Errorf("failed to convert replied post id to Mongo object id %w", storage.NotFoundError)
+	}
+	var parent Post
+	err = s.mongo.posts.FindOneAndUpdate(
+		sessCtx,
+		bson.M{"_id": parentId},
+		bson.M{"$inc": bson.M{"replyCount": 1}},
+	).Decode(&parent)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("replied post %s not found: %w", replyToPostId, storage.NotFoundError)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update reply count: %s %w", err.Error(), storage.InternalError)
+	}
+	post.ReplyToPostId = replyToPostId
+	post.RootPostId = parent.RootPostId
+	if post.RootPostId == "" {
+		post.RootPostId = replyToPostId
+	}
+	post.ReplyToAuthorId = parent.AuthorId
+	return s.enqueue(sessCtx, createPatchPostTask(parentId))
+}
+
+// updateReplyCount changes the reply count of the post by delta, if the post still exists.
+func (s *MongoStorageWithBroker) updateReplyCount(sessCtx mongo.SessionContext, postId string, delta int) error {
+	postMongoId, _ := primitive.ObjectIDFromHex(postId)
+	result, err := s.mongo.posts.UpdateOne(sessCtx, bson.M{"_id": postMongoId}, bson.M{"$inc": bson.M{"replyCount": delta}})
+	if err != nil {
+		return fmt.Errorf("failed to update reply count: %s %w", err.Error(), storage.InternalError)
+	}
+	if result.MatchedCount == 0 {
+		return nil
+	}
+	return s.enqueue(sessCtx, createPatchPostTask(postMongoId))
+}
+
+func (s *MongoStorageWithBroker) GetReplies(
+	ctx context.Context, postId string, page *string, size int) ([]models.Post, *string, error) {
+	if _, err := s.findPost(ctx, postId); err != nil {
+		return nil, nil, err
+	}
+	filter := bson.M{"replyToPostId": postId}
+	if page != nil {
+		pageId, err := primitive.ObjectIDFromHex(*page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid replies page %s: %w", *page, storage.ClientError)
+		}
+		filter["_id"] = bson.M{"$gte": pageId}
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "_id", Value: 1}})
+	queryOptions.SetLimit(int64(size + 1))
+	cursor, err := s.mongo.posts.Find(ctx, filter, queryOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find replies: %s %w", err.Error(), storage.InternalError)
+	}
+	var replies []Post
+	if err = cursor.All(ctx, &replies); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+
+	result := make([]models.Post, 0, size)
+	for i := range replies {
+		if len(result) == size {
+			nextPage := replies[i].Id.Hex()
+			return result, &nextPage, nil
+		}
+		result = append(result, &replies[i])
+	}
+	return result, nil, nil
+}
@@ -0,0 +1,229 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"miniblog/storage"
+)
+
+// repostCounter is the field of the reposted post counting reposts of the kind of post.
+func repostCounter(post *Post) string {
+	if storage.IsPlainRepost(post) {
+		return "repostCount"
+	}
+	return "quoteCount"
+}
+
+// findRepostedPost returns the post reposted by a repost of the post with id postId:
+// reposting a plain repost reposts the original post.
+func (s *MongoStorageWithBroker) findRepostedPost(ctx context.Context, postId string) (*Post, error) {
+	reposted, err := s.findPost(ctx, postId)
+	if err == nil && storage.IsPlainRepost(reposted) {
+		reposted, err = s.findPost(ctx, reposted.RepostOfPostId)
+	}
+	if errors.Is(err, storage.NotFoundError) {
+		return nil, fmt.Errorf("reposted post %s not found: %w", postId, storage.NotFoundError)
+	}
+	return reposted, err
+}
+
+// setRepostOf makes post a repost of the post with id repostOfPostId and counts the repost.
+func (s *MongoStorageWithBroker) setRepostOf(sessCtx mongo.SessionContext, post *Post, repostOfPostId string) error {
+	reposted, err := s.findRepostedPost(sessCtx, repostOfPostId)
+	if err != nil {
+		return err
+	}
+	post.RepostOfPostId = reposted.Id.Hex()
+	if storage.IsPlainRepost(post) {
+		count, err := s.mongo.posts.CountDocuments(sessCtx, bson.M{
+			"authorId":       post.AuthorId,
+			"repostOfPostId": post.RepostOfPostId,
+			"text":           bson.M{"$exists": false},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to find reposts: %s %w", err.Error(), storage.InternalError)
+		}
+		if count > 0 {
+			return fmt.Errorf("post %s is already reposted by %s: %w", post.RepostOfPostId, post.AuthorId, storage.Conflict)
+		}
+	}
+	// concurrent reposts of the post conflict on the counter, so the check above is not raced
+	_, err = s.mongo.posts.UpdateOne(sessCtx, bson.M{"_id": reposted.Id}, bson.M{"$inc": bson.M{repostCounter(post): 1}})
+	if err != nil {
+		return fmt.Errorf("failed to update repost count: %s %w", err.Error(), storage.InternalError)
+	}
+	return s.enqueue(sessCtx, createPatchPostTask(reposted.Id))
+}
+
+// unsetRepostOf uncounts the deleted repost and removes the reposted post from feeds it was brought to.
+func (s *MongoStorageWithBroker) unsetRepostOf(sessCtx mongo.SessionContext, deleted *Post) error {
+	repostedId, _ := primitive.ObjectIDFromHex(deleted.RepostOfPostId)
+	result, err := s.mongo.posts.UpdateOne(sessCtx, bson.M{"_id": repostedId}, bson.M{"$inc": bson.M{repostCounter(deleted): -1}})
+	if err != nil {
+		return fmt.Errorf("failed to update repost count: %s %w", err.Error(), storage.InternalError)
+	}
+	if result.MatchedCount > 0 {
+		if err = s.enqueue(sessCtx, createPatchPostTask(repostedId)); err != nil {
+			return err
+		}
+	}
+	if storage.IsPlainRepost(deleted) {
+		return s.enqueue(sessCtx, createDeleteRepostTask(repostedId, deleted.AuthorId))
+	}
+	return nil
+}
+
+// updateFeedNewRepost adds the post reposted by the plain repost to feeds of subscribers
+// that do not have it yet. Returns the reposted post attributed to the repost and the readers
+// whose feeds got it, the post is nil if it was deleted.
+func (s *MongoStorageWithBroker) updateFeedNewRepost(
+	ctx context.Context, repost *Post, subscribers []string) (*Post, []string, error) {
+	reposted, err := s.findPost(ctx, repost.RepostOfPostId)
+	if errors.Is(err, storage.NotFoundError) {
+		log.Printf("Update feed: reposted post %s was deleted", repost.RepostOfPostId)
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("update feed: failed to get reposted post: %w", err)
+	}
+
+	mergedOnRead := make(map[string]bool)
+	if reposted.FanoutOnRead {
+		// followers of the author read the post from the author's posts
+		followers, err := s.followersOf(ctx, reposted.AuthorId, subscribers)
+		if err != nil {
+			return nil, nil, err
+		}
+		mergedOnRead = userSet(followers)
+	}
+
+	var writes []mongo.WriteModel
+	var readers []string
+	for _, subscriber := range subscribers {
+		if subscriber == reposted.AuthorId || mergedOnRead[subscriber] {
+			continue
+		}
+		feedItem := newFeedItem(subscriber, reposted)
+		feedItem.RepostedBy = repost.AuthorId
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"userId": subscriber, "postId": reposted.Id}).
+			SetUpdate(bson.M{"$setOnInsert": feedItem}).
+			SetUpsert(true))
+		readers = append(readers, subscriber)
+	}
+	if len(writes) == 0 {
+		log.Printf("Update feed: nothing to insert")
+		return reposted, nil, nil
+	}
+	result, err := s.mongo.feed.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to insert reposted feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	log.Printf("update feed - added repost: Inserted %d feedItems", result.UpsertedCount)
+	// UpsertedIDs is keyed by indices of the writes
+	upserted := make([]string, 0, len(result.UpsertedIDs))
+	for i := range result.UpsertedIDs {
+		upserted = append(upserted, readers[i])
+	}
+	if _, err = s.trimFeedsOf(ctx, upserted); err != nil {
+		return nil, nil, err
+	}
+	reposted.RepostedBy = repost.AuthorId
+	return reposted, upserted, nil
+}
+
+// restoreReposts brings the post back to feeds of readers following authors of its other plain reposts.
+func (s *MongoStorageWithBroker) restoreReposts(ctx context.Context, postId primitive.ObjectID, readers []string) error {
+	cursor, err := s.mongo.posts.Find(ctx, bson.M{"repostOfPostId": postId.Hex(), "text": bson.M{"$exists": false}})
+	if err != nil {
+		return fmt.Errorf("failed to find reposts: %s %w", err.Error(), storage.InternalError)
+	}
+	var reposts []Post
+	if err = cursor.All(ctx, &reposts); err != nil {
+		return fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	for _, repost := range reposts {
+		followers, err := s.followersOf(ctx, repost.AuthorId, readers)
+		if err != nil {
+			return err
+		}
+		var subscribers []string
+		for _, follower := range followers {
+			if follower != repost.AuthorId {
+				subscribers = append(subscribers, follower)
+			}
+		}
+		if len(subscribers) == 0 {
+			continue
+		}
+		if _, _, err = s.updateFeedNewRepost(ctx, &repost, subscribers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFollowedReposts brings the posts back to user's feed if authors the user follows plainly reposted them.
+func (s *MongoStorageWithBroker) restoreFollowedReposts(ctx context.Context, userId string, postIds []string) error {
+	if len(postIds) == 0 {
+		return nil
+	}
+	subscriptions, err := s.GetSubscriptions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+	cursor, err := s.mongo.posts.Find(ctx, bson.M{
+		"authorId":       bson.M{"$in": subscriptions},
+		"repostOfPostId": bson.M{"$in": postIds},
+		"text":           bson.M{"$exists": false},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find reposts: %s %w", err.Error(), storage.InternalError)
+	}
+	var reposts []Post
+	if err = cursor.All(ctx, &reposts); err != nil {
+		return fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	for _, repost := range reposts {
+		if _, _, err = s.updateFeedNewRepost(ctx, &repost, []string{userId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateFeedDeleteRepost removes the post from feeds it was brought to by the plain repost of reposter,
+// unless other followed authors reposted it as well.
+func (s *MongoStorageWithBroker) UpdateFeedDeleteRepost(ctx context.Context, postId string, reposter string) (int, error) {
+	postObjId, _ := primitive.ObjectIDFromHex(postId)
+	filter := bson.M{"postId": postObjId, "repostedBy": reposter}
+	readers, err := s.mongo.feed.Distinct(ctx, "userId", filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find reposted feed items: %s %w", err.Error(), storage.InternalError)
+	}
+	deleteResult, err := s.mongo.feed.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete repost from feed: %s %w", err.Error(), storage.InternalError)
+	}
+	readerIds := make([]string, 0, len(readers))
+	for _, reader := range readers {
+		if id, ok := reader.(string); ok {
+			readerIds = append(readerIds, id)
+		}
+	}
+	if len(readerIds) > 0 {
+		if err = s.restoreReposts(ctx, postObjId, readerIds); err != nil {
+			return 0, err
+		}
+	}
+	return int(deleteResult.DeletedCount), nil
+}
@@ -0,0 +1,79 @@
+package persistent
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"strconv"
+)
+
+type Revision struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	PostId    primitive.ObjectID `bson:"postId" json:"-"`
+	Version   int64              `bson:"version" json:"version"`
+	Text      string             `bson:"text" json:"text"`
+	CreatedAt string             `bson:"createdAt" json:"createdAt"`
+}
+
+func (r *Revision) GetVersion() int64 {
+	return r.Version
+}
+
+func (r *Revision) GetText() string {
+	return r.Text
+}
+
+func (r *Revision) GetCreatedAt() string {
+	return r.CreatedAt
+}
+
+func newRevision(post *Post) Revision {
+	return Revision{
+		PostId:    post.Id,
+		Version:   post.Version,
+		Text:      post.Text,
+		CreatedAt: post.LastModifiedAt,
+	}
+}
+
+func (s *MongoStorageWithBroker) GetRevisions(
+	ctx context.Context, postId string, page *string, size int) ([]models.Revision, *string, error) {
+	post, err := s.findPost(ctx, postId)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := bson.M{"postId": post.Id}
+	if page != nil {
+		version, err := strconv.ParseInt(*page, 10, 64)
+		if err != nil || version < 0 || version >= post.Version {
+			return nil, nil, fmt.Errorf("invalid revisions page %s: %w", *page, storage.ClientError)
+		}
+		filter["version"] = bson.M{"$lte": version}
+	}
+
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "version", Value: -1}})
+	queryOptions.SetLimit(int64(size + 1))
+	cursor, err := s.mongo.revisions.Find(ctx, filter, queryOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find revisions: %s %w", err.Error(), storage.InternalError)
+	}
+	var revisions []Revision
+	if err = cursor.All(ctx, &revisions); err != nil {
+		return nil, nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+
+	result := make([]models.Revision, 0, size)
+	for i := range revisions {
+		if len(result) == size {
+			nextPage := strconv.FormatInt(revisions[i].Version, 10)
+			return result, &nextPage, nil
+		}
+		result = append(result, &revisions[i])
+	}
+	return result, nil, nil
+}
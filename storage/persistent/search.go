@@ -0,0 +1,187 @@
+package persistent
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SEARCH_RESULTS_TTL is how long the next pages of a search can be read after its first page
+const SEARCH_RESULTS_TTL = 30 * time.Minute
+
+// SearchResults are ids of posts found by a search beyond its first page, most relevant first.
+// Posts are ranked once, so that next pages neither rank all matching posts again nor shift when posts change.
+type SearchResults struct {
+	Id        primitive.ObjectID   `bson:"_id,omitempty"`
+	PostIds   []primitive.ObjectID `bson:"postIds"`
+	CreatedAt time.Time            `bson:"createdAt"`
+}
+
+func encodeSearchPage(resultsId primitive.ObjectID, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(resultsId.Hex() + " " + strconv.Itoa(offset)))
+}
+
+func decodeSearchPage(page string) (primitive.ObjectID, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(page)
+	if err != nil {
+		return primitive.NilObjectID, 0, fmt.Errorf("invalid search page %s: %w", page, storage.ClientError)
+	}
+	parts := strings.SplitN(string(raw), " ", 2)
+	if len(parts) != 2 {
+		return primitive.NilObjectID, 0, fmt.Errorf("invalid search page %s: %w", page, storage.ClientError)
+	}
+	resultsId, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return primitive.NilObjectID, 0, fmt.Errorf("invalid search page results %s: %w", page, storage.ClientError)
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil || offset < 0 {
+		return primitive.NilObjectID, 0, fmt.Errorf("invalid search page offset %s: %w", page, storage.ClientError)
+	}
+	return resultsId, offset, nil
+}
+
+// SearchPosts uses the text index of posts, see ensurePostsIndexes. Plain reposts have no text, so they are not found.
+// The first page ranks up to MAX_SEARCH_RESULTS matching posts and keeps the rest of them for the next pages.
+func (s *MongoStorageWithBroker) SearchPosts(
+	ctx context.Context, query storage.SearchQuery, page *string, size int) ([]models.Post, *string, error) {
+	if page != nil {
+		return s.searchResultsPage(ctx, *page, size)
+	}
+
+	postIds, err := s.rankPosts(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(postIds) <= size {
+		posts, err := s.postsByIds(ctx, postIds)
+		return posts, nil, err
+	}
+	results := SearchResults{PostIds: postIds[size:], CreatedAt: time.Now().UTC()}
+	inserted, err := s.mongo.searchResults.InsertOne(ctx, results)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to save search results: %s %w", err.Error(), storage.InternalError)
+	}
+	posts, err := s.postsByIds(ctx, postIds[:size])
+	if err != nil {
+		return nil, nil, err
+	}
+	nextPage := encodeSearchPage(inserted.InsertedID.(primitive.ObjectID), 0)
+	return posts, &nextPage, nil
+}
+
+// rankPosts returns ids of the most relevant posts matching the query, then newest first.
+func (s *MongoStorageWithBroker) rankPosts(ctx context.Context, query storage.SearchQuery) ([]primitive.ObjectID, error) {
+	match := bson.M{"$text": bson.M{"$search": strings.Join(query.Terms, " ")}}
+	if query.AuthorId != "" {
+		match["authorId"] = query.AuthorId
+	}
+	createdAt := bson.M{}
+	if query.CreatedAfter != "" {
+		createdAt["$gte"] = query.CreatedAfter
+	}
+	if query.CreatedBefore != "" {
+		createdAt["$lte"] = query.CreatedBefore
+	}
+	if len(createdAt) > 0 {
+		match["createdAt"] = createdAt
+	}
+
+	cursor, err := s.mongo.posts.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: storage.MAX_SEARCH_RESULTS}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search posts: %s %w", err.Error(), storage.InternalError)
+	}
+	var found []Post
+	if err = cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	postIds := make([]primitive.ObjectID, len(found))
+	for i, post := range found {
+		postIds[i] = post.Id
+	}
+	return postIds, nil
+}
+
+// searchResultsPage returns a next page of the search results saved by its first page.
+// Posts deleted since then are skipped, the page is filled up with the following ones.
+func (s *MongoStorageWithBroker) searchResultsPage(ctx context.Context, page string, size int) ([]models.Post, *string, error) {
+	resultsId, offset, err := decodeSearchPage(page)
+	if err != nil {
+		return nil, nil, err
+	}
+	posts := make([]models.Post, 0, size)
+	for {
+		missing := size - len(posts)
+		var results SearchResults
+		err = s.mongo.searchResults.FindOne(
+			ctx,
+			bson.M{"_id": resultsId},
+			options.FindOne().SetProjection(bson.M{"postIds": bson.M{"$slice": bson.A{offset, missing + 1}}}),
+		).Decode(&results)
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, fmt.Errorf("search page %s has expired: %w", page, storage.ClientError)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find search results: %s %w", err.Error(), storage.InternalError)
+		}
+
+		postIds := results.PostIds
+		hasMore := len(postIds) > missing
+		if hasMore {
+			postIds = postIds[:missing]
+		}
+		found, err := s.postsByIds(ctx, postIds)
+		if err != nil {
+			return nil, nil, err
+		}
+		posts = append(posts, found...)
+		offset += len(postIds)
+		if !hasMore {
+			return posts, nil, nil
+		}
+		if len(posts) == size {
+			nextPage := encodeSearchPage(resultsId, offset)
+			return posts, &nextPage, nil
+		}
+	}
+}
+
+// postsByIds returns posts in the order of ids, deleted posts are skipped.
+func (s *MongoStorageWithBroker) postsByIds(ctx context.Context, postIds []primitive.ObjectID) ([]models.Post, error) {
+	posts := make([]models.Post, 0, len(postIds))
+	if len(postIds) == 0 {
+		return posts, nil
+	}
+	cursor, err := s.mongo.posts.Find(ctx, bson.M{"_id": bson.M{"$in": postIds}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find posts: %s %w", err.Error(), storage.InternalError)
+	}
+	var found []Post
+	if err = cursor.All(ctx, &found); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	byId := make(map[primitive.ObjectID]*Post, len(found))
+	for i := range found {
+		byId[found[i].Id] = &found[i]
+	}
+	for _, postId := range postIds {
+		if post, ok := byId[postId]; ok {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
+}
@@ -0,0 +1,166 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+const IN_PROCESS_WORKERS int = 4
+
+// skippedTaskError is the result of a task that was not run, since an earlier task with the same key failed.
+var skippedTaskError = errors.New("skipped after a failed task with the same key")
+
+// TaskQueue runs feed tasks asynchronously.
+// Tasks with the same key (see taskKey) are run one by one in the order they are sent.
+type TaskQueue interface {
+	// Send schedules task.
+	Send(ctx context.Context, task tasks.Signature) error
+	// Wait blocks until the tasks sent since the previous call are handed over for good (stored by the broker
+	// or run in process) and returns their results in the order they were sent.
+	// A queue that does not track how tasks end reports nil for every task it handed over.
+	Wait(ctx context.Context) ([]error, error)
+}
+
+// taskKey returns the key of the entity task changes: the post for post tasks and
+// the pair of users for subscription tasks.
+func taskKey(task tasks.Signature) string {
+	if len(task.Args) == 0 {
+		return task.Name
+	}
+	switch task.Name {
+	case "addSubscription", "removeSubscription":
+		if len(task.Args) < 2 {
+			return fmt.Sprintf("subscription:%v", task.Args[0].Value)
+		}
+		return fmt.Sprintf("subscription:%v:%v", task.Args[0].Value, task.Args[1].Value)
+	default:
+		return fmt.Sprintf("post:%v", task.Args[0].Value)
+	}
+}
+
+// taskShard maps task key to one of n shards.
+func taskShard(key string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+type queuedTask struct {
+	task  tasks.Signature
+	key   string
+	index int
+}
+
+// InProcessTaskQueue runs tasks on a pool of goroutines of the current process.
+// Every goroutine has its own queue, tasks with the same key go to the same queue.
+// Send and Wait must not be called concurrently.
+type InProcessTaskQueue struct {
+	shards  []chan queuedTask
+	run     func(task tasks.Signature) error
+	pending sync.WaitGroup
+	mut     sync.Mutex
+	// results of the tasks sent since the previous Wait
+	results []error
+	// keys of the tasks failed since the previous Wait
+	failedKeys map[string]bool
+}
+
+func (q *InProcessTaskQueue) Send(ctx context.Context, task tasks.Signature) error {
+	key := taskKey(task)
+	q.mut.Lock()
+	index := len(q.results)
+	q.results = append(q.results, nil)
+	q.mut.Unlock()
+
+	q.pending.Add(1)
+	select {
+	case q.shards[taskShard(key, len(q.shards))] <- queuedTask{task: task, key: key, index: index}:
+		return nil
+	case <-ctx.Done():
+		q.setResult(index, key, ctx.Err())
+		q.pending.Done()
+		return ctx.Err()
+	}
+}
+
+// Wait returns the results of the tasks sent since the previous call.
+func (q *InProcessTaskQueue) Wait(ctx context.Context) ([]error, error) {
+	done := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	results := q.results
+	q.results = nil
+	q.failedKeys = make(map[string]bool)
+	return results, nil
+}
+
+func (q *InProcessTaskQueue) setResult(index int, key string, err error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.results[index] = err
+	if err != nil {
+		q.failedKeys[key] = true
+	}
+}
+
+func (q *InProcessTaskQueue) work(shard <-chan queuedTask) {
+	for queued := range shard {
+		q.mut.Lock()
+		skip := q.failedKeys[queued.key]
+		q.mut.Unlock()
+
+		var err error
+		if skip {
+			// the failed task is sent again, later tasks must not overtake it
+			err = skippedTaskError
+		} else if err = q.run(queued.task); err != nil {
+			log.Printf("Task %s failed: %s", queued.task.Name, err.Error())
+		}
+		q.setResult(queued.index, queued.key, err)
+		q.pending.Done()
+	}
+}
+
+func newInProcessTaskQueue(workers int, run func(task tasks.Signature) error) *InProcessTaskQueue {
+	q := &InProcessTaskQueue{
+		shards:     make([]chan queuedTask, 0, workers),
+		run:        run,
+		failedKeys: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		shard := make(chan queuedTask, 1)
+		q.shards = append(q.shards, shard)
+		go q.work(shard)
+	}
+	return q
+}
+
+// CreateInProcessTaskQueue creates a queue running feed tasks without the broker.
+func CreateInProcessTaskQueue(workers int) *InProcessTaskQueue {
+	return newInProcessTaskQueue(workers, runTask)
+}
+
+// CreateInProcessWorker updates feeds in the current process, without the broker.
+func CreateInProcessWorker(ctx context.Context) error {
+	go TrimFeeds(ctx)
+	if GetMongoStorageWithoutBroker().feedConfig.Source == ChangeStreamFeedSource {
+		return CreateChangeStreamWorker(ctx)
+	}
+	RelayOutbox(ctx, CreateInProcessTaskQueue(IN_PROCESS_WORKERS))
+	return ctx.Err()
+}
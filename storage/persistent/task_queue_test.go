@@ -0,0 +1,81 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"github.com/RichardKnop/machinery/v1/tasks"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestInProcessTaskQueueWaitsForSentTasks(t *testing.T) {
+	ctx := context.Background()
+	var mut sync.Mutex
+	ran := make([]string, 0)
+	queue := newInProcessTaskQueue(2, func(task tasks.Signature) error {
+		mut.Lock()
+		defer mut.Unlock()
+		ran = append(ran, task.Name)
+		if task.Name == "failing" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	for _, name := range []string{"first", "second", "third"} {
+		require.NoError(t, queue.Send(ctx, tasks.Signature{Name: name}))
+	}
+	results, err := queue.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []error{nil, nil, nil}, results)
+	require.ElementsMatch(t, []string{"first", "second", "third"}, ran)
+
+	require.NoError(t, queue.Send(ctx, tasks.Signature{Name: "failing"}))
+	require.NoError(t, queue.Send(ctx, tasks.Signature{Name: "fourth"}))
+	results, err = queue.Wait(ctx)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Error(t, results[0])
+	require.NoError(t, results[1])
+	require.Len(t, ran, 5)
+
+	// results are reported once
+	results, err = queue.Wait(ctx)
+	require.NoError(t, err)
+	require.Empty(t, results)
+}
+
+func TestInProcessTaskQueueRunsTasksOfKeyInOrder(t *testing.T) {
+	ctx := context.Background()
+	var mut sync.Mutex
+	ran := make([]string, 0)
+	queue := newInProcessTaskQueue(4, func(task tasks.Signature) error {
+		mut.Lock()
+		defer mut.Unlock()
+		ran = append(ran, task.Name)
+		if task.Name == "addPost" && task.Args[0].Value == "failing" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	post := func(name, postId string) tasks.Signature {
+		return tasks.Signature{Name: name, Args: []tasks.Arg{{Type: "string", Value: postId}}}
+	}
+
+	for _, name := range []string{"addPost", "patchPost", "patchPost", "deletePost"} {
+		require.NoError(t, queue.Send(ctx, post(name, "post")))
+	}
+	_, err := queue.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"addPost", "patchPost", "patchPost", "deletePost"}, ran)
+
+	// tasks following the failed one are not run until it succeeds
+	require.NoError(t, queue.Send(ctx, post("addPost", "failing")))
+	require.NoError(t, queue.Send(ctx, post("deletePost", "failing")))
+	results, err := queue.Wait(ctx)
+	require.NoError(t, err)
+	require.Error(t, results[0])
+	require.ErrorIs(t, results[1], skippedTaskError)
+	require.Len(t, ran, 5)
+}
@@ -0,0 +1,203 @@
+package persistent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"regexp"
+	"time"
+)
+
+type User struct {
+	Id          string `bson:"_id" json:"id"`
+	Handle      string `bson:"handle" json:"handle"`
+	DisplayName string `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	Bio         string `bson:"bio,omitempty" json:"bio,omitempty"`
+	AvatarUrl   string `bson:"avatarUrl,omitempty" json:"avatarUrl,omitempty"`
+	CreatedAt   string `bson:"createdAt" json:"createdAt"`
+	// SearchNames are the names the user is found by, see storage.UserSearchNames
+	SearchNames []string `bson:"searchNames,omitempty" json:"-"`
+	// FollowerCount is a copy of UserStats.FollowerCount, users are ranked by it in search
+	FollowerCount int64 `bson:"followerCount,omitempty" json:"-"`
+}
+
+func (u *User) GetId() string {
+	return u.Id
+}
+
+func (u *User) GetHandle() string {
+	return u.Handle
+}
+
+func (u *User) GetDisplayName() string {
+	return u.DisplayName
+}
+
+func (u *User) GetBio() string {
+	return u.Bio
+}
+
+func (u *User) GetAvatarUrl() string {
+	return u.AvatarUrl
+}
+
+func (u *User) GetCreatedAt() string {
+	return u.CreatedAt
+}
+
+func profileFields(profile storage.UserProfile) bson.M {
+	fields := bson.M{}
+	if profile.Handle != nil {
+		fields["handle"] = *profile.Handle
+	}
+	if profile.DisplayName != nil {
+		fields["displayName"] = *profile.DisplayName
+	}
+	if profile.Bio != nil {
+		fields["bio"] = *profile.Bio
+	}
+	if profile.AvatarUrl != nil {
+		fields["avatarUrl"] = *profile.AvatarUrl
+	}
+	return fields
+}
+
+func (s *MongoStorageWithBroker) CreateUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	if profile.Handle == nil {
+		return nil, fmt.Errorf("handle is required: %w", storage.ClientError)
+	}
+	user := User{
+		Id:        userId,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	fields := profileFields(profile)
+	fields["_id"] = user.Id
+	fields["createdAt"] = user.CreatedAt
+	displayName, _ := fields["displayName"].(string)
+	fields["searchNames"] = storage.UserSearchNames(*profile.Handle, displayName)
+	err := s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// writing the stats conflicts with a concurrent subscription, so its follower is either counted
+		// in the stats read here or added to the inserted user by incFollowerCount
+		var stats UserStats
+		err := s.mongo.userStats.FindOneAndUpdate(
+			sessCtx,
+			bson.M{"_id": userId},
+			bson.M{"$set": bson.M{"userCreatedAt": user.CreatedAt}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&stats)
+		if err != nil {
+			return fmt.Errorf("failed to read user stats: %s %w", err.Error(), storage.InternalError)
+		}
+		fields["followerCount"] = stats.FollowerCount
+		_, err = s.mongo.users.InsertOne(sessCtx, fields)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("user or handle already exists: %s %w", err.Error(), storage.Conflict)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to insert user: %s %w", err.Error(), storage.InternalError)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUser(ctx, userId)
+}
+
+func (s *MongoStorageWithBroker) GetUser(ctx context.Context, userId string) (models.User, error) {
+	var user User
+	err := s.mongo.users.FindOne(ctx, bson.M{"_id": userId}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, fmt.Errorf("no user with id %s: %w", userId, storage.NotFoundError)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user: %s %w", err.Error(), storage.InternalError)
+	}
+	return &user, nil
+}
+
+func (s *MongoStorageWithBroker) GetUsers(ctx context.Context, userIds []string) ([]models.User, error) {
+	cursor, err := s.mongo.users.Find(ctx, bson.M{"_id": bson.M{"$in": userIds}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %s %w", err.Error(), storage.InternalError)
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	result := make([]models.User, 0, len(users))
+	for i := range users {
+		result = append(result, &users[i])
+	}
+	return result, nil
+}
+
+func (s *MongoStorageWithBroker) PatchUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	fields := profileFields(profile)
+	if len(fields) == 0 {
+		return s.GetUser(ctx, userId)
+	}
+	var user User
+	// search names depend on both the handle and the display name, so they are updated in the same transaction
+	err := s.withTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		err := s.mongo.users.FindOneAndUpdate(
+			sessCtx,
+			bson.M{"_id": userId},
+			bson.M{"$set": fields},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&user)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("no user with id %s: %w", userId, storage.NotFoundError)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("handle already exists: %s %w", err.Error(), storage.Conflict)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update user: %s %w", err.Error(), storage.InternalError)
+		}
+		if profile.Handle == nil && profile.DisplayName == nil {
+			return nil
+		}
+		user.SearchNames = storage.UserSearchNames(user.Handle, user.DisplayName)
+		_, err = s.mongo.users.UpdateOne(sessCtx, bson.M{"_id": userId}, bson.M{"$set": bson.M{"searchNames": user.SearchNames}})
+		if err != nil {
+			return fmt.Errorf("failed to update user search names: %s %w", err.Error(), storage.InternalError)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SearchUsers matches prefixes with the search names index, see ensureUsersIndexes.
+// Follower counts are copied to users, so the matches are ranked by a top-size sort without joining userStats.
+func (s *MongoStorageWithBroker) SearchUsers(ctx context.Context, prefixes []string, size int) ([]models.User, error) {
+	conditions := make(bson.A, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		// an anchored case sensitive regex is a range scan of the index
+		conditions = append(conditions, bson.M{"searchNames": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	}
+	queryOptions := options.Find()
+	queryOptions.SetSort(bson.D{{Key: "followerCount", Value: -1}, {Key: "handle", Value: 1}})
+	queryOptions.SetLimit(int64(size))
+	cursor, err := s.mongo.users.Find(ctx, bson.M{"$and": conditions}, queryOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %s %w", err.Error(), storage.InternalError)
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("decode error: %s, %w", err, storage.InternalError)
+	}
+	result := make([]models.User, 0, len(users))
+	for i := range users {
+		result = append(result, &users[i])
+	}
+	return result, nil
+}
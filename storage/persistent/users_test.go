@@ -0,0 +1,46 @@
+package persistent
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"miniblog/storage"
+	"testing"
+)
+
+func TestSearchUsersRanksByFollowers(t *testing.T) {
+	s := createTestStorage(t)
+	ctx := context.Background()
+
+	// handles are unique per run, since the test database is not cleaned
+	popular, unpopular := primitive.NewObjectID().Hex(), primitive.NewObjectID().Hex()
+	prefix := "p" + popular[len(popular)-8:]
+	for userId, handle := range map[string]string{popular: prefix + "_a", unpopular: prefix + "_b"} {
+		handle := handle
+		_, err := s.CreateUser(ctx, userId, storage.UserProfile{Handle: &handle})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Subscribe(ctx, popular, primitive.NewObjectID().Hex()))
+	// followers of a user are counted before the profile is created
+	late := primitive.NewObjectID().Hex()
+	require.NoError(t, s.Subscribe(ctx, late, primitive.NewObjectID().Hex()))
+	require.NoError(t, s.Subscribe(ctx, late, primitive.NewObjectID().Hex()))
+	lateHandle := prefix + "_c"
+	_, err := s.CreateUser(ctx, late, storage.UserProfile{Handle: &lateHandle})
+	require.NoError(t, err)
+
+	users, err := s.SearchUsers(ctx, []string{prefix}, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 3)
+	require.Equal(t, late, users[0].GetId())
+	require.Equal(t, popular, users[1].GetId())
+	require.Equal(t, unpopular, users[2].GetId())
+
+	displayName := "Renamed"
+	_, err = s.PatchUser(ctx, unpopular, storage.UserProfile{DisplayName: &displayName})
+	require.NoError(t, err)
+	users, err = s.SearchUsers(ctx, []string{prefix, "ren"}, 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	require.Equal(t, unpopular, users[0].GetId())
+}
@@ -3,12 +3,15 @@ package persistent_cached
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
 	"miniblog/storage"
 	"miniblog/storage/models"
 	"miniblog/storage/persistent"
 	"strconv"
+	"time"
 )
 
 // TODO: retry on redis fails
@@ -17,16 +20,23 @@ import (
 // KEYS[1] - key
 // KEYS[2] - version
 // KEYS[3] - value
+// ARGV[1] - ttl in seconds
+// A deleted or invalidated post is not cached again until its marker expires.
 var UPDATE_SCRIPT_STR = `
+	if (redis.call("hexists", KEYS[1], "deleted") == 1 or redis.call("hexists", KEYS[1], "invalidated") == 1) then
+	  return 0
+	end
 	local old_version = redis.call("hget", KEYS[1], "version")
 	if (old_version == false) then
 	  redis.call("hset", KEYS[1], "value", KEYS[3])
 	  redis.call("hset", KEYS[1], "version", KEYS[2])
+	  redis.call("expire", KEYS[1], ARGV[1])
 	  return 1
     end
     if (tonumber(old_version) < tonumber(KEYS[2])) then
 	  redis.call("hset", KEYS[1], "value", KEYS[3])
 	  redis.call("hset", KEYS[1], "version", KEYS[2])
+	  redis.call("expire", KEYS[1], ARGV[1])
 	  return 1
     end
     return 0
@@ -36,34 +46,88 @@ var UPDATE_SCRIPT = redis.NewScript(UPDATE_SCRIPT_STR)
 func updateCache(ctx context.Context, client *redis.Client, post models.Post) {
 	j, err := json.Marshal(post)
 	if err != nil {
-		log.Printf("Failed to dump to json:", err)
+		log.Printf("Failed to dump to json: %s", err)
 		return
 	}
 	_, err = UPDATE_SCRIPT.Run(
 		ctx,
 		client,
 		[]string{post.GetId(), strconv.FormatInt(post.GetVersion(), 10), string(j)},
-		[]interface{}{},
+		int(POST_CACHE_TTL.Seconds()),
 	).Result()
 	if err != nil {
-		log.Printf("Failed to update redis cache:", err)
+		log.Printf("Failed to update redis cache: %s", err)
 		return
 	}
 	//log.Printf("Cache update returned: ", updated)
 }
 
 func getFromCache(ctx context.Context, client *redis.Client, postId string) (models.Post, error) {
-	val, err := client.HGet(ctx, postId, "value").Result()
-	if err == nil {
-		var p persistent.Post
-		err = json.Unmarshal([]byte(val), &p)
-		if err == nil {
-			//log.Printf("Got post from redis!")
-			return &p, nil
-		}
+	vals, err := client.HMGet(ctx, postId, "value", "deleted").Result()
+	if err != nil {
+		return nil, err
+	}
+	if vals[1] != nil {
+		return nil, fmt.Errorf("post %s is deleted: %w", postId, storage.NotFoundError)
+	}
+	val, ok := vals[0].(string)
+	if !ok {
+		return nil, redis.Nil
+	}
+	var p persistent.Post
+	if err = json.Unmarshal([]byte(val), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// POST_CACHE_TTL bounds the time counters missed by an invalidation stay stale
+var POST_CACHE_TTL = 10 * time.Minute
+
+// POST_TOMBSTONE_TTL keeps a deleted post out of the cache while reads started before the deletion finish
+var POST_TOMBSTONE_TTL = time.Minute
+
+// POST_INVALIDATION_TTL keeps a post with changed counters out of the cache while reads started before the change finish
+var POST_INVALIDATION_TTL = time.Minute
+
+// tombstoneInCache replaces the cached post with a tombstone, so that a concurrent read of the post
+// from the storage does not put it back into the cache.
+func tombstoneInCache(ctx context.Context, client *redis.Client, postId string) {
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, postId)
+		pipe.HSet(ctx, postId, "deleted", 1)
+		pipe.Expire(ctx, postId, POST_TOMBSTONE_TTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to put tombstone of post to redis cache: %s", err)
+	}
+}
+
+// invalidateInCache drops the cached post, which counters changed without changing its version,
+// and keeps it out of the cache, so that a concurrent read of the post from the storage does not put
+// the old counters back into the cache.
+func invalidateInCache(ctx context.Context, client *redis.Client, postId string) {
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, postId, "value", "version")
+		pipe.HSet(ctx, postId, "invalidated", 1)
+		pipe.Expire(ctx, postId, POST_INVALIDATION_TTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to invalidate post in redis cache: %s", err)
+	}
+}
+
+// invalidateReferencedInCache drops the posts replied or reposted by post, their counters change
+// without changing their versions.
+func invalidateReferencedInCache(ctx context.Context, client *redis.Client, post models.Post) {
+	if post.GetReplyToPostId() != "" {
+		invalidateInCache(ctx, client, post.GetReplyToPostId())
+	}
+	if post.GetRepostOfPostId() != "" {
+		invalidateInCache(ctx, client, post.GetRepostOfPostId())
 	}
-	//log.Printf("Failed to get post from redis:", err)
-	return nil, err
 }
 
 func CreatePersistentStorageCachedWithRedis(persistentStorage storage.Storage, redisUrl string) storage.Storage {
@@ -90,6 +154,10 @@ func (s *PersistentStorageWithCache) Subscribe(ctx context.Context, userId strin
 	return nil
 }
 
+func (s *PersistentStorageWithCache) Unsubscribe(ctx context.Context, userId string, subscriber string) error {
+	return s.persistentStorage.Unsubscribe(ctx, userId, subscriber)
+}
+
 func (s *PersistentStorageWithCache) GetSubscriptions(ctx context.Context, userId string) ([]string, error) {
 	subscriptions, err := s.persistentStorage.GetSubscriptions(ctx, userId)
 	if err != nil {
@@ -106,6 +174,10 @@ func (s *PersistentStorageWithCache) GetSubscribers(ctx context.Context, userId
 	return subscribers, nil
 }
 
+func (s *PersistentStorageWithCache) GetFanoutOnReadAuthors(ctx context.Context, userId string) ([]string, error) {
+	return s.persistentStorage.GetFanoutOnReadAuthors(ctx, userId)
+}
+
 func (s *PersistentStorageWithCache) Feed(ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error) {
 	feed, page, err := s.persistentStorage.Feed(ctx, userId, page, size)
 	if err != nil {
@@ -114,35 +186,112 @@ func (s *PersistentStorageWithCache) Feed(ctx context.Context, userId *string, p
 	return feed, page, nil
 }
 
+func (s *PersistentStorageWithCache) FeedSince(ctx context.Context, userId string, since string, size int) ([]models.Post, *string, error) {
+	return s.persistentStorage.FeedSince(ctx, userId, since, size)
+}
+
+func (s *PersistentStorageWithCache) SetFeedReadMarker(ctx context.Context, userId string, postId string) error {
+	return s.persistentStorage.SetFeedReadMarker(ctx, userId, postId)
+}
+
+func (s *PersistentStorageWithCache) GetFeedUnreadCount(ctx context.Context, userId string) (int, error) {
+	return s.persistentStorage.GetFeedUnreadCount(ctx, userId)
+}
+
 func (s *PersistentStorageWithCache) PatchPost(
 	ctx context.Context,
 	id string,
 	userId string,
 	text string,
+	ifVersion *int64,
 ) (models.Post, error) {
-	post, err := s.persistentStorage.PatchPost(ctx, id, userId, text)
+	post, err := s.persistentStorage.PatchPost(ctx, id, userId, text, ifVersion)
 	if err == nil {
 		updateCache(ctx, s.client, post)
 	}
 	return post, err
 }
 
+func (s *PersistentStorageWithCache) DeletePost(ctx context.Context, id string, userId string) error {
+	post, err := s.GetPost(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = s.persistentStorage.DeletePost(ctx, id, userId)
+	if err == nil {
+		tombstoneInCache(ctx, s.client, id)
+		invalidateReferencedInCache(ctx, s.client, post)
+	}
+	return err
+}
+
+func (s *PersistentStorageWithCache) GetReplies(
+	ctx context.Context,
+	postId string,
+	page *string,
+	size int,
+) ([]models.Post, *string, error) {
+	return s.persistentStorage.GetReplies(ctx, postId, page, size)
+}
+
+func (s *PersistentStorageWithCache) GetPostsByHashtag(
+	ctx context.Context,
+	hashtag string,
+	page *string,
+	size int,
+) ([]models.Post, *string, error) {
+	return s.persistentStorage.GetPostsByHashtag(ctx, hashtag, page, size)
+}
+
+func (s *PersistentStorageWithCache) GetPostsMentioning(
+	ctx context.Context,
+	userId string,
+	page *string,
+	size int,
+) ([]models.Post, *string, error) {
+	return s.persistentStorage.GetPostsMentioning(ctx, userId, page, size)
+}
+
+func (s *PersistentStorageWithCache) SearchPosts(
+	ctx context.Context,
+	query storage.SearchQuery,
+	page *string,
+	size int,
+) ([]models.Post, *string, error) {
+	return s.persistentStorage.SearchPosts(ctx, query, page, size)
+}
+
+func (s *PersistentStorageWithCache) SearchUsers(ctx context.Context, prefixes []string, size int) ([]models.User, error) {
+	return s.persistentStorage.SearchUsers(ctx, prefixes, size)
+}
+
+func (s *PersistentStorageWithCache) GetRevisions(
+	ctx context.Context,
+	postId string,
+	page *string,
+	size int,
+) ([]models.Revision, *string, error) {
+	return s.persistentStorage.GetRevisions(ctx, postId, page, size)
+}
+
 func (s *PersistentStorageWithCache) AddPost(
 	ctx context.Context,
 	userId string,
 	text string,
+	options storage.PostOptions,
 ) (models.Post, error) {
-	post, err := s.persistentStorage.AddPost(ctx, userId, text)
+	post, err := s.persistentStorage.AddPost(ctx, userId, text, options)
 	if err == nil {
 		updateCache(ctx, s.client, post)
+		invalidateReferencedInCache(ctx, s.client, post)
 	}
 	return post, err
 }
 
 func (s *PersistentStorageWithCache) GetPost(ctx context.Context, postId string) (models.Post, error) {
 	p, err := getFromCache(ctx, s.client, postId)
-	if err == nil {
-		return p, nil
+	if err == nil || errors.Is(err, storage.NotFoundError) {
+		return p, err
 	}
 	post, err := s.persistentStorage.GetPost(ctx, postId)
 	if err == nil {
@@ -159,3 +308,31 @@ func (s *PersistentStorageWithCache) GetPostsByUserId(
 ) ([]models.Post, *string, error) {
 	return s.persistentStorage.GetPostsByUserId(ctx, userId, page, size)
 }
+
+// Reactions do not change the post's version, so the cached post is invalidated instead of updated.
+
+func (s *PersistentStorageWithCache) AddReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	err := s.persistentStorage.AddReaction(ctx, postId, userId, reaction)
+	if err == nil {
+		invalidateInCache(ctx, s.client, postId)
+	}
+	return err
+}
+
+func (s *PersistentStorageWithCache) RemoveReaction(ctx context.Context, postId string, userId string, reaction string) error {
+	err := s.persistentStorage.RemoveReaction(ctx, postId, userId, reaction)
+	if err == nil {
+		invalidateInCache(ctx, s.client, postId)
+	}
+	return err
+}
+
+func (s *PersistentStorageWithCache) GetReactions(
+	ctx context.Context,
+	postId string,
+	reaction string,
+	page *string,
+	size int,
+) ([]string, *string, error) {
+	return s.persistentStorage.GetReactions(ctx, postId, reaction, page, size)
+}
@@ -0,0 +1,113 @@
+package persistent_cached
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"miniblog/storage"
+	"miniblog/storage/models"
+	"miniblog/storage/persistent"
+	"time"
+)
+
+// USER_CACHE_TTL bounds the time a profile missed by an invalidation stays stale
+var USER_CACHE_TTL = 10 * time.Minute
+
+// USER_PATCH_MARKER_TTL keeps a patched profile out of the cache while reads started before the patch finish
+var USER_PATCH_MARKER_TTL = time.Minute
+
+// KEYS[1] - key
+// KEYS[2] - patch marker key
+// ARGV[1] - value
+// ARGV[2] - ttl in seconds
+// A patched profile is not cached until its marker expires, the value read may predate the patch.
+var UPDATE_USER_SCRIPT = redis.NewScript(`
+	if (redis.call("exists", KEYS[2]) == 1) then
+	  return 0
+	end
+	redis.call("set", KEYS[1], ARGV[1], "EX", ARGV[2])
+	return 1
+`)
+
+func userCacheKey(userId string) string {
+	return "user:" + userId
+}
+
+func userPatchMarkerKey(userId string) string {
+	return "user:" + userId + ":patched"
+}
+
+func updateUserCache(ctx context.Context, client *redis.Client, user models.User) {
+	j, err := json.Marshal(user)
+	if err != nil {
+		log.Printf("Failed to dump to json: %s", err)
+		return
+	}
+	err = UPDATE_USER_SCRIPT.Run(
+		ctx,
+		client,
+		[]string{userCacheKey(user.GetId()), userPatchMarkerKey(user.GetId())},
+		string(j),
+		int(USER_CACHE_TTL.Seconds()),
+	).Err()
+	if err != nil {
+		log.Printf("Failed to update redis cache: %s", err)
+	}
+}
+
+func getUserFromCache(ctx context.Context, client *redis.Client, userId string) (models.User, error) {
+	val, err := client.Get(ctx, userCacheKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var u persistent.User
+	if err = json.Unmarshal([]byte(val), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// invalidateUserInCache drops the cached profile and marks it patched, so that a concurrent read
+// of the profile from the storage does not put the old one back into the cache.
+func invalidateUserInCache(ctx context.Context, client *redis.Client, userId string) {
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, userPatchMarkerKey(userId), 1, USER_PATCH_MARKER_TTL)
+		pipe.Del(ctx, userCacheKey(userId))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete user from redis cache: %s", err)
+	}
+}
+
+func (s *PersistentStorageWithCache) CreateUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	user, err := s.persistentStorage.CreateUser(ctx, userId, profile)
+	if err == nil {
+		updateUserCache(ctx, s.client, user)
+	}
+	return user, err
+}
+
+func (s *PersistentStorageWithCache) GetUser(ctx context.Context, userId string) (models.User, error) {
+	u, err := getUserFromCache(ctx, s.client, userId)
+	if err == nil {
+		return u, nil
+	}
+	user, err := s.persistentStorage.GetUser(ctx, userId)
+	if err == nil {
+		updateUserCache(ctx, s.client, user)
+	}
+	return user, err
+}
+
+func (s *PersistentStorageWithCache) GetUsers(ctx context.Context, userIds []string) ([]models.User, error) {
+	return s.persistentStorage.GetUsers(ctx, userIds)
+}
+
+func (s *PersistentStorageWithCache) PatchUser(ctx context.Context, userId string, profile storage.UserProfile) (models.User, error) {
+	// the cached profile is dropped rather than updated, since users have no versions to order updates by
+	user, err := s.persistentStorage.PatchUser(ctx, userId, profile)
+	invalidateUserInCache(ctx, s.client, userId)
+	return user, err
+}
@@ -4,7 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"miniblog/storage/models"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
 )
 
 var (
@@ -12,15 +17,265 @@ var (
 	ClientError   = errors.New("storage client error")
 	NotFoundError = fmt.Errorf("%w.not_found", ClientError)
 	Forbidden     = fmt.Errorf("%w.forbidden", ClientError)
+	Conflict      = fmt.Errorf("%w.conflict", ClientError)
+	// PreconditionFailed means the post was modified since the version the client expected
+	PreconditionFailed = fmt.Errorf("%w.precondition_failed", ClientError)
 )
 
+const Like = "like"
+
+// MAX_FEED_UNREAD_COUNT bounds the number of unread posts counted in a feed
+const MAX_FEED_UNREAD_COUNT = 100
+
+// Reactions users can leave on posts, likes are counted separately from the others.
+var Reactions = []string{Like, "love", "haha", "wow", "sad", "angry"}
+
+// UserProfile holds the editable fields of a user. Nil fields are not changed on update.
+type UserProfile struct {
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarUrl   *string
+}
+
+// PostOptions holds the optional fields of a new post.
+type PostOptions struct {
+	// ReplyToPostId makes the post a reply, the replied post must exist
+	ReplyToPostId *string
+	// RepostOfPostId makes the post a repost, a plain one if the text is empty or a quote otherwise.
+	// The reposted post must exist, a user reposts a post without text at most once.
+	RepostOfPostId *string
+}
+
+// IsPlainRepost tells if the post is a repost without text, feeds show the reposted post instead.
+func IsPlainRepost(post models.Post) bool {
+	return post.GetRepostOfPostId() != "" && post.GetText() == ""
+}
+
+const MAX_HASHTAG_LENGTH = 100
+
+// a hashtag starts after a character that cannot be a part of a word, so "a#b" and "&#39;" are not hashtags
+var hashtagRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#])#([\p{L}\p{N}_]+)`)
+
+// ExtractHashtags returns distinct hashtags of the text without "#", in lower case, in order of appearance.
+func ExtractHashtags(text string) []string {
+	var hashtags []string
+	seen := make(map[string]bool)
+	for _, match := range hashtagRegexp.FindAllStringSubmatch(text, -1) {
+		hashtag := strings.ToLower(match[1])
+		if len([]rune(hashtag)) > MAX_HASHTAG_LENGTH || seen[hashtag] {
+			continue
+		}
+		seen[hashtag] = true
+		hashtags = append(hashtags, hashtag)
+	}
+	return hashtags
+}
+
+// HashtagUse is a hashtag of a post counted in trending hashtags at RecordedAt.
+type HashtagUse struct {
+	Tag        string    `bson:"tag"`
+	RecordedAt time.Time `bson:"recordedAt"`
+}
+
+// HashtagTracker counts uses of hashtags in trending hashtags, see trending.Tracker.
+type HashtagTracker interface {
+	Record(ctx context.Context, hashtags []string, recordedAt time.Time) error
+	Remove(ctx context.Context, hashtags []string, recordedAt time.Time) error
+}
+
+// UpdateHashtagUses returns the uses of a post whose hashtags change from previous to current at now,
+// the hashtags new to the post, which are used at now, and the uses of the removed ones.
+// Hashtags of previous without a use were never recorded, e.g. the ones of posts created before trending.
+func UpdateHashtagUses(
+	uses []HashtagUse, previous []string, current []string, now time.Time) ([]HashtagUse, []string, []HashtagUse) {
+	var updated, removed []HashtagUse
+	for _, use := range uses {
+		if containsString(current, use.Tag) {
+			updated = append(updated, use)
+		} else {
+			removed = append(removed, use)
+		}
+	}
+	var added []string
+	for _, hashtag := range current {
+		if !containsString(previous, hashtag) {
+			added = append(added, hashtag)
+			updated = append(updated, HashtagUse{Tag: hashtag, RecordedAt: now})
+		}
+	}
+	return updated, added, removed
+}
+
+// RecordHashtagChanges counts the added hashtags of post as used at now and takes back the removed uses
+// from the moments they were recorded. Trending counts are best effort, errors are only logged.
+func RecordHashtagChanges(
+	ctx context.Context, tracker HashtagTracker, postId string, added []string, now time.Time, removed []HashtagUse) {
+	if tracker == nil {
+		return
+	}
+	if len(added) > 0 {
+		if err := tracker.Record(ctx, added, now); err != nil {
+			log.Printf("Failed to record hashtags of post %s: %s", postId, err.Error())
+		}
+	}
+	for _, use := range removed {
+		if err := tracker.Remove(ctx, []string{use.Tag}, use.RecordedAt); err != nil {
+			log.Printf("Failed to remove hashtags of post %s: %s", postId, err.Error())
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeHashtag brings a hashtag from a request, with or without "#", to the form stored on posts.
+// Returns false if it is not a valid hashtag.
+func NormalizeHashtag(hashtag string) (string, bool) {
+	hashtag = strings.TrimPrefix(hashtag, "#")
+	hashtags := ExtractHashtags("#" + hashtag)
+	if len(hashtags) != 1 || hashtags[0] != strings.ToLower(hashtag) {
+		return "", false
+	}
+	return hashtags[0], true
+}
+
+const MAX_MENTIONS = 50
+
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&@])@([A-Za-z0-9_]+)`)
+
+// ExtractMentions returns distinct mentioned handles or user ids of the text without "@", as written,
+// in order of appearance, up to MAX_MENTIONS of them.
+func ExtractMentions(text string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+	for _, match := range mentionRegexp.FindAllStringSubmatch(text, -1) {
+		mention := match[1]
+		if seen[mention] {
+			continue
+		}
+		if len(mentions) == MAX_MENTIONS {
+			break
+		}
+		seen[mention] = true
+		mentions = append(mentions, mention)
+	}
+	return mentions
+}
+
+// ResolveMentions maps mentions to ids of the mentioned users. A mention is a handle of a user in any case,
+// otherwise an id of an existing user as is, since user ids are taken from credentials unchanged.
+// handles maps handles of existing users to their ids, isUser tells if a user with the id exists.
+// Other mentions are skipped.
+func ResolveMentions(mentions []string, handles map[string]string, isUser func(userId string) bool) []string {
+	var userIds []string
+	seen := make(map[string]bool)
+	for _, mention := range mentions {
+		userId, found := handles[strings.ToLower(mention)]
+		if !found && isUser(mention) {
+			userId, found = mention, true
+		}
+		if found && !seen[userId] {
+			seen[userId] = true
+			userIds = append(userIds, userId)
+		}
+	}
+	return userIds
+}
+
+const MAX_SEARCH_TERMS = 10
+
+// MAX_SEARCH_RESULTS bounds the number of posts found by a search, the most relevant ones are kept
+const MAX_SEARCH_RESULTS = 1000
+
+// SearchQuery selects posts having any of Terms. Empty filters are not applied.
+type SearchQuery struct {
+	Terms    []string
+	AuthorId string
+	// CreatedAfter and CreatedBefore are inclusive bounds of post creation time in RFC 3339 format in UTC
+	CreatedAfter  string
+	CreatedBefore string
+}
+
+// Tokenize splits the text into lower case words, the same way for posts and search queries.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	})
+}
+
+// UserSearchNames returns distinct names a user is found by: the handle and the words of the display name.
+func UserSearchNames(handle string, displayName string) []string {
+	names := []string{handle}
+	for _, word := range Tokenize(displayName) {
+		if word != handle && indexOf(names, word) < 0 {
+			names = append(names, word)
+		}
+	}
+	return names
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
 type Storage interface {
-	AddPost(ctx context.Context, userId string, text string) (models.Post, error)
+	AddPost(ctx context.Context, userId string, text string, options PostOptions) (models.Post, error)
 	GetPost(ctx context.Context, id string) (models.Post, error)
 	GetPostsByUserId(ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error)
-	PatchPost(ctx context.Context, id string, userId string, text string) (models.Post, error)
+	// PatchPost updates the post if its version equals ifVersion, or unconditionally if ifVersion is nil
+	PatchPost(ctx context.Context, id string, userId string, text string, ifVersion *int64) (models.Post, error)
+	DeletePost(ctx context.Context, id string, userId string) error
+	// GetPostsByHashtag returns posts having the normalized hashtag, newest first
+	GetPostsByHashtag(ctx context.Context, hashtag string, page *string, size int) ([]models.Post, *string, error)
+	// GetPostsMentioning returns posts mentioning the user, newest first
+	GetPostsMentioning(ctx context.Context, userId string, page *string, size int) ([]models.Post, *string, error)
+	// SearchPosts returns posts matching the query, most relevant first, then newest first.
+	// Posts are public, so any existing post may be found. Relevance is fixed when the first page is read,
+	// so that posts are not skipped or repeated on the next pages when other posts change.
+	SearchPosts(ctx context.Context, query SearchQuery, page *string, size int) ([]models.Post, *string, error)
+	// GetReplies returns direct replies to the post, oldest first
+	GetReplies(ctx context.Context, postId string, page *string, size int) ([]models.Post, *string, error)
+	// AddReaction is idempotent, a user leaves at most one reaction of each kind on a post
+	AddReaction(ctx context.Context, postId string, userId string, reaction string) error
+	RemoveReaction(ctx context.Context, postId string, userId string, reaction string) error
+	// GetReactions returns users who left the reaction on the post, newest first
+	GetReactions(ctx context.Context, postId string, reaction string, page *string, size int) ([]string, *string, error)
+	// GetRevisions returns earlier versions of the post, newest first. Page token is a version.
+	GetRevisions(ctx context.Context, postId string, page *string, size int) ([]models.Revision, *string, error)
 	Subscribe(ctx context.Context, userId string, subscriber string) error
+	Unsubscribe(ctx context.Context, userId string, subscriber string) error
 	GetSubscriptions(ctx context.Context, userId string) ([]string, error)
 	GetSubscribers(ctx context.Context, userId string) ([]string, error)
+	// GetFanoutOnReadAuthors returns the users followed by the user whose new posts are not added
+	// to the feeds of their subscribers but merged into the feeds on read
+	GetFanoutOnReadAuthors(ctx context.Context, userId string) ([]string, error)
 	Feed(ctx context.Context, userId *string, page *string, size int) ([]models.Post, *string, error)
+	// FeedSince returns posts of the feed newer than the post since, oldest first.
+	// The next page token is the id of the newest returned post, to be passed as since.
+	FeedSince(ctx context.Context, userId string, since string, size int) ([]models.Post, *string, error)
+	// SetFeedReadMarker marks posts of the feed up to the post as read, the marker never moves back
+	SetFeedReadMarker(ctx context.Context, userId string, postId string) error
+	// GetFeedUnreadCount returns the number of posts of the feed newer than the read marker,
+	// up to MAX_FEED_UNREAD_COUNT
+	GetFeedUnreadCount(ctx context.Context, userId string) (int, error)
+	CreateUser(ctx context.Context, userId string, profile UserProfile) (models.User, error)
+	GetUser(ctx context.Context, userId string) (models.User, error)
+	// SearchUsers returns up to size users having a name starting with each of prefixes, see UserSearchNames,
+	// most followed first
+	SearchUsers(ctx context.Context, prefixes []string, size int) ([]models.User, error)
+	// GetUsers returns existing users of userIds, unknown ids are skipped
+	GetUsers(ctx context.Context, userIds []string) ([]models.User, error)
+	PatchUser(ctx context.Context, userId string, profile UserProfile) (models.User, error)
 }
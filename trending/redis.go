@@ -0,0 +1,94 @@
+package trending
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// RedisTracker keeps a sorted set of hashtag uses per bucket in Redis, so counts are shared between replicas.
+type RedisTracker struct {
+	client *redis.Client
+	config Config
+}
+
+func CreateRedisTracker(redisUrl string, config Config) *RedisTracker {
+	return &RedisTracker{
+		client: redis.NewClient(&redis.Options{
+			Addr: redisUrl,
+		}),
+		config: config,
+	}
+}
+
+func bucketKey(bucket int64) string {
+	return "trending:" + strconv.FormatInt(bucket, 10)
+}
+
+func (t *RedisTracker) Record(ctx context.Context, hashtags []string, recordedAt time.Time) error {
+	bucket := t.config.bucket(recordedAt)
+	if len(hashtags) == 0 || bucket <= t.config.bucket(time.Now())-int64(t.config.Buckets) {
+		return nil
+	}
+	key := bucketKey(bucket)
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hashtag := range hashtags {
+			pipe.ZIncrBy(ctx, key, 1, hashtag)
+		}
+		// the bucket leaves the window after Window, it is kept for one more bucket for the readers in progress
+		pipe.Expire(ctx, key, t.config.Window+t.config.bucketDuration())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record hashtags: %w", err)
+	}
+	return nil
+}
+
+func (t *RedisTracker) Remove(ctx context.Context, hashtags []string, recordedAt time.Time) error {
+	bucket := t.config.bucket(recordedAt)
+	if len(hashtags) == 0 || bucket <= t.config.bucket(time.Now())-int64(t.config.Buckets) {
+		return nil
+	}
+	key := bucketKey(bucket)
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hashtag := range hashtags {
+			pipe.ZIncrBy(ctx, key, -1, hashtag)
+		}
+		// uses missing in the bucket are not taken back, an emptied bucket is deleted
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "0")
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove hashtags: %w", err)
+	}
+	return nil
+}
+
+func (t *RedisTracker) Top(ctx context.Context, limit int) ([]TagCount, error) {
+	current := t.config.bucket(time.Now())
+	keys := make([]string, 0, t.config.Buckets)
+	for bucket := current - int64(t.config.Buckets) + 1; bucket <= current; bucket++ {
+		keys = append(keys, bucketKey(bucket))
+	}
+	// the union is computed in a transaction, so the same key is safe to use for all readers
+	unionKey := "trending:top"
+	var top *redis.ZSliceCmd
+	_, err := t.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZUnionStore(ctx, unionKey, &redis.ZStore{Keys: keys, Aggregate: "SUM"})
+		top = pipe.ZRevRangeWithScores(ctx, unionKey, 0, int64(limit-1))
+		pipe.Del(ctx, unionKey)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trending hashtags: %w", err)
+	}
+	result := make([]TagCount, 0, limit)
+	for _, z := range top.Val() {
+		tag, _ := z.Member.(string)
+		result = append(result, TagCount{Tag: tag, Count: int64(z.Score)})
+	}
+	return result, nil
+}
@@ -0,0 +1,153 @@
+package trending
+
+import (
+	"context"
+	"fmt"
+	"miniblog/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TagCount is the number of uses of a hashtag within the window.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int64  `json:"count"`
+}
+
+// Tracker counts hashtag uses over a sliding window.
+type Tracker interface {
+	// Record counts uses of hashtags at recordedAt, usually now. Uses that have left the window are not counted.
+	Record(ctx context.Context, hashtags []string, recordedAt time.Time) error
+	// Remove takes back uses of hashtags recorded at recordedAt, e.g. when they are removed from a post.
+	// Uses that have left the window are not counted anyway.
+	Remove(ctx context.Context, hashtags []string, recordedAt time.Time) error
+	// Top returns up to limit hashtags used most within the window, most used first
+	Top(ctx context.Context, limit int) ([]TagCount, error)
+}
+
+// Config splits the window into Buckets, the window slides by one bucket at a time.
+type Config struct {
+	Window  time.Duration
+	Buckets int
+}
+
+const DEFAULT_BUCKETS = 60
+
+func (c Config) bucketDuration() time.Duration {
+	return c.Window / time.Duration(c.Buckets)
+}
+
+// bucket returns the index of the bucket the moment belongs to.
+func (c Config) bucket(now time.Time) int64 {
+	return now.UnixNano() / int64(c.bucketDuration())
+}
+
+// ConfigFromEnv reads the window from TRENDING_WINDOW in time.ParseDuration format.
+func ConfigFromEnv() (Config, error) {
+	window, err := time.ParseDuration(utils.GetEnvVarWithDefault("TRENDING_WINDOW", "1h"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid TRENDING_WINDOW: %w", err)
+	}
+	if window < time.Duration(DEFAULT_BUCKETS)*time.Second {
+		return Config{}, fmt.Errorf("TRENDING_WINDOW %s is shorter than %d seconds", window, DEFAULT_BUCKETS)
+	}
+	return Config{Window: window, Buckets: DEFAULT_BUCKETS}, nil
+}
+
+// sortTagCounts orders counts by count descending, then by tag, and keeps up to limit of them.
+func sortTagCounts(counts map[string]int64, limit int) []TagCount {
+	result := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		result = append(result, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Tag < result[j].Tag
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+// InMemoryTracker keeps counts in the process memory, so they are not shared between replicas.
+type InMemoryTracker struct {
+	mut    sync.Mutex
+	config Config
+	// buckets[bucket][tag] - uses of tag within bucket
+	buckets map[int64]map[string]int64
+	now     func() time.Time
+}
+
+func CreateInMemoryTracker(config Config) *InMemoryTracker {
+	return &InMemoryTracker{
+		config:  config,
+		buckets: make(map[int64]map[string]int64),
+		now:     time.Now,
+	}
+}
+
+func (t *InMemoryTracker) Record(ctx context.Context, hashtags []string, recordedAt time.Time) error {
+	if len(hashtags) == 0 {
+		return nil
+	}
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	current := t.config.bucket(t.now())
+	for bucket := range t.buckets {
+		if bucket <= current-int64(t.config.Buckets) {
+			delete(t.buckets, bucket)
+		}
+	}
+	bucket := t.config.bucket(recordedAt)
+	if bucket <= current-int64(t.config.Buckets) {
+		return nil
+	}
+	if t.buckets[bucket] == nil {
+		t.buckets[bucket] = make(map[string]int64)
+	}
+	for _, hashtag := range hashtags {
+		t.buckets[bucket][hashtag]++
+	}
+	return nil
+}
+
+func (t *InMemoryTracker) Remove(ctx context.Context, hashtags []string, recordedAt time.Time) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	bucket := t.config.bucket(recordedAt)
+	bucketCounts, found := t.buckets[bucket]
+	if !found {
+		return nil
+	}
+	for _, hashtag := range hashtags {
+		if bucketCounts[hashtag] <= 1 {
+			delete(bucketCounts, hashtag)
+		} else {
+			bucketCounts[hashtag]--
+		}
+	}
+	return nil
+}
+
+func (t *InMemoryTracker) Top(ctx context.Context, limit int) ([]TagCount, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	current := t.config.bucket(t.now())
+	counts := make(map[string]int64)
+	for bucket, bucketCounts := range t.buckets {
+		if bucket <= current-int64(t.config.Buckets) || bucket > current {
+			continue
+		}
+		for tag, count := range bucketCounts {
+			counts[tag] += count
+		}
+	}
+	return sortTagCounts(counts, limit), nil
+}
@@ -0,0 +1,52 @@
+package trending
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestInMemoryTrackerSlidesWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	tracker := CreateInMemoryTracker(Config{Window: time.Minute, Buckets: 6})
+	tracker.now = func() time.Time { return now }
+
+	require.NoError(t, tracker.Record(ctx, []string{"old", "both"}, now))
+	now = now.Add(30 * time.Second)
+	require.NoError(t, tracker.Record(ctx, []string{"new", "both"}, now))
+	require.NoError(t, tracker.Record(ctx, []string{"new"}, now))
+
+	top, err := tracker.Top(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []TagCount{{"both", 2}, {"new", 2}, {"old", 1}}, top)
+	top, err = tracker.Top(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []TagCount{{"both", 2}}, top)
+
+	// the first bucket leaves the window
+	now = now.Add(30 * time.Second)
+	top, err = tracker.Top(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []TagCount{{"new", 2}, {"both", 1}}, top)
+}
+
+func TestInMemoryTrackerRemovesUses(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	tracker := CreateInMemoryTracker(Config{Window: time.Minute, Buckets: 6})
+	tracker.now = func() time.Time { return now }
+
+	recordedAt := now
+	require.NoError(t, tracker.Record(ctx, []string{"kept", "removed"}, now))
+	require.NoError(t, tracker.Record(ctx, []string{"kept"}, now))
+	now = now.Add(30 * time.Second)
+	require.NoError(t, tracker.Remove(ctx, []string{"kept", "removed"}, recordedAt))
+	// uses are not taken back from buckets missing them
+	require.NoError(t, tracker.Remove(ctx, []string{"kept"}, now))
+
+	top, err := tracker.Top(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, []TagCount{{"kept", 1}}, top)
+}